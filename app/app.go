@@ -1,15 +1,18 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/billyyoyo/microj/broker"
 	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/db"
 	"github.com/billyyoyo/microj/logger"
 	"github.com/billyyoyo/microj/registry"
+	"github.com/billyyoyo/microj/trace"
 	"os"
-	"os/signal"
 	"strings"
+	"sync"
 )
 
 var (
@@ -18,8 +21,11 @@ var (
 
 type Server interface {
 	Init()
-	Run()
-	Stop()
+	// Run binds the listener, calls ready once it is bound and serves until stopped,
+	// an error returned from Run aborts the whole app
+	Run(ready func()) error
+	// Stop drains in-flight work, it must return once ctx is done
+	Stop(ctx context.Context)
 }
 
 type application struct {
@@ -28,7 +34,9 @@ type application struct {
 	Port int    `yaml:"port"`
 	Mode string `yaml:"mode"`
 
-	servers []Server
+	servers    []Server
+	registered bool
+	mgmt       management
 }
 
 func Name() string {
@@ -45,6 +53,29 @@ func Mode() string {
 	return app.Mode
 }
 
+// ListenAddr returns the listen address of a server, <key>.addr and <key>.port
+// override the app ones so servers in one app can listen on their own ports
+func ListenAddr(key string) string {
+	addr := config.GetString(key + ".addr")
+	if addr == "" {
+		addr = app.Addr
+	}
+	port := config.GetInt64(key + ".port")
+	if port == 0 {
+		port = int64(app.Port)
+	}
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// registryPort is the port the clients found by the registry dial, the one of the rpc server if it listens
+// on its own rpc.port, registry.port overrides it
+func registryPort(rpcPort int64) int {
+	if rpcPort > 0 {
+		return int(rpcPort)
+	}
+	return app.Port
+}
+
 func App() *application {
 	return app
 }
@@ -58,6 +89,7 @@ func (a *application) Init(fns ...func()) *application {
 	if app.Addr == "" {
 		app.Addr = "0.0.0.0"
 	}
+	logger.SetService(app.Name)
 	a.initBack()
 	if fns != nil {
 		for _, fn := range fns {
@@ -76,8 +108,15 @@ func (a *application) initBack() {
 		err = nil
 	}
 	ro.ServiceName = app.Name
-	ro.Port = app.Port
-	registry.Init(ro)
+	if ro.Port == 0 {
+		ro.Port = registryPort(config.GetInt64("rpc.port"))
+	}
+	if ro.Enable {
+		if p := config.GetInt64("api.port"); p > 0 && int(p) != ro.Port {
+			logger.Warnf("api.port %d is not registered, the nodes found by the registry are dialed on %d", p, ro.Port)
+		}
+	}
+	registry.Setup(ro)
 	bo := broker.Options{}
 	err = config.Scan("broker", &bo)
 	if err != nil {
@@ -85,6 +124,17 @@ func (a *application) initBack() {
 		err = nil
 	}
 	broker.Init(bo)
+	to := trace.Options{}
+	if err = config.Scan("trace", &to); err != nil {
+		logger.Error("no trace config", err)
+	}
+	to.ServiceName = app.Name
+	if err = trace.Init(to); err != nil {
+		logger.Error("trace init error", err)
+	}
+	// no-ops until db.InitDataSource or db.InitRedis
+	AddShutdownHook(SHUTDOWN_ORDER_CLOSE, "db", db.Close)
+	AddHealthCheck("db", db.Ping)
 }
 
 func (a *application) BrokerListener(f func()) *application {
@@ -97,19 +147,69 @@ func (a *application) WithServer(s Server) *application {
 	return a
 }
 
+// Run starts all servers concurrently, registers this service once every server is ready
+// and shuts down on signal or when any server fails
 func (a *application) Run() {
+	quit := a.notifySignal()
+	if err := a.startManagement(); err != nil {
+		a.abort(err)
+		return
+	}
+	failed := make(chan error, len(a.servers))
+	ready := a.startServers(failed)
+	select {
+	case <-ready:
+		logger.Info("all servers ready")
+	case err := <-failed:
+		a.abort(err)
+		return
+	case sig := <-quit:
+		a.exit(sig)
+		return
+	}
+	if err := registry.Register(); err != nil {
+		a.abort(err)
+		return
+	}
+	a.registered = registry.Enabled()
+	a.mgmt.ready.Store(true)
+	select {
+	case err := <-failed:
+		a.abort(err)
+	case sig := <-quit:
+		a.exit(sig)
+	}
+}
+
+func (a *application) startServers(failed chan error) chan bool {
+	var wg sync.WaitGroup
+	wg.Add(len(a.servers))
 	for _, s := range a.servers {
-		s.Run()
-	}
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	registry.Deregister()
-	broker.Disconnect()
-	logger.Info("Shutdown Server ...")
-	for _, s := range a.servers {
-		s.Stop()
+		go func(s Server) {
+			var once sync.Once
+			if err := s.Run(func() { once.Do(wg.Done) }); err != nil {
+				failed <- err
+			}
+		}(s)
 	}
+	ready := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(ready)
+	}()
+	return ready
+}
+
+func (a *application) exit(sig os.Signal) {
+	logger.Info("Shutdown Server ... ", sig)
+	a.shutdown()
+	logger.Info("Server exited")
+}
+
+func (a *application) abort(err error) {
+	logger.Error("server failed, shutdown", err)
+	a.shutdown()
+	os.Exit(1)
 }
 
 func NewApplication() *application {
@@ -0,0 +1,17 @@
+package app
+
+import "testing"
+
+func TestRegistryPort(t *testing.T) {
+	old := app
+	app = &application{Port: 8001}
+	defer func() {
+		app = old
+	}()
+	if p := registryPort(0); p != 8001 {
+		t.Fatalf("registry port %d without rpc.port", p)
+	}
+	if p := registryPort(9001); p != 9001 {
+		t.Fatalf("registry port %d, want rpc.port", p)
+	}
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/registry"
+	"github.com/billyyoyo/microj/trace"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdown hooks run from the smaller order to the bigger one, user hooks can be put between the built-in ones
+const (
+	SHUTDOWN_ORDER_DEREGISTER = 100
+	SHUTDOWN_ORDER_SERVER     = 200
+	SHUTDOWN_ORDER_BROKER     = 300
+	SHUTDOWN_ORDER_CLOSE      = 400
+)
+
+var (
+	hooks   []*shutdownHook
+	hooksMu sync.Mutex
+)
+
+// ShutdownHook must return once ctx is done, ctx carries the deadline of the whole shutdown
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHook struct {
+	order int
+	name  string
+	fn    ShutdownHook
+}
+
+func AddShutdownHook(order int, name string, fn ShutdownHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = append(hooks, &shutdownHook{
+		order: order,
+		name:  name,
+		fn:    fn,
+	})
+}
+
+// notifySignal delivers the first SIGINT/SIGTERM, a second one forces exit
+func (a *application) notifySignal() <-chan os.Signal {
+	quit := make(chan os.Signal, 2)
+	first := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		first <- <-quit
+		<-quit
+		logger.Warn("Force shutdown by second signal")
+		os.Exit(1)
+	}()
+	return first
+}
+
+func (a *application) shutdown() {
+	config.SetDefault("app.shutdown.delay", 3)
+	config.SetDefault("app.shutdown.timeout", 30)
+	delay := time.Duration(config.GetInt64("app.shutdown.delay")) * time.Second
+	timeout := time.Duration(config.GetInt64("app.shutdown.timeout")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	a.mgmt.stopping.Store(true)
+
+	hooksMu.Lock()
+	all := []*shutdownHook{
+		{order: SHUTDOWN_ORDER_DEREGISTER, name: "registry", fn: a.deregisterHook(delay)},
+		{order: SHUTDOWN_ORDER_SERVER, name: "servers", fn: a.stopServers},
+		{order: SHUTDOWN_ORDER_BROKER, name: "broker", fn: disconnectBroker},
+		{order: SHUTDOWN_ORDER_CLOSE + 100, name: "trace", fn: trace.Shutdown},
+		{order: SHUTDOWN_ORDER_CLOSE + 100, name: "management", fn: a.stopManagement},
+	}
+	all = append(all, hooks...)
+	hooksMu.Unlock()
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].order < all[j].order
+	})
+	for _, h := range all {
+		start := time.Now()
+		if err := runHook(ctx, h.fn); err != nil {
+			logger.Error(fmt.Sprintf("shutdown %s failed", h.name), err)
+		} else {
+			logger.Infof("shutdown %s took=%dms", h.name, time.Since(start).Milliseconds())
+		}
+	}
+	// the log sinks are closed at last to ship the logs of the hooks
+	if err := logger.Close(); err != nil {
+		logger.Error("shutdown log sinks failed", err)
+	}
+}
+
+// runHook returns when the hook is done or the deadline is exceeded
+func runHook(ctx context.Context, fn ShutdownHook) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deregisterHook removes this instance from registry first then waits the delay
+// for the change propagating to gateways and clients
+func (a *application) deregisterHook(delay time.Duration) ShutdownHook {
+	return func(ctx context.Context) error {
+		if !a.registered {
+			return nil
+		}
+		if err := registry.Deregister(); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		return nil
+	}
+}
+
+func (a *application) stopServers(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, s := range a.servers {
+		wg.Add(1)
+		go func(s Server) {
+			defer wg.Done()
+			s.Stop(ctx)
+		}(s)
+	}
+	wg.Wait()
+	return nil
+}
+
+// disconnectBroker drains the workers of the consumers first, so the queued messages are settled on the connection
+func disconnectBroker(ctx context.Context) error {
+	if !broker.Enabled() {
+		return nil
+	}
+	if err := broker.Drain(ctx); err != nil {
+		logger.Error("broker drain error", err)
+	}
+	return broker.Disconnect()
+}
@@ -0,0 +1,327 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/registry"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HEALTH_UP   = "UP"
+	HEALTH_DOWN = "DOWN"
+
+	healthCheckTimeout = 3 * time.Second
+	defaultLevelTTL    = 5 * time.Minute
+)
+
+var (
+	checks   = make(map[string]HealthChecker)
+	checksMu sync.RWMutex
+	mgmtMux  = http.NewServeMux()
+)
+
+// HealthChecker returns nil when the dependency is healthy, it must return once ctx is done
+type HealthChecker func(ctx context.Context) error
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	TookMs int64  `json:"tookMs"`
+}
+
+type HealthResult struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type management struct {
+	s        *http.Server
+	ready    atomic.Bool
+	stopping atomic.Bool
+}
+
+// AddHealthCheck adds a checker aggregated by /health/ready, a same name replaces the old one
+func AddHealthCheck(name string, fn HealthChecker) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	checks[name] = fn
+}
+
+// HandleManagement serves the handler on the management listener
+func HandleManagement(pattern string, handler http.Handler) {
+	mgmtMux.Handle(pattern, handler)
+}
+
+func init() {
+	AddHealthCheck("registry", func(ctx context.Context) error {
+		if registry.Enabled() && !registry.Registered() {
+			return errs.New(errs.ERRCODE_REGISTRY, "service not registered")
+		}
+		return nil
+	})
+	AddHealthCheck("broker", func(ctx context.Context) error {
+		if broker.Enabled() && !broker.Connected() {
+			return errs.New(errs.ERRCODE_BROKER, "broker not connected")
+		}
+		return nil
+	})
+	mgmtMux.Handle("/metrics", metrics.Handler())
+	mgmtMux.HandleFunc("/health/live", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, HealthResult{Status: HEALTH_UP})
+	})
+	mgmtMux.HandleFunc("/health/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, app.health(r.Context(), false))
+	})
+	mgmtMux.HandleFunc("/health/detail", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, app.health(r.Context(), true))
+	})
+	mgmtMux.HandleFunc("/log/level", handleLogLevel)
+	mgmtMux.HandleFunc("/broker/deadletters", handleDeadLetters)
+}
+
+// startManagement runs the management listener if app.management.port is set
+func (a *application) startManagement() error {
+	port := config.GetInt64("app.management.port")
+	if port == 0 {
+		return nil
+	}
+	addr := config.GetString("app.management.addr")
+	if addr == "" {
+		addr = app.Addr
+	}
+	a.mgmt.s = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", addr, port),
+		Handler: authorized(config.GetString("app.management.token"), mgmtMux),
+	}
+	listener, err := net.Listen("tcp", a.mgmt.s.Addr)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_COMMON, "management listen error", err)
+	}
+	logger.Info("management server listen on ", a.mgmt.s.Addr)
+	go func() {
+		if err := a.mgmt.s.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("management server serve error", err)
+		}
+	}()
+	return nil
+}
+
+// authorized rejects the requests changing the state like setting the log level or replaying the dead
+// letters without the bearer token of app.management.token, they are only taken from the loopback
+// if no token is configured
+func authorized(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !authorizedRequest(token, r) {
+			writeJson(w, http.StatusUnauthorized, FailedResult(errs.ERRCODE_COMMON, "unauthorized"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func authorizedRequest(token string, r *http.Request) bool {
+	if token == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(auth), []byte(token)) == 1
+}
+
+func (a *application) stopManagement(ctx context.Context) error {
+	if a.mgmt.s == nil {
+		return nil
+	}
+	return a.mgmt.s.Shutdown(ctx)
+}
+
+// health runs all checkers concurrently, the app is not ready before all servers
+// are ready or once the shutdown begins
+func (a *application) health(ctx context.Context, detail bool) HealthResult {
+	ret := HealthResult{Status: HEALTH_UP, Checks: make(map[string]CheckResult)}
+	if !a.mgmt.ready.Load() || a.mgmt.stopping.Load() {
+		ret.Status = HEALTH_DOWN
+		ret.Checks["app"] = CheckResult{Status: HEALTH_DOWN, Error: "app not ready"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	checksMu.RLock()
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]CheckResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, fn HealthChecker) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, fn)
+		}(i, checks[name])
+	}
+	checksMu.RUnlock()
+	wg.Wait()
+	for i, name := range names {
+		if results[i].Status == HEALTH_DOWN {
+			ret.Status = HEALTH_DOWN
+		}
+		ret.Checks[name] = results[i]
+	}
+	if !detail {
+		ret.Checks = nil
+	}
+	return ret
+}
+
+func runCheck(ctx context.Context, fn HealthChecker) CheckResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	ret := CheckResult{Status: HEALTH_UP, TookMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		ret.Status = HEALTH_DOWN
+		ret.Error = err.Error()
+	}
+	return ret
+}
+
+func writeHealth(w http.ResponseWriter, ret HealthResult) {
+	body, _ := json.Marshal(ret)
+	w.Header().Set("Content-Type", "application/json")
+	if ret.Status == HEALTH_UP {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// handleLogLevel shows the levels by GET, raises the level of module for ttl seconds by POST
+// like module=db&level=debug&ttl=600 and restores it by DELETE, the empty module is the root one
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	module := r.FormValue("module")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		ttl := defaultLevelTTL
+		if v := r.FormValue("ttl"); v != "" {
+			sec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || sec <= 0 {
+				writeJson(w, http.StatusBadRequest, FailedResult(errs.ERRCODE_INVALID_PARAMS, "invalid ttl "+v))
+				return
+			}
+			ttl = time.Duration(sec) * time.Second
+		}
+		if err := logger.SetLevel(module, r.FormValue("level"), ttl); err != nil {
+			writeJson(w, http.StatusBadRequest, FailedResult(errs.ERRCODE_INVALID_PARAMS, err.Error()))
+			return
+		}
+		logger.Warnf("log level of module '%s' set to %s for %s", module, r.FormValue("level"), ttl)
+		logger.Audit(r.Context(), "log.level.set", logger.Val{K: "module", V: module},
+			logger.Val{K: "level", V: r.FormValue("level")}, logger.Val{K: "ttl", V: ttl.String()},
+			logger.Val{K: "ip", V: r.RemoteAddr})
+	case http.MethodDelete:
+		logger.ResetLevel(module)
+		logger.Warnf("log level of module '%s' reset", module)
+		logger.Audit(r.Context(), "log.level.reset", logger.Val{K: "module", V: module},
+			logger.Val{K: "ip", V: r.RemoteAddr})
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, FailedResult(errs.ERRCODE_COMMON, "method not allowed"))
+		return
+	}
+	writeJson(w, http.StatusOK, SuccessResult(logger.Levels()))
+}
+
+// handleDeadLetters lists the dead letters by GET like topic=order.created&limit=20, replays one by
+// POST with id, or all of the topic by POST with topic, and deletes one by DELETE with id
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	id, topic := r.FormValue("id"), r.FormValue("topic")
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	switch r.Method {
+	case http.MethodGet:
+		dls, err := broker.ListDeadLetters(topic, limit)
+		if err != nil {
+			writeJson(w, http.StatusInternalServerError, FailedResult(errs.ERRCODE_BROKER, err.Error()))
+			return
+		}
+		writeJson(w, http.StatusOK, SuccessResult(dls))
+	case http.MethodPost:
+		ids := []string{id}
+		if id == "" {
+			if topic == "" {
+				writeJson(w, http.StatusBadRequest, FailedResult(errs.ERRCODE_INVALID_PARAMS, "no id or topic"))
+				return
+			}
+			dls, err := broker.ListDeadLetters(topic, limit)
+			if err != nil {
+				writeJson(w, http.StatusInternalServerError, FailedResult(errs.ERRCODE_BROKER, err.Error()))
+				return
+			}
+			ids = ids[:0]
+			for _, dl := range dls {
+				ids = append(ids, dl.ID)
+			}
+		}
+		replayed := 0
+		for _, id := range ids {
+			if err := broker.ReplayDeadLetter(r.Context(), id); err != nil {
+				writeJson(w, http.StatusInternalServerError, FailedResultf(errs.ERRCODE_BROKER,
+					"%d replayed, %s failed: %s", replayed, id, err.Error()))
+				return
+			}
+			replayed++
+			logger.Audit(r.Context(), "broker.deadletter.replay", logger.Val{K: "id", V: id},
+				logger.Val{K: "ip", V: r.RemoteAddr})
+		}
+		writeJson(w, http.StatusOK, SuccessResult(replayed))
+	case http.MethodDelete:
+		if id == "" {
+			writeJson(w, http.StatusBadRequest, FailedResult(errs.ERRCODE_INVALID_PARAMS, "no id"))
+			return
+		}
+		if err := broker.DeleteDeadLetter(id); err != nil {
+			writeJson(w, http.StatusInternalServerError, FailedResult(errs.ERRCODE_BROKER, err.Error()))
+			return
+		}
+		logger.Audit(r.Context(), "broker.deadletter.delete", logger.Val{K: "id", V: id},
+			logger.Val{K: "ip", V: r.RemoteAddr})
+		writeJson(w, http.StatusOK, SuccessResult(nil))
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, FailedResult(errs.ERRCODE_COMMON, "method not allowed"))
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	body, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	a := &application{}
+	if ret := a.health(context.Background(), true); ret.Status != HEALTH_DOWN {
+		t.Fatalf("not ready app reported %s", ret.Status)
+	}
+	a.mgmt.ready.Store(true)
+	if ret := a.health(context.Background(), false); ret.Status != HEALTH_UP || ret.Checks != nil {
+		t.Fatalf("ready app reported %+v", ret)
+	}
+	AddHealthCheck("custom", func(ctx context.Context) error {
+		return errors.New("down")
+	})
+	defer delete(checks, "custom")
+	ret := a.health(context.Background(), true)
+	if ret.Status != HEALTH_DOWN || ret.Checks["custom"].Error != "down" || ret.Checks["registry"].Status != HEALTH_UP {
+		t.Fatalf("failed check reported %+v", ret)
+	}
+	a.mgmt.stopping.Store(true)
+	delete(checks, "custom")
+	if ret := a.health(context.Background(), false); ret.Status != HEALTH_DOWN {
+		t.Fatalf("stopping app reported %s", ret.Status)
+	}
+}
+
+func TestHealthTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ret := runCheck(ctx, func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	if ret.Status != HEALTH_DOWN {
+		t.Fatalf("slow check reported %s", ret.Status)
+	}
+}
+
+func TestWriteHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeHealth(w, HealthResult{Status: HEALTH_DOWN})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("down status code %d", w.Code)
+	}
+}
+
+func TestManagementAuth(t *testing.T) {
+	handled := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	})
+	request := func(token, method, remote, auth string) int {
+		r := httptest.NewRequest(method, "/log/level", nil)
+		r.RemoteAddr = remote
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		authorized(token, h).ServeHTTP(w, r)
+		return w.Code
+	}
+	cases := []struct {
+		token, method, remote, auth string
+		code                        int
+	}{
+		{"", http.MethodGet, "192.168.1.9:5000", "", http.StatusOK},
+		{"", http.MethodPost, "192.168.1.9:5000", "", http.StatusUnauthorized},
+		{"", http.MethodDelete, "127.0.0.1:5000", "", http.StatusOK},
+		{"secret", http.MethodPost, "127.0.0.1:5000", "", http.StatusUnauthorized},
+		{"secret", http.MethodDelete, "192.168.1.9:5000", "wrong", http.StatusUnauthorized},
+		{"secret", http.MethodPost, "192.168.1.9:5000", "secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		if code := request(c.token, c.method, c.remote, c.auth); code != c.code {
+			t.Errorf("%s from %s with token %q: %d, want %d", c.method, c.remote, c.auth, code, c.code)
+		}
+	}
+	if handled != 3 {
+		t.Fatalf("%d requests handled", handled)
+	}
+}
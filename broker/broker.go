@@ -1,13 +1,26 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/trace"
+	"time"
 )
 
+const logModule = "broker"
+
 var (
 	MqBroker         *Broker
 	InvokeInitBroker func(opts Options) (Broker, error)
+
+	published = metrics.NewCounterVec(metrics.NAMESPACE+"_broker_published_total",
+		"Total number of messages published to the broker.", "topic", "result")
+	consumed = metrics.NewCounterVec(metrics.NAMESPACE+"_broker_consumed_total",
+		"Total number of messages consumed from the broker.", "topic", "group")
+	handleLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_broker_handler_duration_seconds",
+		"Latency of the broker message handlers.", nil, "topic", "group")
 )
 
 type Broker interface {
@@ -18,18 +31,95 @@ type Broker interface {
 	Send(topic string, msg Message) error
 }
 
+// Checker is implemented by brokers able to report their connection state
+type Checker interface {
+	IsConnected() bool
+}
+
 type Options struct {
-	Enable bool   `yaml:"enable"`
-	Addr   string `yaml:"addr"`
-	User   string `yaml:"user"`
-	Pwd    string `yaml:"pwd"`
+	Enable bool         `yaml:"enable"`
+	Addr   string       `yaml:"addr"`
+	User   string       `yaml:"user"`
+	Pwd    string       `yaml:"pwd"`
+	Retry  RetryOptions `yaml:"retry"`
+	// Codec is the content type of Publish, application/json by default
+	Codec    string          `yaml:"codec"`
+	Consumer ConsumerOptions `yaml:"consumer"`
+	Delay    DelayOptions    `yaml:"delay"`
 }
 
+const (
+	// HEAD_DELIVERY_COUNT is set by the durable brokers, 1 for the first delivery
+	HEAD_DELIVERY_COUNT = "x-delivery-count"
+	// HEAD_PARTITION_KEY keeps the messages of a key in order on the partitioned brokers like kafka
+	HEAD_PARTITION_KEY = "x-partition-key"
+	// HEAD_MESSAGE_ID is set on sending if absent, the consumers dedup the redelivered messages by it
+	HEAD_MESSAGE_ID = "x-message-id"
+)
+
 type Handler func(msg Message)
 
+type ErrorHandler func(msg Message) error
+
+// Acker settles a message of a durable broker, the message is redelivered until it is acked or terminated
+type Acker interface {
+	Ack() error
+	// Nak redelivers the message after delay, or by the backoff of the consumer if delay is 0
+	Nak(delay time.Duration) error
+	// Term stops the redelivery of the message
+	Term() error
+	// InProgress resets the ack wait of a long handling
+	InProgress() error
+}
+
 type Message struct {
-	Head map[string]string `json:"head"`
-	Body []byte            `json:"body"`
+	Head  map[string]string `json:"head"`
+	Body  []byte            `json:"body"`
+	ctx   context.Context
+	acker Acker
+}
+
+// WithAcker is called by the durable brokers on the received messages
+func (m Message) WithAcker(a Acker) Message {
+	m.acker = a
+	return m
+}
+
+// Ack is a no-op for the brokers without acknowledgement, as Nak, Term and InProgress
+func (m Message) Ack() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Ack()
+}
+
+func (m Message) Nak(delay time.Duration) error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Nak(delay)
+}
+
+func (m Message) Term() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Term()
+}
+
+func (m Message) InProgress() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.InProgress()
+}
+
+// Context carries the consumer span and the request logger of a received message, it is never nil
+func (m Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
 }
 
 func (m Message) String() string {
@@ -41,12 +131,32 @@ func (m Message) String() string {
 
 func Init(opts Options) {
 	MqBroker = new(Broker)
+	stopScheduler()
+	resetConsumers()
+	setRetry(opts.Retry)
+	setConsumer(opts.Consumer)
+	if opts.Codec != "" {
+		if err := SetDefaultCodec(opts.Codec); err != nil {
+			logger.Error("broker codec error: ", err)
+		}
+	}
+	if InvokeInitBroker == nil {
+		if opts.Enable {
+			logger.Warn("no broker plugin imported")
+		}
+		return
+	}
 	b, err := InvokeInitBroker(opts)
 	if err != nil {
 		logger.Error("init broker error: ", err)
 		return
 	}
+	if b == nil {
+		return
+	}
 	MqBroker = &b
+	// the scheduler waits for the broker connected
+	startScheduler(opts.Delay)
 	err = Connect()
 	if err != nil {
 		logger.Error("connect broker error: ", err)
@@ -54,16 +164,99 @@ func Init(opts Options) {
 	}
 }
 
+// Enabled reports whether a broker plugin is initialized
+func Enabled() bool {
+	return MqBroker != nil && *MqBroker != nil
+}
+
+// Connected reports the connection state, brokers not implementing Checker are taken as connected
+func Connected() bool {
+	if !Enabled() {
+		return false
+	}
+	if c, ok := (*MqBroker).(Checker); ok {
+		return c.IsConnected()
+	}
+	return true
+}
+
 func Connect() error {
 	return (*MqBroker).Connect()
 }
 
+// Disconnect stops the scheduler of the delayed messages first
 func Disconnect() error {
+	stopScheduler()
 	return (*MqBroker).Disconnect()
 }
-func Recv(once bool, topic, group string, handler Handler) error {
-	return (*MqBroker).Receive(once, topic, group, handler)
+
+// Recv recovers the panics of the handler, which are retried and dead-lettered by broker.retry
+func Recv(once bool, topic, group string, handler Handler, opts ...ConsumeOption) error {
+	return RecvE(once, topic, group, func(msg Message) error {
+		handler(msg)
+		return nil
+	}, opts...)
+}
+
+// RecvE retries the message once the handler returns an error or panics, and publishes it to
+// the dead letter topic after broker.retry.maxAttempts. The messages pass the consumer pipeline like Consume
+func RecvE(once bool, topic, group string, handler ErrorHandler, opts ...ConsumeOption) error {
+	return consume(once, topic, group, func(ctx context.Context, msg Message) error {
+		return handler(msg)
+	}, opts)
+}
+
+// Send returns the error of the broker, which is also logged
+func Send(topic string, msg Message) error {
+	return SendContext(context.Background(), topic, msg)
+}
+
+// SendContext propagates the trace in ctx to the consumers by the message head
+func SendContext(ctx context.Context, topic string, msg Message) error {
+	return send(ctx, topic, msg)
 }
-func Send(topic string, msg Message) {
-	(*MqBroker).Send(topic, msg)
+
+func send(ctx context.Context, topic string, msg Message) error {
+	ctx, span := trace.Start(ctx, topic+" send", trace.SPAN_KIND_PRODUCER)
+	defer span.End()
+	span.SetAttr("messaging.destination", topic)
+	msg.Head = outgoingHead(ctx, msg.Head)
+	if msg.Head[HEAD_MESSAGE_ID] == "" {
+		msg.Head[HEAD_MESSAGE_ID] = logger.NewRequestID()
+	}
+	if err := (*MqBroker).Send(topic, msg); err != nil {
+		logger.FromContext(ctx).Module(logModule).Error("broker send error", err, logger.Val{K: "topic", V: topic})
+		span.SetError(err)
+		published.Inc(topic, "error")
+		return err
+	}
+	published.Inc(topic, "ok")
+	return nil
+}
+
+// outgoingHead copies the head with the trace and request of ctx
+func outgoingHead(ctx context.Context, h map[string]string) map[string]string {
+	head := make(map[string]string, len(h)+4)
+	for k, v := range h {
+		head[k] = v
+	}
+	trace.Inject(ctx, func(k, v string) {
+		head[k] = v
+	})
+	logger.Inject(ctx, func(k, v string) {
+		head[k] = v
+	})
+	return head
+}
+
+// observeHandler traces and measures the handler outside the consumer pipeline, like the responders
+func observeHandler(topic, group string, handler Handler) Handler {
+	info := &ConsumeInfo{Topic: topic, Group: group}
+	h := chain([]Middleware{traceMiddleware, metricsMiddleware}, info, func(ctx context.Context, msg Message) error {
+		handler(msg)
+		return nil
+	})
+	return func(msg Message) {
+		h(msg.Context(), msg)
+	}
 }
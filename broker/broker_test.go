@@ -1,35 +1,124 @@
-package broker
+package broker_test
 
 import (
-	"fmt"
-	"github.com/billyyoyo/microj/util"
+	"context"
+	"errors"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/plugins/broker/memory"
+	"github.com/billyyoyo/microj/trace"
 	"testing"
 	"time"
 )
-import _ "github.com/billyyoyo/microj/plugins/broker/nats"
-
-func TestNats(t *testing.T) {
-	opts := Options{
-		Enable: true,
-		Addr:   "localhost:4222",
-		User:   "",
-		Pwd:    "",
-	}
-	Init(opts)
-	Recv(false, "test", "nats", handleMsg)
-	tick := time.Tick(time.Second)
-	for t := range tick {
-		text := t.Format(time.DateTime)
-		msg := Message{
-			Head: map[string]string{
-				"token": "1111",
-			},
-			Body: []byte(text),
+
+func TestSendRecv(t *testing.T) {
+	b := memory.New(memory.Options{})
+	broker.MqBroker = &b
+	broker.Connect()
+	defer broker.Disconnect()
+
+	var got broker.Message
+	broker.Recv(true, "order.created", "test", func(msg broker.Message) {
+		got = msg
+	})
+	ctx, span := trace.Start(context.Background(), "parent", trace.SPAN_KIND_SERVER)
+	defer span.End()
+	ctx = logger.Extract(ctx, func(k string) string { return "" }, "")
+	broker.SendContext(ctx, "order.created", broker.Message{Head: map[string]string{"k": "v"}, Body: []byte("1")})
+
+	if string(got.Body) != "1" || got.Head["k"] != "v" {
+		t.Fatalf("received %s", got)
+	}
+	if trace.TraceIDFromContext(got.Context()) != span.Context().TraceID.String() {
+		t.Fatalf("trace not propagated, head %v", got.Head)
+	}
+	if logger.RequestIDFromContext(got.Context()) != logger.RequestIDFromContext(ctx) {
+		t.Fatalf("request id not propagated, head %v", got.Head)
+	}
+}
+
+func TestRetryDeadLetter(t *testing.T) {
+	broker.Init(broker.Options{Enable: true, Retry: broker.RetryOptions{MaxAttempts: 3, Delays: []int64{1}}})
+	defer broker.Disconnect()
+
+	attempts := make(chan int, 10)
+	n := 0
+	broker.RecvE(true, "order.paid", "billing", func(msg broker.Message) error {
+		n++
+		attempts <- n
+		if n < 3 {
+			panic("billing down")
 		}
-		Send("test", msg)
+		if n == 3 {
+			return errors.New("still failed")
+		}
+		return nil
+	})
+	replayed := make(chan broker.Message, 1)
+	broker.Recv(true, "order.paid", "shipping", func(msg broker.Message) {
+		if msg.Head[broker.HEAD_REPLAY_GROUP] != "" {
+			replayed <- msg
+		}
+	})
+	dead := make(chan broker.Message, 1)
+	broker.Recv(false, broker.DeadLetterTopic("order.paid"), "", func(msg broker.Message) {
+		dead <- msg
+	})
+	broker.Send("order.paid", broker.Message{Head: map[string]string{"k": "v"}, Body: []byte("1")})
+
+	var msg broker.Message
+	select {
+	case msg = <-dead:
+	case <-time.After(time.Second):
+		t.Fatal("message not dead-lettered")
+	}
+	if len(attempts) != 3 || msg.Head[broker.HEAD_DEAD_GROUP] != "billing" ||
+		msg.Head[broker.HEAD_DEAD_ATTEMPTS] != "3" || msg.Head[broker.HEAD_DEAD_ERROR] == "" {
+		t.Fatalf("dead letter %s after %d attempts", msg, len(attempts))
+	}
+	dls, _ := broker.ListDeadLetters("order.paid", 10)
+	if len(dls) != 1 || dls[0].Message.Head["k"] != "v" {
+		t.Fatalf("dead letters %+v", dls)
+	}
+	if err := broker.ReplayDeadLetter(context.Background(), dls[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 0 {
+		t.Fatal("replay handled by the other group")
+	}
+	if n != 4 {
+		t.Fatalf("replay not handled by the failed group, %d attempts", n)
+	}
+	if dls, _ = broker.ListDeadLetters("", 0); len(dls) != 0 {
+		t.Fatalf("dead letters after replay %+v", dls)
 	}
 }
 
-func handleMsg(msg Message) {
-	fmt.Println(util.Bytes2str(msg.Body))
+func TestRequest(t *testing.T) {
+	b := memory.New(memory.Options{Mode: memory.MODE_ASYNC})
+	broker.MqBroker = &b
+	broker.Connect()
+	defer broker.Disconnect()
+
+	broker.Respond("user.get", "users", func(msg broker.Message) (broker.Message, error) {
+		if string(msg.Body) == "" {
+			return broker.Message{}, errs.New(errs.ERRCODE_INVALID_PARAMS, "no user id")
+		}
+		return broker.Message{Body: append([]byte("user "), msg.Body...)}, nil
+	})
+	reply, err := broker.Request(context.Background(), "user.get", broker.Message{Body: []byte("1")})
+	if err != nil || string(reply.Body) != "user 1" {
+		t.Fatalf("reply %s, error %v", reply, err)
+	}
+	_, err = broker.Request(context.Background(), "user.get", broker.Message{})
+	if me, ok := errs.FromError(err); !ok || me.Code() != errs.ERRCODE_INVALID_PARAMS {
+		t.Fatalf("responder error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = broker.Request(ctx, "user.none", broker.Message{})
+	if me, ok := errs.FromError(err); !ok || me.Code() != errs.ERRCODE_TIMEOUT {
+		t.Fatalf("no responder error %v", err)
+	}
 }
@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	HEAD_CONTENT_TYPE = "content-type"
+
+	CONTENT_TYPE_JSON     = "application/json"
+	CONTENT_TYPE_PROTOBUF = "application/x-protobuf"
+	CONTENT_TYPE_MSGPACK  = "application/x-msgpack"
+)
+
+var (
+	codecs        sync.Map
+	defaultCodec  atomic.Value
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+)
+
+// Codec encodes the values of Publish and decodes them for Subscribe by the content-type head
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+func init() {
+	defaultCodec.Store(CONTENT_TYPE_JSON)
+	RegCodec(jsonCodec{})
+	RegCodec(protoCodec{})
+	RegCodec(msgpackCodec{})
+}
+
+// RegCodec adds or replaces the codec of its content type, which is matched case-insensitively
+func RegCodec(c Codec) {
+	codecs.Store(strings.TrimSpace(strings.ToLower(c.ContentType())), c)
+}
+
+// SetDefaultCodec is the codec of Publish for the values other than proto.Message, json by default
+func SetDefaultCodec(contentType string) error {
+	if _, ok := GetCodec(contentType); !ok {
+		return errs.New(errs.ERRCODE_BROKER, "unknown codec "+contentType)
+	}
+	defaultCodec.Store(contentType)
+	return nil
+}
+
+// GetCodec ignores the parameters of the content type like charset
+func GetCodec(contentType string) (Codec, bool) {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	c, ok := codecs.Load(strings.TrimSpace(strings.ToLower(contentType)))
+	if !ok {
+		return nil, false
+	}
+	return c.(Codec), true
+}
+
+// Encode marshals v into a message by the codec of contentType, the proto messages are encoded by protobuf
+// and the others by the default codec if it is empty
+func Encode(v any, contentType string) (Message, error) {
+	if contentType == "" {
+		contentType = defaultCodec.Load().(string)
+		if _, ok := v.(proto.Message); ok {
+			contentType = CONTENT_TYPE_PROTOBUF
+		}
+	}
+	c, ok := GetCodec(contentType)
+	if !ok {
+		return Message{}, errs.New(errs.ERRCODE_BROKER, "unknown codec "+contentType)
+	}
+	body, err := c.Marshal(v)
+	if err != nil {
+		return Message{}, errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("%s encode %T error", contentType, v), err)
+	}
+	return Message{Head: map[string]string{HEAD_CONTENT_TYPE: c.ContentType()}, Body: body}, nil
+}
+
+// Decode unmarshals the body into v by the content type of the message, json if the head is absent
+func Decode(msg Message, v any) error {
+	contentType := msg.Head[HEAD_CONTENT_TYPE]
+	if contentType == "" {
+		contentType = CONTENT_TYPE_JSON
+	}
+	c, ok := GetCodec(contentType)
+	if !ok {
+		return errs.New(errs.ERRCODE_BROKER, "unknown codec "+contentType)
+	}
+	if err := c.Unmarshal(msg.Body, v); err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("%s decode %T error", contentType, v), err)
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return CONTENT_TYPE_JSON
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) ContentType() string {
+	return CONTENT_TYPE_PROTOBUF
+}
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return CONTENT_TYPE_MSGPACK
+}
+
+func (msgpackCodec) Marshal(v any) (bs []byte, err error) {
+	err = codec.NewEncoderBytes(&bs, msgpackHandle).Encode(v)
+	return
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
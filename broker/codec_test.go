@@ -0,0 +1,117 @@
+package broker_test
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/broker"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"strings"
+	"testing"
+	"time"
+)
+
+type order struct {
+	ID    int64    `json:"id"`
+	Items []string `json:"items"`
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	broker.Init(broker.Options{Enable: true, Codec: broker.CONTENT_TYPE_MSGPACK})
+	defer broker.Disconnect()
+	defer broker.SetDefaultCodec(broker.CONTENT_TYPE_JSON)
+
+	orders := make(chan order, 1)
+	broker.Subscribe("order.typed", "billing", func(ctx context.Context, o order) error {
+		orders <- o
+		return nil
+	})
+	names := make(chan string, 1)
+	broker.Subscribe("user.typed", "", func(ctx context.Context, v *wrapperspb.StringValue) error {
+		names <- v.GetValue()
+		return nil
+	})
+	heads := make(chan string, 2)
+	broker.Recv(false, ">", "", func(msg broker.Message) {
+		heads <- msg.Head[broker.HEAD_CONTENT_TYPE]
+	})
+
+	if err := broker.Publish("order.typed", order{ID: 1, Items: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if o := <-orders; o.ID != 1 || len(o.Items) != 1 || o.Items[0] != "a" {
+		t.Fatalf("order %+v", o)
+	}
+	if ct := <-heads; ct != broker.CONTENT_TYPE_MSGPACK {
+		t.Fatalf("content type %s", ct)
+	}
+	if err := broker.Publish("user.typed", wrapperspb.String("billy")); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-names; name != "billy" {
+		t.Fatalf("name %s", name)
+	}
+	if ct := <-heads; ct != broker.CONTENT_TYPE_PROTOBUF {
+		t.Fatalf("content type %s", ct)
+	}
+}
+
+func TestSubscribeReject(t *testing.T) {
+	broker.Init(broker.Options{Enable: true, Retry: broker.RetryOptions{MaxAttempts: 3, Delays: []int64{1}}})
+	defer broker.Disconnect()
+
+	handled := 0
+	broker.Subscribe("order.broken", "billing", func(ctx context.Context, o order) error {
+		handled++
+		return nil
+	})
+	dead := make(chan broker.Message, 1)
+	broker.Recv(false, broker.DeadLetterTopic("order.broken"), "", func(msg broker.Message) {
+		dead <- msg
+	})
+	broker.Send("order.broken", broker.Message{
+		Head: map[string]string{broker.HEAD_CONTENT_TYPE: broker.CONTENT_TYPE_JSON},
+		Body: []byte("{broken"),
+	})
+
+	select {
+	case msg := <-dead:
+		if handled != 0 || msg.Head[broker.HEAD_DEAD_ATTEMPTS] != "1" || msg.Head[broker.HEAD_DEAD_ERROR] == "" {
+			t.Fatalf("dead letter %s, handled %d", msg, handled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not dead-lettered")
+	}
+}
+
+type upperCodec struct{}
+
+func (upperCodec) ContentType() string {
+	return "Application/X-Upper"
+}
+
+func (upperCodec) Marshal(v any) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v any) error {
+	*(v.(*string)) = string(data)
+	return nil
+}
+
+func TestRegCodec(t *testing.T) {
+	broker.RegCodec(upperCodec{})
+	if _, ok := broker.GetCodec("application/x-upper; charset=utf-8"); !ok {
+		t.Fatal("codec not matched case-insensitively")
+	}
+	if err := broker.SetDefaultCodec("APPLICATION/X-UPPER"); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.SetDefaultCodec(broker.CONTENT_TYPE_JSON)
+	msg, err := broker.Encode("billy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err = broker.Decode(msg, &s); err != nil || s != "BILLY" {
+		t.Fatalf("decoded %q, error %v", s, err)
+	}
+}
@@ -0,0 +1,319 @@
+package broker
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/metrics"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConsumeInfo of the subscription handling a message, passed to the middlewares
+type ConsumeInfo struct {
+	Topic string
+	Group string
+}
+
+type ConsumeHandler func(ctx context.Context, msg Message) error
+
+// Middleware wraps the handling of a message, it calls next to continue the chain
+type Middleware func(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error
+
+// ConsumerOptions of broker.consumer are the defaults of every subscription, overridden by the ConsumeOptions
+type ConsumerOptions struct {
+	// Concurrency of the workers of a subscription, 0 handles the messages on the callback of the broker.
+	// The brokers settling a message once their callback returns like kafka and redis streams always
+	// handle it on the callback, so the order of the partition is kept
+	Concurrency int `yaml:"concurrency"`
+	// QueueSize of the messages waiting for a worker, the callback of the broker blocks once it is full.
+	// It is the concurrency by default
+	QueueSize int `yaml:"queueSize"`
+	// Ordered handles the messages of a key one by one in order, the key is HEAD_PARTITION_KEY by default.
+	// A retried message is redelivered after the others of its key
+	Ordered bool `yaml:"ordered"`
+}
+
+type ConsumeOption func(o *consumeOptions)
+
+type consumeOptions struct {
+	ConsumerOptions
+	key         func(msg Message) string
+	middlewares []Middleware
+}
+
+func WithConcurrency(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.Concurrency = n
+	}
+}
+
+func WithQueueSize(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.QueueSize = n
+	}
+}
+
+// WithOrdered handles the messages of the same key in order, HEAD_PARTITION_KEY is the key if key is nil
+func WithOrdered(key func(msg Message) string) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.Ordered = true
+		o.key = key
+	}
+}
+
+// WithMiddleware appends the middlewares of the subscription after the ones added by Use
+func WithMiddleware(mws ...Middleware) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.middlewares = append(o.middlewares, mws...)
+	}
+}
+
+// Detacher is implemented by the ackers able to settle a message after the callback of the broker returns,
+// Detach stops the broker settling the message on return and gives the func doing it once it is handled
+type Detacher interface {
+	Detach() (settle func())
+}
+
+var (
+	consumerOpts atomic.Pointer[ConsumerOptions]
+
+	mwMu        sync.RWMutex
+	middlewares []Middleware
+
+	consumersMu sync.Mutex
+	consumers   []*consumer
+)
+
+func init() {
+	consumerOpts.Store(&ConsumerOptions{})
+	metrics.NewGaugeFunc(metrics.NAMESPACE+"_broker_consumer_queued", "Number of messages waiting for or handled by the workers.",
+		[]string{"topic", "group"}, func() []metrics.Sample {
+			consumersMu.Lock()
+			defer consumersMu.Unlock()
+			samples := make([]metrics.Sample, 0, len(consumers))
+			for _, c := range consumers {
+				if c.queues != nil {
+					samples = append(samples, metrics.Sample{Values: []string{c.info.Topic, c.info.Group}, Value: float64(c.pending.Load())})
+				}
+			}
+			return samples
+		})
+}
+
+func setConsumer(opts ConsumerOptions) {
+	consumerOpts.Store(&opts)
+}
+
+// Use appends the middlewares of all subscriptions, it takes effect on the subscriptions made later.
+// They run after the builtin tracing, metrics, retry and recovery, so a retried message passes them again
+func Use(mws ...Middleware) {
+	mwMu.Lock()
+	defer mwMu.Unlock()
+	middlewares = append(middlewares, mws...)
+}
+
+// Consume subscribes the handler through the middlewares, the group shares the messages like Recv once,
+// or every instance gets them if it is empty. The handler error is retried and dead-lettered like RecvE
+func Consume(topic, group string, handler ConsumeHandler, opts ...ConsumeOption) error {
+	return consume(group != "", topic, group, handler, opts)
+}
+
+func consume(once bool, topic, group string, handler ConsumeHandler, opts []ConsumeOption) error {
+	o := consumeOptions{ConsumerOptions: *consumerOpts.Load()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	mwMu.RLock()
+	mws := make([]Middleware, 0, len(middlewares)+len(o.middlewares)+4)
+	mws = append(mws, traceMiddleware, metricsMiddleware, retryMiddleware, recoverMiddleware)
+	mws = append(mws, middlewares...)
+	mwMu.RUnlock()
+	mws = append(mws, o.middlewares...)
+
+	c := newConsumer(ConsumeInfo{Topic: topic, Group: group}, o)
+	c.handler = chain(mws, &c.info, handler)
+	if err := (*MqBroker).Receive(once, topic, group, c.dispatch); err != nil {
+		c.stop()
+		return err
+	}
+	consumersMu.Lock()
+	consumers = append(consumers, c)
+	consumersMu.Unlock()
+	return nil
+}
+
+// resetConsumers stops the workers of the subscriptions of the previous broker
+func resetConsumers() {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	for _, c := range consumers {
+		c.stop()
+	}
+	consumers = nil
+}
+
+func chain(mws []Middleware, info *ConsumeInfo, handler ConsumeHandler) ConsumeHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, next := mws[i], handler
+		handler = func(ctx context.Context, msg Message) error {
+			return mw(ctx, msg, info, next)
+		}
+	}
+	return handler
+}
+
+// Drain stops the workers taking new messages and waits for the queued ones handled, it is called on
+// shutdown before disconnecting the broker. The detachable messages arriving meanwhile are nak-ed to
+// the other consumers, the rest are handled on the callback of the broker. The in-process retries
+// waiting for their delays are dead-lettered
+func Drain(ctx context.Context) error {
+	consumersMu.Lock()
+	cs := consumers
+	consumersMu.Unlock()
+	for _, c := range cs {
+		c.draining.Store(true)
+	}
+	drainRetries()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	wait := func(pending *atomic.Int64) error {
+		for pending.Load() > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+		return nil
+	}
+	for _, c := range cs {
+		if err := wait(&c.pending); err != nil {
+			return err
+		}
+		c.stop()
+	}
+	// the retries fired before drained
+	return wait(&retrying)
+}
+
+type task struct {
+	msg    Message
+	settle func()
+}
+
+// consumer runs the workers of a subscription, unordered workers share one queue and ordered ones
+// have a queue each, the messages of a key always go to the same worker
+type consumer struct {
+	info     ConsumeInfo
+	opts     consumeOptions
+	handler  ConsumeHandler
+	queues   []chan task
+	done     chan struct{}
+	stopOnce sync.Once
+	next     atomic.Uint32
+	pending  atomic.Int64
+	draining atomic.Bool
+}
+
+func newConsumer(info ConsumeInfo, o consumeOptions) *consumer {
+	c := &consumer{info: info, opts: o, done: make(chan struct{})}
+	n := o.Concurrency
+	if n <= 0 {
+		return c
+	}
+	size := o.QueueSize
+	if size <= 0 {
+		size = n
+	}
+	if o.Ordered {
+		if o.key == nil {
+			c.opts.key = func(msg Message) string {
+				return msg.Head[HEAD_PARTITION_KEY]
+			}
+		}
+		c.queues = make([]chan task, n)
+		for i := range c.queues {
+			c.queues[i] = make(chan task, size)
+			go c.work(c.queues[i])
+		}
+		return c
+	}
+	c.queues = []chan task{make(chan task, size)}
+	for i := 0; i < n; i++ {
+		go c.work(c.queues[0])
+	}
+	return c
+}
+
+// dispatch is the callback of the broker
+func (c *consumer) dispatch(msg Message) {
+	d, detachable := msg.acker.(Detacher)
+	if c.queues == nil || (msg.acker != nil && !detachable) {
+		c.handle(msg)
+		return
+	}
+	// counted before checking draining, so Drain either waits for the message or it is never queued
+	c.pending.Add(1)
+	if c.draining.Load() {
+		c.pending.Add(-1)
+		if detachable {
+			msg.Nak(0)
+			return
+		}
+		c.handle(msg)
+		return
+	}
+	t := task{msg: msg}
+	if detachable {
+		t.settle = d.Detach()
+	}
+	select {
+	case c.queue(msg) <- t:
+	case <-c.done:
+		// stopped while the queue is full
+		c.pending.Add(-1)
+		if detachable {
+			msg.Nak(0)
+			return
+		}
+		c.handle(msg)
+	}
+}
+
+func (c *consumer) queue(msg Message) chan task {
+	if len(c.queues) == 1 {
+		return c.queues[0]
+	}
+	if key := c.opts.key(msg); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return c.queues[h.Sum32()%uint32(len(c.queues))]
+	}
+	return c.queues[c.next.Add(1)%uint32(len(c.queues))]
+}
+
+func (c *consumer) work(q chan task) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case t := <-q:
+			c.handle(t.msg)
+			if t.settle != nil {
+				t.settle()
+			}
+			c.pending.Add(-1)
+		}
+	}
+}
+
+func (c *consumer) handle(msg Message) {
+	c.handler(msg.Context(), msg)
+}
+
+func (c *consumer) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
@@ -0,0 +1,177 @@
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/plugins/broker/memory"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsumeConcurrency(t *testing.T) {
+	b := memory.New(memory.Options{})
+	broker.MqBroker = &b
+	broker.Connect()
+	defer broker.Disconnect()
+
+	var running, handled atomic.Int32
+	release := make(chan struct{})
+	broker.Consume("job.created", "workers", func(ctx context.Context, msg broker.Message) error {
+		running.Add(1)
+		<-release
+		handled.Add(1)
+		return nil
+	}, broker.WithConcurrency(4), broker.WithQueueSize(8))
+	for i := 0; i < 8; i++ {
+		broker.Send("job.created", broker.Message{Body: []byte(strconv.Itoa(i))})
+	}
+	deadline := time.Now().Add(time.Second)
+	for running.Load() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages handled concurrently", running.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := broker.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if handled.Load() != 8 {
+		t.Fatalf("drained after %d messages handled", handled.Load())
+	}
+	// handled on the callback once drained
+	broker.Send("job.created", broker.Message{})
+	if handled.Load() != 9 {
+		t.Fatal("message dropped after drained")
+	}
+}
+
+func TestConsumeOrdered(t *testing.T) {
+	b := memory.New(memory.Options{})
+	broker.MqBroker = &b
+	broker.Connect()
+	defer broker.Disconnect()
+
+	var mu sync.Mutex
+	seq := make(map[string][]string)
+	var wg sync.WaitGroup
+	wg.Add(15)
+	broker.Consume("user.updated", "search", func(ctx context.Context, msg broker.Message) error {
+		defer wg.Done()
+		time.Sleep(time.Duration(len(msg.Body)) * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		key := msg.Head[broker.HEAD_PARTITION_KEY]
+		seq[key] = append(seq[key], string(msg.Body))
+		return nil
+	}, broker.WithConcurrency(3), broker.WithOrdered(nil))
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			broker.Send("user.updated", broker.Message{Head: map[string]string{broker.HEAD_PARTITION_KEY: key}, Body: []byte(strconv.Itoa(i))})
+		}
+	}
+	wg.Wait()
+	for key, s := range seq {
+		for i, v := range s {
+			if v != strconv.Itoa(i) {
+				t.Fatalf("messages of %s out of order %v", key, s)
+			}
+		}
+	}
+}
+
+func TestDedupMiddleware(t *testing.T) {
+	broker.Init(broker.Options{Enable: true, Retry: broker.RetryOptions{MaxAttempts: 2, DisableDeadLetter: true}})
+	defer broker.Disconnect()
+
+	// the retry runs on a timer goroutine
+	var mu sync.Mutex
+	var attempts, handled int
+	var steps []string
+	step := func(name string) broker.Middleware {
+		return func(ctx context.Context, msg broker.Message, info *broker.ConsumeInfo, next broker.ConsumeHandler) error {
+			mu.Lock()
+			steps = append(steps, name)
+			mu.Unlock()
+			return next(ctx, msg)
+		}
+	}
+	broker.Consume("order.paid", "billing", func(ctx context.Context, msg broker.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			return errors.New("billing down")
+		}
+		handled++
+		return nil
+	}, broker.WithMiddleware(step("first"), broker.DedupMiddleware(broker.NewMemoryDedupStore(10), time.Minute), step("second")))
+
+	msg := broker.Message{Head: map[string]string{broker.HEAD_MESSAGE_ID: "1"}}
+	broker.Send("order.paid", msg)
+	deadline := time.Now().Add(time.Second)
+	retried := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled > 0
+	}
+	for !retried() {
+		if time.Now().After(deadline) {
+			t.Fatal("failed message not retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	broker.Send("order.paid", msg)
+	broker.Send("order.paid", broker.Message{Head: map[string]string{broker.HEAD_MESSAGE_ID: "2"}})
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 || handled != 2 {
+		t.Fatalf("%d attempts, %d handled", attempts, handled)
+	}
+	if want := "first second first second first first second"; strings.Join(steps, " ") != want {
+		t.Fatalf("middlewares %v", steps)
+	}
+}
+
+func TestDrainRetries(t *testing.T) {
+	broker.Init(broker.Options{Enable: true, Retry: broker.RetryOptions{MaxAttempts: 3, Delays: []int64{60000}}})
+	defer broker.Disconnect()
+
+	var attempts atomic.Int32
+	broker.Consume("invoice.created", "mailer", func(ctx context.Context, msg broker.Message) error {
+		attempts.Add(1)
+		return errors.New("smtp down")
+	}, broker.WithConcurrency(2))
+	broker.Send("invoice.created", broker.Message{Body: []byte("1")})
+	deadline := time.Now().Add(time.Second)
+	for attempts.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not handled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := broker.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dls, err := broker.ListDeadLetters("invoice.created", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 || dls[0].Attempts != 1 || attempts.Load() != 1 {
+		t.Fatalf("%d attempts, dead letters %+v", attempts.Load(), dls)
+	}
+	// no retries once drained
+	broker.Send("invoice.created", broker.Message{Body: []byte("2")})
+	if dls, _ = broker.ListDeadLetters("invoice.created", 0); len(dls) != 2 {
+		t.Fatalf("failed message after drained not dead-lettered, %d dead letters", len(dls))
+	}
+}
@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HEAD_DEAD_ID       = "x-dead-id"
+	HEAD_DEAD_TOPIC    = "x-dead-topic"
+	HEAD_DEAD_GROUP    = "x-dead-group"
+	HEAD_DEAD_ERROR    = "x-dead-error"
+	HEAD_DEAD_ATTEMPTS = "x-dead-attempts"
+	HEAD_DEAD_TIME     = "x-dead-time"
+
+	defaultStoreSize = 1000
+)
+
+var deadLetters atomic.Value
+
+// DeadLetter is a message failed after all attempts
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	Group    string    `json:"group"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+	Message  Message   `json:"message"`
+}
+
+// DeadLetterStore keeps the dead letters for the inspection and replay, besides the dead letter topics
+type DeadLetterStore interface {
+	Save(dl DeadLetter) error
+	// List returns the newest dead letters of the topic first, all topics if empty
+	List(topic string, limit int) ([]DeadLetter, error)
+	Get(id string) (DeadLetter, bool, error)
+	Delete(id string) error
+}
+
+// DurableStore is implemented by the dead letter stores kept across restarts, a message saved by such a store
+// is dead-lettered even if the dead letter topic can't be published
+type DurableStore interface {
+	Durable() bool
+}
+
+type storeHolder struct {
+	DeadLetterStore
+}
+
+func init() {
+	SetDeadLetterStore(NewMemoryStore(defaultStoreSize))
+}
+
+// SetDeadLetterStore replaces the default memory store, which is lost on restart and not shared by the instances,
+// a persistent store should implement DurableStore
+func SetDeadLetterStore(s DeadLetterStore) {
+	deadLetters.Store(storeHolder{s})
+}
+
+func deadLetterStore() DeadLetterStore {
+	return deadLetters.Load().(storeHolder).DeadLetterStore
+}
+
+// deadLetter saves the message and publishes it to the dead letter topic with the failure in the head.
+// It fails if the publish fails unless a durable store saved the message, the memory store alone would lose
+// the message acked by the caller on restart. With jetstream the dead letter topics must be covered by a stream
+func deadLetter(topic, group string, msg Message, cause error, attempts int) error {
+	dl := DeadLetter{
+		ID:       logger.NewRequestID(),
+		Topic:    topic,
+		Group:    group,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		Time:     time.Now(),
+		Message:  Message{Head: make(map[string]string, len(msg.Head)), Body: msg.Body},
+	}
+	for k, v := range msg.Head {
+		if k != HEAD_DELIVERY_COUNT && k != HEAD_REPLAY_GROUP {
+			dl.Message.Head[k] = v
+		}
+	}
+	store := deadLetterStore()
+	saveErr := store.Save(dl)
+	if saveErr != nil {
+		logger.Error("dead letter save error", saveErr, logger.Val{K: "topic", V: topic})
+	}
+	head := make(map[string]string, len(dl.Message.Head)+6)
+	for k, v := range dl.Message.Head {
+		head[k] = v
+	}
+	head[HEAD_DEAD_ID] = dl.ID
+	head[HEAD_DEAD_TOPIC] = topic
+	head[HEAD_DEAD_GROUP] = group
+	head[HEAD_DEAD_ERROR] = dl.Error
+	head[HEAD_DEAD_ATTEMPTS] = strconv.Itoa(attempts)
+	head[HEAD_DEAD_TIME] = dl.Time.Format(time.RFC3339)
+	sendErr := send(msg.Context(), DeadLetterTopic(topic), Message{Head: head, Body: dl.Message.Body})
+	if sendErr != nil && (saveErr != nil || !durable(store)) {
+		if saveErr == nil {
+			// the caller keeps the message, it is saved again by the next attempt
+			store.Delete(dl.ID)
+		}
+		return sendErr
+	}
+	deadLettered.Inc(topic, group)
+	logger.FromContext(msg.Context()).Module(logModule).Warnf("message of %s dead-lettered as %s after %d attempts",
+		topic, dl.ID, attempts)
+	return nil
+}
+
+func durable(s DeadLetterStore) bool {
+	d, ok := s.(DurableStore)
+	return ok && d.Durable()
+}
+
+func ListDeadLetters(topic string, limit int) ([]DeadLetter, error) {
+	return deadLetterStore().List(topic, limit)
+}
+
+// ReplayDeadLetter publishes the message to its topic again, only the failed group handles it
+func ReplayDeadLetter(ctx context.Context, id string) error {
+	s := deadLetterStore()
+	dl, ok, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("dead letter %s not found", id))
+	}
+	msg := Message{Head: make(map[string]string, len(dl.Message.Head)+1), Body: dl.Message.Body}
+	for k, v := range dl.Message.Head {
+		msg.Head[k] = v
+	}
+	if dl.Group != "" {
+		msg.Head[HEAD_REPLAY_GROUP] = dl.Group
+	}
+	if err = send(ctx, dl.Topic, msg); err != nil {
+		return err
+	}
+	return s.Delete(id)
+}
+
+func DeleteDeadLetter(id string) error {
+	return deadLetterStore().Delete(id)
+}
+
+// memoryStore keeps the latest dead letters up to size
+type memoryStore struct {
+	size int
+	mu   sync.Mutex
+	dls  []DeadLetter
+}
+
+func NewMemoryStore(size int) DeadLetterStore {
+	if size <= 0 {
+		size = defaultStoreSize
+	}
+	return &memoryStore{size: size}
+}
+
+func (s *memoryStore) Save(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dls) >= s.size {
+		s.dls = s.dls[1:]
+	}
+	s.dls = append(s.dls, dl)
+	return nil
+}
+
+func (s *memoryStore) List(topic string, limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []DeadLetter
+	for i := len(s.dls) - 1; i >= 0; i-- {
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+		if topic == "" || s.dls[i].Topic == topic {
+			ret = append(ret, s.dls[i])
+		}
+	}
+	return ret, nil
+}
+
+func (s *memoryStore) Get(id string) (DeadLetter, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, dl := range s.dls {
+		if dl.ID == id {
+			return dl, true, nil
+		}
+	}
+	return DeadLetter{}, false, nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, dl := range s.dls {
+		if dl.ID == id {
+			s.dls = append(s.dls[:i], s.dls[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
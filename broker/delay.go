@@ -0,0 +1,294 @@
+package broker
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/trace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDelayInterval    = 1000
+	defaultDelayBatchSize   = 100
+	defaultDelayLease       = 30
+	defaultDelayMaxAttempts = 10
+)
+
+var (
+	delays    atomic.Value
+	scheduled atomic.Pointer[scheduler]
+
+	delayedSent = metrics.NewCounterVec(metrics.NAMESPACE+"_broker_delayed_sent_total",
+		"Total number of delayed messages sent by the scheduler.", "topic", "result")
+)
+
+// DelayOptions of broker.delay, the schedulers of all instances share the store, a due message is leased
+// to one scheduler at a time and sent at least once
+type DelayOptions struct {
+	// Interval of polling the store in millisecond
+	Interval int64 `yaml:"interval"`
+	// BatchSize is the most due messages taken from the store per interval
+	BatchSize int `yaml:"batchSize"`
+	// Lease in second, a message not sent within it is leased again, it must be longer than sending a batch
+	Lease int64 `yaml:"lease"`
+	// MaxAttempts of sending before the message is dead-lettered, 10 by default, -1 retries forever
+	MaxAttempts int `yaml:"maxAttempts"`
+}
+
+// Delayed is a message waiting for its time
+type Delayed struct {
+	ID      string    `json:"id"`
+	Topic   string    `json:"topic"`
+	At      time.Time `json:"at"`
+	Message Message   `json:"message"`
+	// Token of the lease returned by Lease, Ack takes it
+	Token string `json:"-"`
+	// Attempts are the leases of the message including the current one
+	Attempts int `json:"-"`
+}
+
+// DelayStore keeps the delayed messages until they are sent or canceled
+type DelayStore interface {
+	// Save replaces the message of the same id, so it is rescheduled and its attempts restart
+	Save(ctx context.Context, d Delayed) error
+	// Lease returns the messages due at now, oldest first, with a new token and the attempts counted,
+	// and hides them from the other leases until now+lease, a message not acked by then is due again
+	Lease(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Delayed, error)
+	// Ack deletes the message sent under the lease of token, it reports false if the message is
+	// rescheduled, canceled or leased again since, so a reschedule made while sending is kept
+	Ack(ctx context.Context, id, token string) (bool, error)
+	// Delete reports false if the message is not found
+	Delete(ctx context.Context, id string) (bool, error)
+}
+
+type delayHolder struct {
+	DelayStore
+}
+
+func init() {
+	SetDelayStore(NewMemoryDelayStore())
+}
+
+// SetDelayStore replaces the default memory store, which is lost on restart and not shared by the instances
+func SetDelayStore(s DelayStore) {
+	delays.Store(delayHolder{s})
+}
+
+func delayStore() DelayStore {
+	return delays.Load().(delayHolder).DelayStore
+}
+
+// SendAfter sends the message after d, see SendAt
+func SendAfter(ctx context.Context, topic string, msg Message, d time.Duration) (string, error) {
+	return SendAt(ctx, topic, msg, time.Now().Add(d))
+}
+
+// SendAt saves the message to the delay store and the scheduler sends it at the time, the trace of ctx is
+// continued then. The id is HEAD_MESSAGE_ID of the message or a new one, used by CancelDelayed.
+// Sending a message of the same id again reschedules it
+func SendAt(ctx context.Context, topic string, msg Message, at time.Time) (string, error) {
+	d := Delayed{Topic: topic, At: at, Message: Message{Head: outgoingHead(ctx, msg.Head), Body: msg.Body}}
+	d.ID = d.Message.Head[HEAD_MESSAGE_ID]
+	if d.ID == "" {
+		d.ID = logger.NewRequestID()
+		d.Message.Head[HEAD_MESSAGE_ID] = d.ID
+	}
+	if err := delayStore().Save(ctx, d); err != nil {
+		logger.FromContext(ctx).Module(logModule).Error("broker delay save error", err, logger.Val{K: "topic", V: topic})
+		return "", err
+	}
+	return d.ID, nil
+}
+
+// CancelDelayed deletes the message not sent yet, it reports false if the message is not found.
+// A message leased by a scheduler at the moment may still be sent
+func CancelDelayed(ctx context.Context, id string) (bool, error) {
+	return delayStore().Delete(ctx, id)
+}
+
+// scheduler sends the due messages of the store through the broker
+type scheduler struct {
+	opts DelayOptions
+	stop chan bool
+	done chan bool
+}
+
+// startScheduler replaces the scheduler of the previous broker
+func startScheduler(opts DelayOptions) {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultDelayInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultDelayBatchSize
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = defaultDelayLease
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultDelayMaxAttempts
+	}
+	s := &scheduler{opts: opts, stop: make(chan bool), done: make(chan bool)}
+	if old := scheduled.Swap(s); old != nil {
+		old.close()
+	}
+	go s.run()
+}
+
+func stopScheduler() {
+	if s := scheduled.Swap(nil); s != nil {
+		s.close()
+	}
+}
+
+// close waits for the batch in progress, the messages leased but not sent are sent after the lease
+func (s *scheduler) close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *scheduler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Duration(s.opts.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		if !Connected() {
+			continue
+		}
+		// a full batch means more are due
+		for {
+			n, err := s.schedule(context.Background())
+			if err != nil {
+				logger.Module(logModule).Error("broker delay lease error", err)
+				break
+			}
+			if n < s.opts.BatchSize {
+				break
+			}
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// schedule sends a batch, it returns the number of the messages leased
+func (s *scheduler) schedule(ctx context.Context) (int, error) {
+	ds, err := delayStore().Lease(ctx, time.Now(), s.opts.BatchSize, time.Duration(s.opts.Lease)*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range ds {
+		msgCtx := trace.Extract(ctx, func(k string) string {
+			return d.Message.Head[k]
+		})
+		msgCtx = logger.Extract(msgCtx, func(k string) string {
+			return d.Message.Head[k]
+		}, "")
+		msg := d.Message
+		msg.ctx = msgCtx
+		log := logger.FromContext(msgCtx).Module(logModule)
+		switch err := send(msgCtx, d.Topic, msg); {
+		case err == nil:
+			delayedSent.Inc(d.Topic, "ok")
+		case s.opts.MaxAttempts < 0 || d.Attempts < s.opts.MaxAttempts:
+			// sent again after the lease
+			delayedSent.Inc(d.Topic, "error")
+			continue
+		default:
+			if err = deadLetter(d.Topic, "", msg, err, d.Attempts); err != nil {
+				delayedSent.Inc(d.Topic, "error")
+				log.Error("broker delay dead letter error", err, logger.Val{K: "id", V: d.ID})
+				continue
+			}
+			delayedSent.Inc(d.Topic, "dead")
+		}
+		if ok, err := delayStore().Ack(ctx, d.ID, d.Token); err != nil {
+			log.Error("broker delay ack error, it may be sent again", err, logger.Val{K: "id", V: d.ID})
+		} else if !ok {
+			log.Warnf("delayed message %s rescheduled or leased again while sending, it is kept", d.ID)
+		}
+	}
+	return len(ds), nil
+}
+
+// NewMemoryDelayStore scans all messages on lease, it is for the development and tests
+func NewMemoryDelayStore() DelayStore {
+	return &memoryDelayStore{items: make(map[string]*delayItem)}
+}
+
+type delayItem struct {
+	Delayed
+	due time.Time
+}
+
+type memoryDelayStore struct {
+	mu    sync.Mutex
+	items map[string]*delayItem
+}
+
+func (s *memoryDelayStore) Save(ctx context.Context, d Delayed) error {
+	if d.ID == "" {
+		return errs.New(errs.ERRCODE_BROKER, "delayed message without id")
+	}
+	d.Token, d.Attempts = "", 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[d.ID] = &delayItem{Delayed: d, due: d.At}
+	return nil
+}
+
+func (s *memoryDelayStore) Lease(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]Delayed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*delayItem
+	for _, it := range s.items {
+		if !it.due.After(now) {
+			due = append(due, it)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].due.Before(due[j].due)
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	ds := make([]Delayed, len(due))
+	for i, it := range due {
+		it.due = now.Add(lease)
+		it.Token = logger.NewRequestID()
+		it.Attempts++
+		ds[i] = it.Delayed
+	}
+	return ds, nil
+}
+
+func (s *memoryDelayStore) Ack(ctx context.Context, id, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[id]
+	if !ok || it.Token != token {
+		return false, nil
+	}
+	delete(s.items, id)
+	return true, nil
+}
+
+func (s *memoryDelayStore) Delete(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[id]
+	delete(s.items, id)
+	return ok, nil
+}
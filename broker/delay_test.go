@@ -0,0 +1,160 @@
+package broker_test
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/broker"
+	"testing"
+	"time"
+)
+
+func TestSendAfter(t *testing.T) {
+	broker.SetDelayStore(broker.NewMemoryDelayStore())
+	broker.Init(broker.Options{Enable: true, Delay: broker.DelayOptions{Interval: 5}})
+	defer broker.Disconnect()
+
+	got := make(chan broker.Message, 2)
+	broker.Recv(true, "order.timeout", "orders", func(msg broker.Message) {
+		got <- msg
+	})
+	start := time.Now()
+	id, err := broker.SendAfter(context.Background(), "order.timeout", broker.Message{Body: []byte("1")}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceled, _ := broker.SendAfter(context.Background(), "order.timeout", broker.Message{Body: []byte("2")}, 20*time.Millisecond)
+	if ok, err := broker.CancelDelayed(context.Background(), canceled); !ok || err != nil {
+		t.Fatalf("cancel %v, error %v", ok, err)
+	}
+	select {
+	case msg := <-got:
+		if string(msg.Body) != "1" || msg.Head[broker.HEAD_MESSAGE_ID] != id {
+			t.Fatalf("received %s", msg)
+		}
+		if time.Since(start) < 50*time.Millisecond {
+			t.Fatalf("sent after %s", time.Since(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delayed message not sent")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(got) != 0 {
+		t.Fatalf("canceled or sent message received again %s", <-got)
+	}
+	if ok, _ := broker.CancelDelayed(context.Background(), id); ok {
+		t.Fatal("sent message canceled")
+	}
+}
+
+func TestMemoryDelayStore(t *testing.T) {
+	s := broker.NewMemoryDelayStore()
+	ctx := context.Background()
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		s.Save(ctx, broker.Delayed{ID: id, Topic: "t", At: now.Add(time.Duration(i-2) * time.Second)})
+	}
+	ds, _ := s.Lease(ctx, now, 2, time.Minute)
+	if len(ds) != 2 || ds[0].ID != "c" || ds[1].ID != "a" {
+		t.Fatalf("leased %+v", ds)
+	}
+	// leased ones are hidden until the lease expires
+	if ds, _ = s.Lease(ctx, now, 10, time.Minute); len(ds) != 1 || ds[0].ID != "b" {
+		t.Fatalf("leased again %+v", ds)
+	}
+	if ds, _ = s.Lease(ctx, now.Add(2*time.Minute), 10, time.Minute); len(ds) != 3 {
+		t.Fatalf("expired leases %+v", ds)
+	}
+}
+
+func TestDelayAck(t *testing.T) {
+	s := broker.NewMemoryDelayStore()
+	ctx := context.Background()
+	now := time.Now()
+	s.Save(ctx, broker.Delayed{ID: "a", Topic: "t", At: now})
+	ds, _ := s.Lease(ctx, now, 10, time.Minute)
+	if len(ds) != 1 || ds[0].Token == "" || ds[0].Attempts != 1 {
+		t.Fatalf("leased %+v", ds)
+	}
+	// saved again by a reschedule before the send is acked
+	s.Save(ctx, broker.Delayed{ID: "a", Topic: "t", At: now.Add(time.Second)})
+	if ok, _ := s.Ack(ctx, "a", ds[0].Token); ok {
+		t.Fatal("rescheduled message acked")
+	}
+	ds, _ = s.Lease(ctx, now.Add(time.Second), 10, time.Minute)
+	if len(ds) != 1 || ds[0].Attempts != 1 {
+		t.Fatalf("rescheduled message leased %+v", ds)
+	}
+	// leased again after the lease expired
+	again, _ := s.Lease(ctx, now.Add(2*time.Minute), 10, time.Minute)
+	if len(again) != 1 || again[0].Attempts != 2 {
+		t.Fatalf("leased again %+v", again)
+	}
+	if ok, _ := s.Ack(ctx, "a", ds[0].Token); ok {
+		t.Fatal("acked by an expired lease")
+	}
+	if ok, _ := s.Ack(ctx, "a", again[0].Token); !ok {
+		t.Fatal("not acked by the lease")
+	}
+	if ok, _ := s.Delete(ctx, "a"); ok {
+		t.Fatal("acked message not deleted")
+	}
+}
+
+type durableStore struct {
+	broker.DeadLetterStore
+}
+
+func (durableStore) Durable() bool {
+	return true
+}
+
+func TestDelayDeadLetter(t *testing.T) {
+	// the dead letter topic can't be published either, the message is dead-lettered by the durable store alone
+	broker.SetDeadLetterStore(durableStore{broker.NewMemoryStore(0)})
+	defer broker.SetDeadLetterStore(broker.NewMemoryStore(0))
+	broker.SetDelayStore(broker.NewMemoryDelayStore())
+	broker.Init(broker.Options{Enable: true, Delay: broker.DelayOptions{Interval: 5, MaxAttempts: 1}})
+	defer broker.Disconnect()
+
+	// the memory broker rejects the wildcards on send
+	id, err := broker.SendAfter(context.Background(), "report.*", broker.Message{Body: []byte("1")}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		dls, _ := broker.ListDeadLetters("report.*", 0)
+		if len(dls) == 1 {
+			if dls[0].Attempts != 1 || dls[0].Message.Head[broker.HEAD_MESSAGE_ID] != id {
+				t.Fatalf("dead letter %+v", dls[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed delayed message not dead-lettered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ok, _ := broker.CancelDelayed(context.Background(), id); ok {
+		t.Fatal("dead-lettered message kept in the store")
+	}
+}
+
+func TestDelayDeadLetterNotSent(t *testing.T) {
+	broker.SetDelayStore(broker.NewMemoryDelayStore())
+	broker.Init(broker.Options{Enable: true, Delay: broker.DelayOptions{Interval: 5, MaxAttempts: 1}})
+	defer broker.Disconnect()
+
+	// neither the topic nor the dead letter topic can be published, the memory store alone doesn't dead-letter it
+	id, err := broker.SendAfter(context.Background(), "report.*", broker.Message{Body: []byte("1")}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if dls, _ := broker.ListDeadLetters("report.*", 0); len(dls) != 0 {
+		t.Fatalf("dead letters %+v", dls)
+	}
+	if ok, _ := broker.CancelDelayed(context.Background(), id); !ok {
+		t.Fatal("message not dead-lettered removed from the store")
+	}
+}
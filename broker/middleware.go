@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/trace"
+	"sync"
+	"time"
+)
+
+// traceMiddleware starts the consumer span and puts the request logger of the message head into ctx
+func traceMiddleware(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error {
+	ctx = trace.Extract(ctx, func(k string) string {
+		return msg.Head[k]
+	})
+	ctx, span := trace.Start(ctx, info.Topic+" receive", trace.SPAN_KIND_CONSUMER)
+	defer span.End()
+	span.SetAttr("messaging.destination", info.Topic)
+	span.SetAttr("messaging.consumer_group", info.Group)
+	msg.ctx = logger.Extract(ctx, func(k string) string {
+		return msg.Head[k]
+	}, span.Context().TraceID.String())
+	return next(msg.ctx, msg)
+}
+
+func metricsMiddleware(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error {
+	start := time.Now()
+	defer func() {
+		consumed.Inc(info.Topic, info.Group)
+		handleLatency.Observe(time.Since(start).Seconds(), info.Topic, info.Group)
+	}()
+	return next(ctx, msg)
+}
+
+// recoverMiddleware turns the panic of the handler into an error, which is retried by retryMiddleware
+func recoverMiddleware(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error {
+	return safeHandle(func(msg Message) error {
+		return next(ctx, msg)
+	}, msg)
+}
+
+// LogMiddleware logs the handled messages in debug level of the broker module
+func LogMiddleware(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error {
+	start := time.Now()
+	err := next(ctx, msg)
+	vals := []logger.Val{
+		{K: "topic", V: info.Topic},
+		{K: "group", V: info.Group},
+		{K: "delivery", V: msg.Head[HEAD_DELIVERY_COUNT]},
+		{K: "latency", V: time.Since(start).Milliseconds()},
+	}
+	if err != nil {
+		vals = append(vals, logger.Val{K: "error", V: err.Error()})
+	}
+	logger.FromContext(ctx).With(vals...).Module(logModule).Debug("broker message handled")
+	return err
+}
+
+// DedupStore keeps the ids of the handled messages
+type DedupStore interface {
+	// Seen reports whether the key is marked and not expired
+	Seen(ctx context.Context, key string) (bool, error)
+	Mark(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// DedupMiddleware skips the messages whose HEAD_MESSAGE_ID is handled by the group within ttl, the id is
+// marked once the handler succeeds. The messages without an id and the failures of the store are handled
+func DedupMiddleware(store DedupStore, ttl time.Duration) Middleware {
+	return func(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error {
+		id := msg.Head[HEAD_MESSAGE_ID]
+		if id == "" {
+			return next(ctx, msg)
+		}
+		key := info.Group + ":" + id
+		log := logger.FromContext(ctx).Module(logModule)
+		seen, err := store.Seen(ctx, key)
+		if err != nil {
+			log.Error("broker dedup error", err, logger.Val{K: "topic", V: info.Topic})
+		}
+		if seen {
+			log.Debug("broker duplicate message skipped ", id)
+			return nil
+		}
+		if err = next(ctx, msg); err != nil {
+			return err
+		}
+		if err := store.Mark(ctx, key, ttl); err != nil {
+			log.Error("broker dedup error", err, logger.Val{K: "topic", V: info.Topic})
+		}
+		return nil
+	}
+}
+
+// NewMemoryDedupStore keeps the latest size keys in memory, the oldest one is dropped once it is full
+func NewMemoryDedupStore(size int) DedupStore {
+	if size <= 0 {
+		size = 10000
+	}
+	return &memoryDedupStore{size: size, keys: make(map[string]time.Time, size)}
+}
+
+type memoryDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	keys  map[string]time.Time
+	order []string
+}
+
+func (s *memoryDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expire, ok := s.keys[key]
+	return ok && time.Now().Before(expire), nil
+}
+
+func (s *memoryDedupStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.keys[key] = time.Now().Add(ttl)
+	for len(s.order) > s.size {
+		delete(s.keys, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
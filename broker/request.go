@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/trace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HEAD_REPLY_TO       = "x-reply-to"
+	HEAD_CORRELATION_ID = "x-correlation-id"
+	HEAD_REPLY_CODE     = "x-reply-code"
+	HEAD_REPLY_ERROR    = "x-reply-error"
+
+	INBOX_PREFIX = "_INBOX"
+
+	defaultRequestTimeout = 10 * time.Second
+)
+
+var (
+	inbox = &replyInbox{}
+
+	requests = metrics.NewCounterVec(metrics.NAMESPACE+"_broker_requests_total",
+		"Total number of requests sent over the broker.", "topic", "result")
+	requestLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_broker_request_duration_seconds",
+		"Latency of the requests sent over the broker.", nil, "topic")
+)
+
+// Requester is implemented by the brokers with a native request-reply like the nats inboxes, or failing it
+// like kafka. The others are emulated by a reply topic of the instance and HEAD_CORRELATION_ID
+type Requester interface {
+	Request(ctx context.Context, topic string, msg Message) (Message, error)
+	Respond(topic, group string, handler func(msg Message) Message) error
+}
+
+// Responder answers a request, the error is returned by Request with its code
+type Responder func(msg Message) (Message, error)
+
+// Request sends msg and waits for the reply until the deadline of ctx, 10s if ctx has none.
+// It returns an error of ERRCODE_TIMEOUT once the deadline is exceeded. Only the nats broker knows
+// that no one subscribes the topic and fails at once with ERRCODE_BROKER, with the emulated
+// request-reply such a request waits for the deadline and times out
+func Request(ctx context.Context, topic string, msg Message) (reply Message, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	ctx, span := trace.Start(ctx, topic+" request", trace.SPAN_KIND_CLIENT)
+	span.SetAttr("messaging.destination", topic)
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+			if me, ok := errs.FromError(err); ok && me.Code() == errs.ERRCODE_TIMEOUT {
+				result = "timeout"
+			}
+			span.SetError(err)
+		}
+		span.End()
+		requests.Inc(topic, result)
+		requestLatency.Observe(time.Since(start).Seconds(), topic)
+	}()
+	msg.Head = outgoingHead(ctx, msg.Head)
+	if r, ok := (*MqBroker).(Requester); ok {
+		reply, err = r.Request(ctx, topic, msg)
+	} else {
+		reply, err = inbox.request(ctx, topic, msg)
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return reply, errs.Wrap(errs.ERRCODE_TIMEOUT, fmt.Sprintf("broker request %s timeout", topic), err)
+		}
+		if _, ok := errs.FromError(err); ok {
+			return reply, err
+		}
+		return reply, errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("broker request %s error", topic), err)
+	}
+	return reply, replyError(reply)
+}
+
+// Respond registers the responder of the topic, one responder of the group answers a request,
+// all responders answer it if the group is empty and the first reply wins
+func Respond(topic, group string, handler Responder) error {
+	if r, ok := (*MqBroker).(Requester); ok {
+		return r.Respond(topic, group, func(msg Message) Message {
+			var reply Message
+			observeHandler(topic, group, func(msg Message) {
+				reply = respond(handler, msg)
+			})(msg)
+			return reply
+		})
+	}
+	return (*MqBroker).Receive(group != "", topic, group, observeHandler(topic, group, func(msg Message) {
+		to, id := msg.Head[HEAD_REPLY_TO], msg.Head[HEAD_CORRELATION_ID]
+		if to == "" || id == "" {
+			logger.FromContext(msg.Context()).Module(logModule).Warnf("request of %s without reply topic dropped", topic)
+			return
+		}
+		reply := respond(handler, msg)
+		reply.Head[HEAD_CORRELATION_ID] = id
+		if err := (*MqBroker).Send(to, reply); err != nil {
+			logger.FromContext(msg.Context()).Module(logModule).Error("broker reply error", err, logger.Val{K: "topic", V: topic})
+		}
+	}))
+}
+
+// respond puts the error of the responder into the reply head
+func respond(handler Responder, msg Message) Message {
+	var reply Message
+	err := safeHandle(func(msg Message) error {
+		var err error
+		reply, err = handler(msg)
+		return err
+	}, msg)
+	head := make(map[string]string, len(reply.Head)+2)
+	for k, v := range reply.Head {
+		head[k] = v
+	}
+	if err != nil {
+		logger.FromContext(msg.Context()).Module(logModule).Error("broker respond error", err)
+		code := errs.ERRCODE_COMMON
+		if me, ok := errs.FromError(err); ok {
+			code = me.Code()
+		}
+		head[HEAD_REPLY_CODE] = strconv.Itoa(code)
+		head[HEAD_REPLY_ERROR] = err.Error()
+		return Message{Head: head}
+	}
+	return Message{Head: head, Body: reply.Body}
+}
+
+func replyError(reply Message) error {
+	msg, ok := reply.Head[HEAD_REPLY_ERROR]
+	if !ok {
+		return nil
+	}
+	code, err := strconv.Atoi(reply.Head[HEAD_REPLY_CODE])
+	if err != nil {
+		code = errs.ERRCODE_COMMON
+	}
+	return errs.New(code, msg)
+}
+
+// replyInbox emulates the request-reply by a reply topic subscribed once per broker
+type replyInbox struct {
+	mu      sync.Mutex
+	broker  Broker
+	topic   string
+	pending sync.Map
+}
+
+func (i *replyInbox) request(ctx context.Context, topic string, msg Message) (Message, error) {
+	to, err := i.subscribe()
+	if err != nil {
+		return Message{}, err
+	}
+	id := logger.NewRequestID()
+	ch := make(chan Message, 1)
+	i.pending.Store(id, ch)
+	defer i.pending.Delete(id)
+	msg.Head[HEAD_REPLY_TO] = to
+	msg.Head[HEAD_CORRELATION_ID] = id
+	if err = (*MqBroker).Send(topic, msg); err != nil {
+		return Message{}, err
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (i *replyInbox) subscribe() (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	b := *MqBroker
+	if i.broker == b {
+		return i.topic, nil
+	}
+	topic := INBOX_PREFIX + "." + logger.NewRequestID()
+	if err := b.Receive(false, topic, "", i.dispatch); err != nil {
+		return "", err
+	}
+	i.broker, i.topic = b, topic
+	return topic, nil
+}
+
+// dispatch drops the late replies whose requests are done
+func (i *replyInbox) dispatch(msg Message) {
+	if ch, ok := i.pending.Load(msg.Head[HEAD_CORRELATION_ID]); ok {
+		select {
+		case ch.(chan Message) <- msg:
+		default:
+		}
+	}
+}
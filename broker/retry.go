@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HEAD_REPLAY_GROUP limits a replayed dead letter to the group failed on it
+	HEAD_REPLAY_GROUP = "x-replay-group"
+
+	defaultDeadLetterPrefix = "dlq"
+)
+
+var (
+	retryOpts atomic.Pointer[RetryOptions]
+
+	// retryTimers are the in-process retries waiting for their delays with the funcs dead-lettering them,
+	// Drain cancels them rather than losing them on exit and waits for the running ones counted by retrying
+	retryTimers   = make(map[*time.Timer]func())
+	retryMu       sync.Mutex
+	retryDraining bool
+	retrying      atomic.Int64
+
+	retried = metrics.NewCounterVec(metrics.NAMESPACE+"_broker_retried_total",
+		"Total number of messages retried after the handler failed.", "topic", "group")
+	deadLettered = metrics.NewCounterVec(metrics.NAMESPACE+"_broker_dead_lettered_total",
+		"Total number of messages published to the dead letter topics.", "topic", "group")
+)
+
+// RetryOptions of broker.retry, a failed message is retried after the delays, then dead-lettered.
+// The durable brokers redeliver it by Nak, the others retry in process, Drain dead-letters the retries
+// still waiting so they are not lost on exit
+type RetryOptions struct {
+	// MaxAttempts including the first one, 1 by default which dead-letters at once
+	MaxAttempts int `yaml:"maxAttempts"`
+	// Delays between the attempts in millisecond, the last one is reused for the rest.
+	// The kafka broker waits for them in place, holding up the partitions of the reader
+	Delays []int64 `yaml:"delays"`
+	// DeadLetterPrefix of the dead letter topics, dlq by default, like dlq.order.created.
+	// With jetstream a stream must cover them, like dlq.>, or the messages failed are nak-ed again
+	DeadLetterPrefix string `yaml:"deadLetterPrefix"`
+	// DisableDeadLetter only logs the message failed after the attempts
+	DisableDeadLetter bool `yaml:"disableDeadLetter"`
+	// StoreSize is the capacity of the default dead letter store kept for the inspection and replay
+	StoreSize int `yaml:"storeSize"`
+}
+
+func init() {
+	setRetry(RetryOptions{})
+}
+
+func setRetry(opts RetryOptions) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if opts.DeadLetterPrefix == "" {
+		opts.DeadLetterPrefix = defaultDeadLetterPrefix
+	}
+	retryOpts.Store(&opts)
+	// retried in process again by the new broker
+	retryMu.Lock()
+	retryDraining = false
+	retryMu.Unlock()
+	if opts.StoreSize > 0 {
+		if s, ok := deadLetterStore().(*memoryStore); ok && s.size != opts.StoreSize {
+			SetDeadLetterStore(NewMemoryStore(opts.StoreSize))
+		}
+	}
+}
+
+// DeadLetterTopic is the topic receiving the dead letters of the topic
+func DeadLetterTopic(topic string) string {
+	return retryOpts.Load().DeadLetterPrefix + "." + topic
+}
+
+func (o *RetryOptions) delay(attempt int) time.Duration {
+	if len(o.Delays) == 0 {
+		return 0
+	}
+	i := attempt - 1
+	if i >= len(o.Delays) {
+		i = len(o.Delays) - 1
+	}
+	return time.Duration(o.Delays[i]) * time.Millisecond
+}
+
+// retryMiddleware settles the message once handled, the failed one is retried after the delays and
+// dead-lettered after the attempts, so the middlewares before it never see the error
+func retryMiddleware(ctx context.Context, msg Message, info *ConsumeInfo, next ConsumeHandler) error {
+	if g := msg.Head[HEAD_REPLAY_GROUP]; g != "" && g != info.Group {
+		msg.Ack()
+		return nil
+	}
+	attempt := 1
+	if n, err := strconv.Atoi(msg.Head[HEAD_DELIVERY_COUNT]); err == nil && n > 0 {
+		attempt = n
+	}
+	handleAttempt(ctx, info, next, msg, attempt)
+	return nil
+}
+
+// Reject wraps the error of a message never handled successfully like a decode error,
+// the message is dead-lettered at once without the retries
+func Reject(err error) error {
+	return rejected{err}
+}
+
+type rejected struct {
+	error
+}
+
+func (r rejected) Unwrap() error {
+	return r.error
+}
+
+func handleAttempt(ctx context.Context, info *ConsumeInfo, handler ConsumeHandler, msg Message, attempt int) {
+	err := handler(ctx, msg)
+	if err == nil {
+		return
+	}
+	topic, group := info.Topic, info.Group
+	opts := retryOpts.Load()
+	log := logger.FromContext(ctx).Module(logModule)
+	var r rejected
+	reject := errors.As(err, &r)
+	if reject {
+		log.Error("broker message rejected", r.error,
+			logger.Val{K: "topic", V: topic},
+			logger.Val{K: "group", V: group},
+			logger.Val{K: HEAD_CONTENT_TYPE, V: msg.Head[HEAD_CONTENT_TYPE]})
+		err = r.error
+	} else {
+		log.Error("broker handle error", err,
+			logger.Val{K: "topic", V: topic},
+			logger.Val{K: "group", V: group},
+			logger.Val{K: "attempt", V: attempt})
+	}
+	if !reject && attempt < opts.MaxAttempts {
+		delay := opts.delay(attempt)
+		if msg.acker != nil {
+			retried.Inc(topic, group)
+			msg.Nak(delay)
+			return
+		}
+		if scheduleRetry(delay, func() {
+			handleAttempt(ctx, info, handler, msg, attempt+1)
+		}, func() {
+			giveUp(ctx, info, msg, err, attempt)
+		}) {
+			retried.Inc(topic, group)
+			return
+		}
+		log.Warn("broker draining, message dead-lettered without retries",
+			logger.Val{K: "topic", V: topic}, logger.Val{K: "group", V: group})
+	}
+	giveUp(ctx, info, msg, err, attempt)
+}
+
+// giveUp dead-letters the message failed after the attempts
+func giveUp(ctx context.Context, info *ConsumeInfo, msg Message, err error, attempt int) {
+	opts := retryOpts.Load()
+	if opts.DisableDeadLetter {
+		msg.Term()
+		return
+	}
+	if err := deadLetter(info.Topic, info.Group, msg, err, attempt); err != nil {
+		logger.FromContext(ctx).Module(logModule).Error("broker dead letter error", err, logger.Val{K: "topic", V: info.Topic})
+		// redelivered by the durable brokers, dead-lettered again once failed
+		msg.Nak(opts.delay(attempt))
+		return
+	}
+	msg.Ack()
+}
+
+// scheduleRetry runs retry after the delay, it reports false once draining
+func scheduleRetry(delay time.Duration, retry, giveUp func()) bool {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	if retryDraining {
+		return false
+	}
+	retrying.Add(1)
+	var t *time.Timer
+	// the timer waits for the lock, so t is set before it is deleted
+	t = time.AfterFunc(delay, func() {
+		defer retrying.Add(-1)
+		retryMu.Lock()
+		delete(retryTimers, t)
+		retryMu.Unlock()
+		retry()
+	})
+	retryTimers[t] = giveUp
+	return true
+}
+
+// drainRetries dead-letters the retries waiting for their delays, the failures after it are
+// dead-lettered at once
+func drainRetries() {
+	retryMu.Lock()
+	retryDraining = true
+	var cancelled []func()
+	for t, giveUp := range retryTimers {
+		if t.Stop() {
+			cancelled = append(cancelled, giveUp)
+		}
+		delete(retryTimers, t)
+	}
+	retryMu.Unlock()
+	for _, giveUp := range cancelled {
+		giveUp()
+		retrying.Add(-1)
+	}
+}
+
+// safeHandle turns the panic of the handler into an error
+func safeHandle(handler ErrorHandler, msg Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = errs.Wrap(errs.ERRCODE_BROKER, "handler panic", e)
+			} else {
+				err = errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("handler panic: %v", r))
+			}
+		}
+	}()
+	return handler(msg)
+}
@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"context"
+	"reflect"
+)
+
+// Publish encodes v by Encode and sends it, the content type is kept in the head for the consumers
+func Publish[T any](topic string, v T) error {
+	return PublishContext(context.Background(), topic, v)
+}
+
+func PublishContext[T any](ctx context.Context, topic string, v T) error {
+	msg, err := Encode(v, "")
+	if err != nil {
+		return err
+	}
+	return send(ctx, topic, msg)
+}
+
+// Subscribe decodes the messages into T by their content type, T must be a pointer for the proto messages.
+// The group shares the messages like Recv once, or every instance gets them if it is empty.
+// A message failed to decode is dead-lettered at once without the retries
+func Subscribe[T any](topic, group string, handler func(ctx context.Context, v T) error, opts ...ConsumeOption) error {
+	return Consume(topic, group, func(ctx context.Context, msg Message) error {
+		v, err := decodeAs[T](msg)
+		if err != nil {
+			return Reject(err)
+		}
+		return handler(ctx, v)
+	}, opts...)
+}
+
+// decodeAs allocates the value of a pointer T, so the codecs requiring a pointer like protobuf get it
+func decodeAs[T any](msg Message) (T, error) {
+	var v T
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Pointer {
+		v = reflect.New(t.Elem()).Interface().(T)
+		return v, Decode(msg, v)
+	}
+	return v, Decode(msg, &v)
+}
@@ -1,19 +1,31 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
 	"github.com/billyyoyo/microj/registry"
+	"github.com/billyyoyo/microj/trace"
 	"github.com/go-resty/resty/v2"
 	"math/rand"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	restWatcher chan bool
 	r           = rand.New(rand.NewSource(99))
 	next        Next
+
+	apiRequests = metrics.NewCounterVec(metrics.NAMESPACE+"_api_client_requests_total",
+		"Total number of requests sent by the api clients.", "service", "node", "status")
+	apiLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_api_client_request_duration_seconds",
+		"Latency of requests sent by the api clients.", nil, "service", "node")
 )
 
 func init() {
@@ -26,9 +38,60 @@ func NewApiClient(serviceName string) *resty.Client {
 	cli := resty.New()
 	cli.SetBaseURL(fmt.Sprintf("lb://%s", serviceName))
 	cli.OnBeforeRequest(onBefore)
+	cli.OnBeforeRequest(startRequestSpan)
+	cli.OnAfterResponse(func(cli *resty.Client, resp *resty.Response) error {
+		observeRequest(serviceName, resp.Request, strconv.Itoa(resp.StatusCode()))
+		endRequestSpan(resp.Request, resp.StatusCode(), nil)
+		return nil
+	})
+	cli.OnError(func(req *resty.Request, err error) {
+		observeRequest(serviceName, req, "error")
+		endRequestSpan(req, 0, err)
+	})
 	return cli
 }
 
+type spanKey struct{}
+
+// startRequestSpan runs after onBefore so the span knows the selected node
+func startRequestSpan(cli *resty.Client, req *resty.Request) error {
+	ctx, span := trace.Start(req.Context(), req.Method+" "+cli.BaseURL, trace.SPAN_KIND_CLIENT)
+	span.SetAttr("http.method", req.Method)
+	span.SetAttr("http.url", req.URL)
+	trace.Inject(ctx, func(k, v string) {
+		req.SetHeader(k, v)
+	})
+	logger.Inject(ctx, func(k, v string) {
+		req.SetHeader(k, v)
+	})
+	req.SetContext(context.WithValue(ctx, spanKey{}, span))
+	return nil
+}
+
+func endRequestSpan(req *resty.Request, status int, err error) {
+	span, ok := req.Context().Value(spanKey{}).(*trace.Span)
+	if !ok {
+		return
+	}
+	if status > 0 {
+		span.SetAttr("http.status_code", status)
+	}
+	span.SetError(err)
+	span.End()
+}
+
+// observeRequest labels the request by the node selected in onBefore
+func observeRequest(serviceName string, req *resty.Request, status string) {
+	node := "none"
+	if u, err := url.Parse(req.URL); err == nil && u.Host != "" {
+		node = u.Host
+	}
+	apiRequests.Inc(serviceName, node, status)
+	if !req.Time.IsZero() {
+		apiLatency.Observe(time.Since(req.Time).Seconds(), serviceName, node)
+	}
+}
+
 func onBefore(cli *resty.Client, req *resty.Request) error {
 	if strings.HasPrefix(cli.BaseURL, "lb://") {
 		serviceName := strings.TrimLeft(cli.BaseURL, "lb://")
@@ -1,17 +1,30 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"github.com/billyyoyo/microj/errs"
 	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
 	"github.com/billyyoyo/microj/registry"
+	"github.com/billyyoyo/microj/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+	"time"
 )
 
 var (
 	builder *rpcResolverBuilder
+
+	rpcHandled = metrics.NewCounterVec(metrics.NAMESPACE+"_rpc_client_handled_total",
+		"Total number of rpc calls completed by the rpc clients.", "method", "code")
+	rpcLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_rpc_client_handling_seconds",
+		"Latency of rpc calls completed by the rpc clients.", nil, "method")
 )
 
 func init() {
@@ -28,6 +41,8 @@ func NewRpcConn(serviceName string) *grpc.ClientConn {
 		fmt.Sprintf("lb:///%s", serviceName),
 		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin":{}}]}`), // This sets the initial balancing policy.
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(ErrorUnaryInterceptor, TraceUnaryInterceptor, MetricsUnaryInterceptor),
+		grpc.WithChainStreamInterceptor(ErrorStreamInterceptor, TraceStreamInterceptor, MetricsStreamInterceptor),
 	)
 	if err != nil {
 		err = errs.Wrap(errs.ERRCODE_REMOTE_CALL, err.Error(), err)
@@ -36,6 +51,130 @@ func NewRpcConn(serviceName string) *grpc.ClientConn {
 	return conn
 }
 
+// ErrorUnaryInterceptor restores the errs.MicroError encoded in the status details by the server
+func ErrorUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return errs.FromRpcError(invoker(ctx, method, req, reply, cc, opts...))
+}
+
+// ErrorStreamInterceptor restores the errs.MicroError encoded in the status details by the server
+func ErrorStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, errs.FromRpcError(err)
+	}
+	return &errorClientStream{cs}, nil
+}
+
+type errorClientStream struct {
+	grpc.ClientStream
+}
+
+func (s *errorClientStream) SendMsg(m any) error {
+	return errs.FromRpcError(s.ClientStream.SendMsg(m))
+}
+
+func (s *errorClientStream) RecvMsg(m any) error {
+	return errs.FromRpcError(s.ClientStream.RecvMsg(m))
+}
+
+// TraceUnaryInterceptor starts a client span and propagates it by the outgoing metadata
+func TraceUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := startCallSpan(ctx, method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	endCallSpan(span, err)
+	return err
+}
+
+// TraceStreamInterceptor starts a client span ended when the stream fails to open or its receiving ends
+func TraceStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, span := startCallSpan(ctx, method)
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		endCallSpan(span, err)
+		return nil, err
+	}
+	return &tracedClientStream{ClientStream: cs, span: span}, nil
+}
+
+type tracedClientStream struct {
+	grpc.ClientStream
+	span *trace.Span
+}
+
+func (s *tracedClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		endCallSpan(s.span, nil)
+	} else if err != nil {
+		endCallSpan(s.span, err)
+	}
+	return err
+}
+
+func startCallSpan(ctx context.Context, method string) (context.Context, *trace.Span) {
+	ctx, span := trace.Start(ctx, method, trace.SPAN_KIND_CLIENT)
+	span.SetAttr("rpc.system", "grpc")
+	span.SetAttr("rpc.method", method)
+	var kv []string
+	trace.Inject(ctx, func(k, v string) {
+		kv = append(kv, k, v)
+	})
+	logger.Inject(ctx, func(k, v string) {
+		kv = append(kv, k, v)
+	})
+	return metadata.AppendToOutgoingContext(ctx, kv...), span
+}
+
+func endCallSpan(span *trace.Span, err error) {
+	span.SetAttr("rpc.grpc.status_code", status.Code(err).String())
+	span.SetError(err)
+	span.End()
+}
+
+func MetricsUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	observeCall(method, start, err)
+	return err
+}
+
+// MetricsStreamInterceptor observes a stream when it fails to open or its receiving ends
+func MetricsStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		observeCall(method, start, err)
+		return nil, err
+	}
+	return &metricsClientStream{ClientStream: cs, method: method, start: start}, nil
+}
+
+type metricsClientStream struct {
+	grpc.ClientStream
+	method string
+	start  time.Time
+	once   sync.Once
+}
+
+func (s *metricsClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			if err == io.EOF {
+				observeCall(s.method, s.start, nil)
+			} else {
+				observeCall(s.method, s.start, err)
+			}
+		})
+	}
+	return err
+}
+
+func observeCall(method string, start time.Time, err error) {
+	rpcHandled.Inc(method, status.Code(err).String())
+	rpcLatency.Observe(time.Since(start).Seconds(), method)
+}
+
 type rpcResolverBuilder struct {
 	serviceWatcher chan bool
 	resolvers      []*rpcResolver
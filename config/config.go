@@ -36,6 +36,8 @@ func Init() {
 	if remoteEnable {
 		loadRemoteConfig()
 	}
+	// 4. 日志配置  log.yml只用于启动阶段，之后以配置中心的log配置为准，并随配置刷新
+	initLog()
 }
 
 func loadLocalConfig(confName string, merge bool) {
@@ -70,6 +72,11 @@ func loadRemoteConfig() {
 	loader.WatchRemoteConfigOnChannel()
 }
 
+// IsSet reports whether the key is configured, false before Init
+func IsSet(key string) bool {
+	return loader != nil && loader.IsSet(key)
+}
+
 func Scan(key string, conf interface{}) error {
 	return loader.UnmarshalKey(key, conf)
 }
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/billyyoyo/microj/logger"
+	"time"
+)
+
+// initLog configures the logger again by the config of log key, the bootstrap one of log.yml is kept if absent
+func initLog() {
+	if !loader.IsSet("log") {
+		return
+	}
+	c, applied, err := scanLog()
+	if err != nil {
+		logger.Error("log config load failed", err)
+		return
+	}
+	logger.Configure(c)
+	loader.SetDefault("log.refreshInterval", 10)
+	interval := loader.GetInt64("log.refreshInterval")
+	if interval <= 0 {
+		return
+	}
+	go watchLog(applied, time.Duration(interval)*time.Second)
+}
+
+// watchLog applies the log config once it is changed by the remote config, it is scanned into a new
+// struct each time instead of the one written by the refresh, so nothing is shared with the watcher of viper
+func watchLog(applied string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c, snapshot, err := scanLog()
+		if err != nil {
+			logger.Error("log config load failed", err)
+			continue
+		}
+		if snapshot == applied {
+			continue
+		}
+		logger.Info("log config changed")
+		logger.Configure(c)
+		applied = snapshot
+	}
+}
+
+// scanLog returns the log config and its json to tell the changes
+func scanLog() (*logger.LogConf, string, error) {
+	c := &logger.LogConf{}
+	if err := loader.UnmarshalKey("log", c); err != nil {
+		return nil, "", err
+	}
+	b, _ := json.Marshal(c)
+	return c, string(b), nil
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// Ping checks the datasource and the redis initialized, it is the health check of app
+func Ping(ctx context.Context) error {
+	if db != nil {
+		if err := pingDataSource(ctx); err != nil {
+			return errors.Wrap(err, "datasource")
+		}
+	}
+	if Redis() != nil {
+		if err := pingRedis(ctx); err != nil {
+			return errors.Wrap(err, "redis")
+		}
+	}
+	return nil
+}
+
+// Close closes the datasource and the redis initialized, it is called by app on shutdown
+func Close(ctx context.Context) error {
+	var err error
+	if e := closeDataSource(ctx); e != nil {
+		err = errors.Wrap(e, "datasource")
+	}
+	if e := closeRedis(ctx); e != nil && err == nil {
+		err = errors.Wrap(e, "redis")
+	}
+	return err
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/billyyoyo/microj/config"
 	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
 	"github.com/bwmarrin/snowflake"
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
@@ -16,6 +17,8 @@ import (
 	"time"
 )
 
+const logModule = "db"
+
 var (
 	dbConf      *DBConfig
 	orm         *gorm.DB
@@ -95,6 +98,7 @@ func InitDataSource(openFunc func(dsn string) gorm.Dialector, models []interface
 	if dbConf.Debug {
 		orm.Debug()
 	}
+	regTraceCallbacks(orm)
 	db, err = orm.DB()
 	if err != nil {
 		logger.Fatal(err.Error(), err)
@@ -115,7 +119,56 @@ func InitDataSource(openFunc func(dsn string) gorm.Dialector, models []interface
 	if dbConf.DDL && len(models) > 0 {
 		orm.AutoMigrate(models...)
 	}
+	regDataSourceMetrics()
+}
 
+// regDataSourceMetrics exports db.Stats() on every collection
+func regDataSourceMetrics() {
+	gauge := func(name, help string, fn func(st sql.DBStats) float64) {
+		metrics.NewGaugeFunc(metrics.NAMESPACE+"_db_pool_"+name, help, nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: fn(db.Stats())}}
+		})
+	}
+	counter := func(name, help string, fn func(st sql.DBStats) float64) {
+		metrics.NewCounterFunc(metrics.NAMESPACE+"_db_pool_"+name, help, nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: fn(db.Stats())}}
+		})
+	}
+	gauge("max_open", "Maximum number of open connections to the database.", func(st sql.DBStats) float64 {
+		return float64(st.MaxOpenConnections)
+	})
+	gauge("open", "Number of established connections both in use and idle.", func(st sql.DBStats) float64 {
+		return float64(st.OpenConnections)
+	})
+	gauge("in_use", "Number of connections currently in use.", func(st sql.DBStats) float64 {
+		return float64(st.InUse)
+	})
+	gauge("idle", "Number of idle connections.", func(st sql.DBStats) float64 {
+		return float64(st.Idle)
+	})
+	counter("wait_count_total", "Total number of connections waited for.", func(st sql.DBStats) float64 {
+		return float64(st.WaitCount)
+	})
+	counter("wait_duration_seconds_total", "Total time blocked waiting for a new connection.", func(st sql.DBStats) float64 {
+		return st.WaitDuration.Seconds()
+	})
+	counter("max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.", func(st sql.DBStats) float64 {
+		return float64(st.MaxIdleClosed)
+	})
+	counter("max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.", func(st sql.DBStats) float64 {
+		return float64(st.MaxLifetimeClosed)
+	})
+}
+
+func pingDataSource(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+func closeDataSource(ctx context.Context) error {
+	if db == nil {
+		return nil
+	}
+	return db.Close()
 }
 
 func initIdGenerater() {
@@ -130,6 +183,11 @@ func Orm() *sql.DB {
 	return db
 }
 
+// Gorm is the orm of the data source, use Gorm().WithContext(ctx) to join the trace of the request
+func Gorm() *gorm.DB {
+	return orm
+}
+
 func NextID() int64 {
 	return idGenerater.Generate().Int64()
 }
@@ -142,11 +200,11 @@ func (l *dLogger) LogMode(level ormlog.LogLevel) ormlog.Interface {
 }
 
 func (l *dLogger) Info(ctx context.Context, msg string, infos ...interface{}) {
-	logger.Info(msg, infos)
+	logger.FromContext(ctx).Module(logModule).Info(msg, infos)
 }
 
 func (l *dLogger) Warn(ctx context.Context, msg string, infos ...interface{}) {
-	logger.Warn(msg, infos)
+	logger.FromContext(ctx).Module(logModule).Warn(msg, infos)
 }
 
 func (l *dLogger) Error(ctx context.Context, msg string, infos ...interface{}) {
@@ -160,20 +218,21 @@ func (l *dLogger) Error(ctx context.Context, msg string, infos ...interface{}) {
 		}
 	}
 
-	logger.Error("", errors.New(msg), kv...)
+	logger.FromContext(ctx).Module(logModule).Error("", errors.New(msg), kv...)
 }
 
 func (l *dLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
 	elapsed := time.Since(begin)
+	log := logger.FromContext(ctx).Module(logModule)
 	switch {
 	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
 		sql, rows := fc()
-		logger.Errorf("Error sql (%s) has error, effected: %d", errors.Wrap(err, ""), sql, rows)
+		log.Errorf("Error sql (%s) has error, effected: %d", errors.Wrap(err, ""), sql, rows)
 	case elapsed.Milliseconds() > dbConf.SlowSqlThreshold && dbConf.SlowSqlThreshold > 0:
 		sql, rows := fc()
-		logger.Warnf("Slow sql (%s) spend %dms , effected: %d", sql, elapsed.Milliseconds(), rows)
+		log.Warnf("Slow sql (%s) spend %dms , effected: %d", sql, elapsed.Milliseconds(), rows)
 	case dbConf.Debug:
 		sql, rows := fc()
-		logger.Infof("Exec sql (%s) spend %d, effected: %d", sql, elapsed.Milliseconds(), rows)
+		log.Infof("Exec sql (%s) spend %d, effected: %d", sql, elapsed.Milliseconds(), rows)
 	}
 }
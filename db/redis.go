@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"github.com/billyyoyo/microj/config"
 	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"sync"
 	"time"
 )
 
@@ -14,6 +16,7 @@ var (
 	masterdb  *redis.Client
 	clusterdb *redis.ClusterClient
 	rConfig   *RConfig
+	redisOnce sync.Once
 )
 
 type RConfig struct {
@@ -33,7 +36,12 @@ type RPoolConfig struct {
 	IdleTimeout int64 `yaml:"idleTimeout"`
 }
 
+// InitRedis is called once, the later calls share the client, e.g. with the redis broker plugin
 func InitRedis() {
+	redisOnce.Do(initRedis)
+}
+
+func initRedis() {
 	err := config.Scan("redis", &rConfig)
 	if err != nil {
 		logger.Fatal("redis config load failed", errors.Wrap(err, ""))
@@ -99,10 +107,66 @@ func InitRedis() {
 		}
 		masterdb = redis.NewClient(opts)
 	}
+	regRedisMetrics()
+}
 
+// regRedisMetrics exports the pool stats of the redis client on every collection
+func regRedisMetrics() {
+	stats := func() *redis.PoolStats {
+		if clusterdb != nil {
+			return clusterdb.PoolStats()
+		}
+		return masterdb.PoolStats()
+	}
+	gauge := func(name, help string, fn func(st *redis.PoolStats) float64) {
+		metrics.NewGaugeFunc(metrics.NAMESPACE+"_redis_pool_"+name, help, nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: fn(stats())}}
+		})
+	}
+	counter := func(name, help string, fn func(st *redis.PoolStats) float64) {
+		metrics.NewCounterFunc(metrics.NAMESPACE+"_redis_pool_"+name, help, nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: fn(stats())}}
+		})
+	}
+	gauge("conns", "Number of total connections in the pool.", func(st *redis.PoolStats) float64 {
+		return float64(st.TotalConns)
+	})
+	gauge("idle_conns", "Number of idle connections in the pool.", func(st *redis.PoolStats) float64 {
+		return float64(st.IdleConns)
+	})
+	counter("hits_total", "Total number of times a free connection was found in the pool.", func(st *redis.PoolStats) float64 {
+		return float64(st.Hits)
+	})
+	counter("misses_total", "Total number of times a free connection was not found in the pool.", func(st *redis.PoolStats) float64 {
+		return float64(st.Misses)
+	})
+	counter("timeouts_total", "Total number of times a wait timeout occurred.", func(st *redis.PoolStats) float64 {
+		return float64(st.Timeouts)
+	})
+	counter("stale_conns_total", "Total number of stale connections removed from the pool.", func(st *redis.PoolStats) float64 {
+		return float64(st.StaleConns)
+	})
 }
 
+func pingRedis(ctx context.Context) error {
+	return Redis().Ping(ctx).Err()
+}
+
+func closeRedis(ctx context.Context) error {
+	if clusterdb != nil {
+		return clusterdb.Close()
+	}
+	if masterdb != nil {
+		return masterdb.Close()
+	}
+	return nil
+}
+
+// Redis is nil before InitRedis
 func Redis() redis.Cmdable {
+	if rConfig == nil {
+		return nil
+	}
 	if rConfig.Mode == "sentinel" {
 		return clusterdb
 	} else {
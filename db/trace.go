@@ -0,0 +1,61 @@
+package db
+
+import (
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/trace"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const spanInstanceKey = "microj:span"
+
+// regTraceCallbacks wraps every gorm operation in a client span of the trace in the statement context,
+// use orm.WithContext(ctx) to join the trace of the request
+func regTraceCallbacks(orm *gorm.DB) {
+	cb := orm.Callback()
+	errs := []error{
+		cb.Create().Before("gorm:create").Register("microj:trace_before_create", traceBefore("create")),
+		cb.Create().After("gorm:create").Register("microj:trace_after_create", traceAfter),
+		cb.Query().Before("gorm:query").Register("microj:trace_before_query", traceBefore("query")),
+		cb.Query().After("gorm:query").Register("microj:trace_after_query", traceAfter),
+		cb.Update().Before("gorm:update").Register("microj:trace_before_update", traceBefore("update")),
+		cb.Update().After("gorm:update").Register("microj:trace_after_update", traceAfter),
+		cb.Delete().Before("gorm:delete").Register("microj:trace_before_delete", traceBefore("delete")),
+		cb.Delete().After("gorm:delete").Register("microj:trace_after_delete", traceAfter),
+		cb.Row().Before("gorm:row").Register("microj:trace_before_row", traceBefore("row")),
+		cb.Row().After("gorm:row").Register("microj:trace_after_row", traceAfter),
+		cb.Raw().Before("gorm:raw").Register("microj:trace_before_raw", traceBefore("raw")),
+		cb.Raw().After("gorm:raw").Register("microj:trace_after_raw", traceAfter),
+	}
+	for _, err := range errs {
+		if err != nil {
+			logger.Error("gorm trace callback register error", err)
+		}
+	}
+}
+
+func traceBefore(op string) func(tx *gorm.DB) {
+	return func(tx *gorm.DB) {
+		ctx, span := trace.Start(tx.Statement.Context, "gorm."+op, trace.SPAN_KIND_CLIENT)
+		tx.Statement.Context = ctx
+		tx.InstanceSet(spanInstanceKey, span)
+	}
+}
+
+func traceAfter(tx *gorm.DB) {
+	v, ok := tx.InstanceGet(spanInstanceKey)
+	if !ok {
+		return
+	}
+	span := v.(*trace.Span)
+	if span.IsRecording() {
+		span.SetAttr("db.system", tx.Dialector.Name())
+		span.SetAttr("db.statement", tx.Statement.SQL.String())
+		span.SetAttr("db.sql.table", tx.Statement.Table)
+		span.SetAttr("db.rows_affected", tx.Statement.RowsAffected)
+	}
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		span.SetError(tx.Error)
+	}
+	span.End()
+}
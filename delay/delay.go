@@ -0,0 +1,68 @@
+package delay
+
+import (
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/db"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+)
+
+const (
+	STORE_REDIS = "redis"
+	STORE_DB    = "db"
+
+	logModule = "delay"
+)
+
+// Options of broker.delay besides the ones of the scheduler
+type Options struct {
+	// Store of the delayed messages, redis or db, the memory store of broker is kept if empty
+	Store string `yaml:"store"`
+	// Prefix of the redis keys, delay by default, the keys share a hash tag for the redis cluster
+	Prefix string `yaml:"prefix"`
+}
+
+// Init replaces the delay store of broker by the configured one, it is called after db.InitRedis or
+// db.InitDataSource. The db store requires &delay.DelayedMessage{} in the models of db.InitDataSource
+func Init() {
+	var opts Options
+	if config.IsSet("broker.delay") {
+		if err := config.Scan("broker.delay", &opts); err != nil {
+			logger.Error("delay config error", err)
+			return
+		}
+	}
+	s, err := newStore(opts)
+	if err != nil {
+		logger.Error("delay store error", err)
+		return
+	}
+	if s == nil {
+		return
+	}
+	broker.SetDelayStore(s)
+	logger.Module(logModule).Infof("delay store %s", opts.Store)
+}
+
+func newStore(opts Options) (broker.DelayStore, error) {
+	switch opts.Store {
+	case "":
+		return nil, nil
+	case STORE_REDIS:
+		client := db.Redis()
+		if client == nil {
+			return nil, errs.New(errs.ERRCODE_BROKER, "delay store redis not initialized")
+		}
+		return NewRedisStore(client, opts.Prefix), nil
+	case STORE_DB:
+		orm := db.Gorm()
+		if orm == nil {
+			return nil, errs.New(errs.ERRCODE_BROKER, "delay store db not initialized")
+		}
+		return NewGormStore(orm), nil
+	default:
+		return nil, errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("unknown delay store %s", opts.Store))
+	}
+}
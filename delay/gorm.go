@@ -0,0 +1,129 @@
+package delay
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// DelayedMessage is a row of the db store waiting for its due time
+type DelayedMessage struct {
+	ID    string `gorm:"primarykey;column:id;type:varchar(64)"`
+	Topic string `gorm:"column:topic;type:varchar(255);not null"`
+	Head  string `gorm:"column:head;type:text"`
+	Body  []byte `gorm:"column:body;type:mediumblob"`
+	// DueAt is put off by the lease, so a message not acked after sent is due again
+	DueAt time.Time `gorm:"column:due_at;not null;index"`
+	// LockedBy is the owner of the lease, the token acking the message
+	LockedBy  string    `gorm:"column:locked_by;type:varchar(64);not null;default:''"`
+	Attempts  int       `gorm:"column:attempts;type:int;not null;default:0"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+// GormStore leases the messages like the outbox relay, by a conditional update with a new owner.
+// The due times are kept on the clock of the database: Save stores the delay left until At added to
+// NOW(3), and Lease compares with NOW(3) rather than the now of the scheduler
+type GormStore struct {
+	orm *gorm.DB
+}
+
+func NewGormStore(orm *gorm.DB) *GormStore {
+	return &GormStore{orm: orm}
+}
+
+func (s *GormStore) Save(ctx context.Context, d broker.Delayed) error {
+	bs, err := json.Marshal(d.Message.Head)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, "delay head encode error", err)
+	}
+	// a reschedule releases the lease and restarts the attempts
+	err = s.orm.WithContext(ctx).Model(&DelayedMessage{}).Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"topic", "head", "body", "due_at", "locked_by", "attempts"}),
+	}).Create(map[string]any{
+		"id":         d.ID,
+		"topic":      d.Topic,
+		"head":       string(bs),
+		"body":       d.Message.Body,
+		"due_at":     gorm.Expr("NOW(3) + INTERVAL ? MICROSECOND", time.Until(d.At).Microseconds()),
+		"locked_by":  "",
+		"attempts":   0,
+		"created_at": gorm.Expr("NOW(3)"),
+	}).Error
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_DB, "delay save error", err)
+	}
+	return nil
+}
+
+func (s *GormStore) Lease(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]broker.Delayed, error) {
+	var ids []string
+	err := s.orm.WithContext(ctx).Model(&DelayedMessage{}).
+		Where("due_at <= NOW(3)").Order("due_at").Limit(limit).Pluck("id", &ids).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ERRCODE_DB, "delay poll error", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	owner := logger.NewRequestID()
+	err = s.orm.WithContext(ctx).Model(&DelayedMessage{}).
+		Where("id IN ? AND due_at <= NOW(3)", ids).
+		Updates(map[string]any{
+			"locked_by": owner,
+			"due_at":    gorm.Expr("NOW(3) + INTERVAL ? MICROSECOND", lease.Microseconds()),
+			"attempts":  gorm.Expr("attempts + 1"),
+		}).Error
+	if err != nil {
+		return nil, errs.Wrap(errs.ERRCODE_DB, "delay lease error", err)
+	}
+	var rows []DelayedMessage
+	if err = s.orm.WithContext(ctx).Where("locked_by = ?", owner).Find(&rows).Error; err != nil {
+		return nil, errs.Wrap(errs.ERRCODE_DB, "delay lease error", err)
+	}
+	ds := make([]broker.Delayed, 0, len(rows))
+	for _, m := range rows {
+		ds = append(ds, m.delayed())
+	}
+	return ds, nil
+}
+
+func (s *GormStore) Ack(ctx context.Context, id, token string) (bool, error) {
+	res := s.orm.WithContext(ctx).Where("id = ? AND locked_by = ?", id, token).Delete(&DelayedMessage{})
+	if res.Error != nil {
+		return false, errs.Wrap(errs.ERRCODE_DB, "delay ack error", res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (s *GormStore) Delete(ctx context.Context, id string) (bool, error) {
+	res := s.orm.WithContext(ctx).Where("id = ?", id).Delete(&DelayedMessage{})
+	if res.Error != nil {
+		return false, errs.Wrap(errs.ERRCODE_DB, "delay delete error", res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// delayed converts the row back, a head which fails to decode is logged and replaced by an empty one
+// so the message is still sent
+func (m *DelayedMessage) delayed() broker.Delayed {
+	d := broker.Delayed{
+		ID:       m.ID,
+		Topic:    m.Topic,
+		At:       m.DueAt,
+		Message:  broker.Message{Head: make(map[string]string), Body: m.Body},
+		Token:    m.LockedBy,
+		Attempts: m.Attempts,
+	}
+	if m.Head != "" {
+		if err := json.Unmarshal([]byte(m.Head), &d.Message.Head); err != nil {
+			logger.Error("delay head decode error", err, logger.Val{K: "id", V: m.ID})
+			d.Message.Head = make(map[string]string)
+		}
+	}
+	return d
+}
@@ -0,0 +1,94 @@
+package delay
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/billyyoyo/microj/broker"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newMockStore(t *testing.T) (*GormStore, sqlmock.Sqlmock) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	orm, err := gorm.Open(mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true}),
+		&gorm.Config{SkipDefaultTransaction: true, Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGormStore(orm), mock
+}
+
+func TestGormStoreLease(t *testing.T) {
+	s, mock := newMockStore(t)
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE due_at <= NOW(3) ORDER BY due_at LIMIT 10")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a"))
+	mock.ExpectExec(regexp.QuoteMeta("SET `attempts`=attempts + 1,`due_at`=NOW(3) + INTERVAL ? MICROSECOND,`locked_by`=? WHERE id IN (?) AND due_at <= NOW(3)")).
+		WithArgs(int64(30*time.Second/time.Microsecond), sqlmock.AnyArg(), "a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE locked_by = ?")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "head", "locked_by", "attempts"}).
+			AddRow("a", "order.timeout", `{"k":"v"}`, "owner", 2))
+	ds, err := s.Lease(context.Background(), time.Now(), 10, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Token != "owner" || ds[0].Attempts != 2 || ds[0].Message.Head["k"] != "v" {
+		t.Fatalf("leased %+v", ds)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGormStoreAck(t *testing.T) {
+	s, mock := newMockStore(t)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM")).WithArgs("a", "owner").WillReturnResult(sqlmock.NewResult(0, 1))
+	// rescheduled or leased again
+	mock.ExpectExec(regexp.QuoteMeta("WHERE id = ? AND locked_by = ?")).WithArgs("a", "owner").WillReturnResult(sqlmock.NewResult(0, 0))
+	if ok, err := s.Ack(context.Background(), "a", "owner"); !ok || err != nil {
+		t.Fatalf("ack %v, error %v", ok, err)
+	}
+	if ok, err := s.Ack(context.Background(), "a", "owner"); ok || err != nil {
+		t.Fatalf("ack of a lost lease %v, error %v", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGormStoreSave(t *testing.T) {
+	s, mock := newMockStore(t)
+	// due after the delay left on the clock of the database, a reschedule releases the lease and restarts the attempts
+	mock.ExpectExec(regexp.QuoteMeta("(`attempts`,`body`,`created_at`,`due_at`,`head`,`id`,`locked_by`,`topic`) VALUES (?,?,NOW(3),NOW(3) + INTERVAL ? MICROSECOND,?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE `topic`=VALUES(`topic`),`head`=VALUES(`head`),`body`=VALUES(`body`),`due_at`=VALUES(`due_at`),"+
+		"`locked_by`=VALUES(`locked_by`),`attempts`=VALUES(`attempts`)")).
+		WithArgs(0, sqlmock.AnyArg(), delayArg{time.Minute}, "null", "a", "", "order.timeout").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	if err := s.Save(context.Background(), broker.Delayed{ID: "a", Topic: "order.timeout", At: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// delayArg matches the microseconds left until a due time set d from now
+type delayArg struct {
+	d time.Duration
+}
+
+func (a delayArg) Match(v driver.Value) bool {
+	us, ok := v.(int64)
+	return ok && us <= a.d.Microseconds() && us > (a.d-time.Second).Microseconds()
+}
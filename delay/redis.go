@@ -0,0 +1,126 @@
+package delay
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+const defaultPrefix = "delay"
+
+// leaseScript puts off the score of the due ids by the lease and returns their messages with the attempts
+// counted, an id without the message is a leftover of a delete and removed
+var leaseScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local res = {}
+for _, id in ipairs(ids) do
+	local v = redis.call('HGET', KEYS[2], id)
+	if v then
+		redis.call('ZADD', KEYS[1], ARGV[3], id)
+		table.insert(res, v)
+		table.insert(res, redis.call('HINCRBY', KEYS[3], id, 1))
+	else
+		redis.call('ZREM', KEYS[1], id)
+		redis.call('HDEL', KEYS[3], id)
+	end
+end
+return res
+`)
+
+// ackScript deletes the message only if its score is still the leased one, a reschedule or a new lease
+// changes it
+var ackScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// RedisStore keeps the due time of the messages in a sorted set, the messages and their attempts in hashes,
+// the token of a lease is the score it put
+type RedisStore struct {
+	client   redis.Cmdable
+	queue    string
+	messages string
+	attempts string
+}
+
+func NewRedisStore(client redis.Cmdable, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	tag := "{" + prefix + "}"
+	return &RedisStore{client: client, queue: tag + ":queue", messages: tag + ":messages", attempts: tag + ":attempts"}
+}
+
+func (s *RedisStore) Save(ctx context.Context, d broker.Delayed) error {
+	bs, err := json.Marshal(d)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, "delay encode error", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, s.messages, d.ID, bs)
+		p.HDel(ctx, s.attempts, d.ID)
+		p.ZAdd(ctx, s.queue, &redis.Z{Score: float64(d.At.UnixMilli()), Member: d.ID})
+		return nil
+	})
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, "delay save error", err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Lease(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]broker.Delayed, error) {
+	until := now.Add(lease).UnixMilli()
+	vs, err := leaseScript.Run(ctx, s.client, []string{s.queue, s.messages, s.attempts},
+		now.UnixMilli(), limit, until).Slice()
+	if err != nil && err != redis.Nil {
+		return nil, errs.Wrap(errs.ERRCODE_BROKER, "delay lease error", err)
+	}
+	token := strconv.FormatInt(until, 10)
+	ds := make([]broker.Delayed, 0, len(vs)/2)
+	for i := 0; i+1 < len(vs); i += 2 {
+		v, _ := vs[i].(string)
+		var d broker.Delayed
+		if err := json.Unmarshal([]byte(v), &d); err != nil {
+			// never sent successfully, it stays for the inspection
+			logger.Error("delay decode error", err)
+			continue
+		}
+		attempts, _ := vs[i+1].(int64)
+		d.Token, d.Attempts = token, int(attempts)
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+func (s *RedisStore) Ack(ctx context.Context, id, token string) (bool, error) {
+	n, err := ackScript.Run(ctx, s.client, []string{s.queue, s.messages, s.attempts}, id, token).Int()
+	if err != nil {
+		return false, errs.Wrap(errs.ERRCODE_BROKER, "delay ack error", err)
+	}
+	return n == 1, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, id string) (bool, error) {
+	var removed *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		removed = p.ZRem(ctx, s.queue, id)
+		p.HDel(ctx, s.messages, id)
+		p.HDel(ctx, s.attempts, id)
+		return nil
+	})
+	if err != nil {
+		return false, errs.Wrap(errs.ERRCODE_BROKER, "delay delete error", err)
+	}
+	return removed.Val() > 0, nil
+}
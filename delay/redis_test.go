@@ -0,0 +1,94 @@
+package delay
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+func TestRedisStore(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	s := NewRedisStore(client, "")
+	ctx := context.Background()
+	now := time.Now()
+
+	for i, id := range []string{"c", "a", "b"} {
+		err := s.Save(ctx, broker.Delayed{ID: id, Topic: "order.timeout", At: now.Add(time.Duration(i-2) * time.Second),
+			Message: broker.Message{Head: map[string]string{"k": id}, Body: []byte(id)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds, err := s.Lease(ctx, now, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 2 || ds[0].ID != "c" || ds[1].ID != "a" || ds[0].Message.Head["k"] != "c" || string(ds[1].Message.Body) != "a" {
+		t.Fatalf("leased %+v", ds)
+	}
+	if ds, _ = s.Lease(ctx, now, 10, time.Minute); len(ds) != 1 || ds[0].ID != "b" {
+		t.Fatalf("leased again %+v", ds)
+	}
+	if ok, err := s.Delete(ctx, "c"); !ok || err != nil {
+		t.Fatalf("delete %v, error %v", ok, err)
+	}
+	if ok, _ := s.Delete(ctx, "c"); ok {
+		t.Fatal("deleted twice")
+	}
+	// the leases expired
+	if ds, _ = s.Lease(ctx, now.Add(2*time.Minute), 10, time.Minute); len(ds) != 2 {
+		t.Fatalf("expired leases %+v", ds)
+	}
+	// rescheduled by saving again
+	s.Save(ctx, broker.Delayed{ID: "a", Topic: "order.timeout", At: now.Add(time.Hour)})
+	if ds, _ = s.Lease(ctx, now.Add(10*time.Minute), 10, time.Minute); len(ds) != 1 || ds[0].ID != "b" {
+		t.Fatalf("leased after reschedule %+v", ds)
+	}
+}
+
+func TestRedisStoreAck(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	s := NewRedisStore(client, "")
+	ctx := context.Background()
+	now := time.Now()
+
+	s.Save(ctx, broker.Delayed{ID: "a", Topic: "order.timeout", At: now})
+	ds, err := s.Lease(ctx, now, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Token == "" || ds[0].Attempts != 1 {
+		t.Fatalf("leased %+v", ds)
+	}
+	// rescheduled while sending
+	s.Save(ctx, broker.Delayed{ID: "a", Topic: "order.timeout", At: now.Add(time.Second)})
+	if ok, err := s.Ack(ctx, "a", ds[0].Token); ok || err != nil {
+		t.Fatalf("rescheduled message acked %v, error %v", ok, err)
+	}
+	if ds, _ = s.Lease(ctx, now.Add(time.Second), 10, time.Minute); len(ds) != 1 || ds[0].Attempts != 1 {
+		t.Fatalf("rescheduled message leased %+v", ds)
+	}
+	again, _ := s.Lease(ctx, now.Add(2*time.Minute), 10, time.Minute)
+	if len(again) != 1 || again[0].Attempts != 2 {
+		t.Fatalf("leased again %+v", again)
+	}
+	if ok, _ := s.Ack(ctx, "a", ds[0].Token); ok {
+		t.Fatal("acked by an expired lease")
+	}
+	if ok, err := s.Ack(ctx, "a", again[0].Token); !ok || err != nil {
+		t.Fatalf("ack %v, error %v", ok, err)
+	}
+	if n, _ := srv.HKeys("{delay}:attempts"); len(n) != 0 {
+		t.Fatalf("attempts left %v", n)
+	}
+	if ok, _ := s.Delete(ctx, "a"); ok {
+		t.Fatal("acked message not deleted")
+	}
+}
@@ -2,8 +2,6 @@ package errs
 
 import (
 	"github.com/pkg/errors"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 const ERRMSG_UNKNOWN = "unknown error"
@@ -17,6 +15,9 @@ const (
 	ERRCODE_GATEWAY
 
 	ERRCODE_NO_TOKEN
+	ERRCODE_INVALID_PARAMS
+	ERRCODE_TIMEOUT
+	ERRCODE_DB
 )
 
 type stackTracer interface {
@@ -24,9 +25,10 @@ type stackTracer interface {
 }
 
 type MicroError struct {
-	code int
-	msg  string
-	err  error
+	code   int
+	msg    string
+	fields map[string]string
+	err    error
 }
 
 func (e MicroError) Error() string {
@@ -37,6 +39,28 @@ func (e MicroError) Code() int {
 	return e.code
 }
 
+// Fields returns the optional fields carried with the error, they travel across rpc calls
+func (e MicroError) Fields() map[string]string {
+	return e.fields
+}
+
+func (e MicroError) Unwrap() error {
+	return e.err
+}
+
+// As makes errors.As work with both MicroError and *MicroError targets
+func (e MicroError) As(target any) bool {
+	switch t := target.(type) {
+	case *MicroError:
+		*t = e
+		return true
+	case **MicroError:
+		*t = &e
+		return true
+	}
+	return false
+}
+
 func (e MicroError) StackTrace() errors.StackTrace {
 	if st, ok := e.err.(stackTracer); ok {
 		return st.StackTrace()
@@ -52,6 +76,16 @@ func New(code int, msg string) error {
 		err:  errors.New(msg),
 	}
 }
+
+func NewWithFields(code int, msg string, fields map[string]string) error {
+	return &MicroError{
+		code:   code,
+		msg:    msg,
+		fields: fields,
+		err:    errors.New(msg),
+	}
+}
+
 func NewInternal(msg string) error {
 	return New(ERRCODE_COMMON, msg)
 }
@@ -76,7 +110,11 @@ func Wrap(code int, msg string, err error) error {
 	}
 }
 
-func NewRpcError(code int, msg string) error {
-	err := status.New(codes.Code(code), msg).Err()
-	return err
+// FromError finds the MicroError in the chain of err
+func FromError(err error) (MicroError, bool) {
+	var me MicroError
+	if err == nil {
+		return me, false
+	}
+	return me, errors.As(err, &me)
 }
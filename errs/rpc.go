@@ -0,0 +1,88 @@
+package errs
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+)
+
+const RPC_ERROR_DOMAIN = "microj"
+
+var (
+	// RpcCodes maps business codes to grpc codes, codes not listed travel as codes.Unknown
+	RpcCodes = map[int]codes.Code{
+		ERRCODE_COMMON:         codes.Internal,
+		ERRCODE_REMOTE_CALL:    codes.Unavailable,
+		ERRCODE_REGISTRY:       codes.Unavailable,
+		ERRCODE_GATEWAY:        codes.Unavailable,
+		ERRCODE_NO_TOKEN:       codes.Unauthenticated,
+		ERRCODE_INVALID_PARAMS: codes.InvalidArgument,
+		ERRCODE_TIMEOUT:        codes.DeadlineExceeded,
+		ERRCODE_DB:             codes.Internal,
+	}
+)
+
+// NewRpcError creates a grpc status error carrying the business code in its details
+func NewRpcError(code int, msg string) error {
+	return ToRpcError(MicroError{code: code, msg: msg})
+}
+
+// ToRpcError converts a MicroError into a grpc status error, the business code, message
+// and fields are encoded into an ErrorInfo detail so FromRpcError can restore them.
+// grpc status errors and errors without MicroError are returned as is
+func ToRpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	me, ok := FromError(err)
+	if !ok {
+		return err
+	}
+	c, ok := RpcCodes[me.code]
+	if !ok {
+		c = codes.Unknown
+	}
+	st := status.New(c, me.msg)
+	sd, e := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   strconv.Itoa(me.code),
+		Domain:   RPC_ERROR_DOMAIN,
+		Metadata: me.fields,
+	})
+	if e != nil {
+		return st.Err()
+	}
+	return sd.Err()
+}
+
+// FromRpcError restores the MicroError encoded by ToRpcError, other errors are returned as is
+func FromRpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != RPC_ERROR_DOMAIN {
+			continue
+		}
+		code, e := strconv.Atoi(info.Reason)
+		if e != nil {
+			continue
+		}
+		return MicroError{
+			code:   code,
+			msg:    st.Message(),
+			fields: info.Metadata,
+			err:    errors.WithStack(err),
+		}
+	}
+	return err
+}
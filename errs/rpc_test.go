@@ -0,0 +1,33 @@
+package errs
+
+import (
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestRpcErrorRoundTrip(t *testing.T) {
+	err := ToRpcError(NewWithFields(510021, "can not say any thing", map[string]string{"word": "hello"}))
+	if status.Code(err) != codes.Unknown {
+		t.Fatalf("grpc code %s", status.Code(err))
+	}
+	var me MicroError
+	if !errors.As(FromRpcError(err), &me) {
+		t.Fatal("no MicroError decoded")
+	}
+	if me.Code() != 510021 || me.Error() != "can not say any thing" || me.Fields()["word"] != "hello" {
+		t.Errorf("decoded %d %s %v", me.Code(), me.Error(), me.Fields())
+	}
+	var pme *MicroError
+	if !errors.As(FromRpcError(NewRpcError(ERRCODE_NO_TOKEN, "no token")), &pme) || pme.Code() != ERRCODE_NO_TOKEN {
+		t.Error("no *MicroError decoded")
+	}
+	if status.Code(NewRpcError(ERRCODE_INVALID_PARAMS, "id required")) != codes.InvalidArgument {
+		t.Error("invalid params not mapped to InvalidArgument")
+	}
+	plain := status.Error(codes.NotFound, "not found")
+	if FromRpcError(plain) != plain {
+		t.Error("plain status changed")
+	}
+}
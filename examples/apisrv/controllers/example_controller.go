@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"github.com/billyyoyo/microj/errs"
 	"github.com/billyyoyo/microj/examples/apisrv/codes"
 	"github.com/billyyoyo/microj/logger"
@@ -18,24 +19,24 @@ func NewExampleController() *ExampleController {
 
 func (c *ExampleController) Apis() []api.Api {
 	return []api.Api{
-		{Method: "post", Path: "/login", Func: c.Login},
+		api.Typed("post", "/login", c.Login),
 		{Method: "get", Path: "/info", Func: c.GetInfo},
 		{Method: "post", Path: "/edit", Func: c.Edit},
 	}
 }
 
-func (c *ExampleController) Login(ctx *gin.Context) {
-	var user struct {
-		Name string `json:"username"`
-		Pwd  string `json:"password"`
-	}
-	err := ctx.ShouldBindJSON(&user)
-	if err != nil {
-		logger.Error("login params error", err)
-		c.RetFailed(ctx, codes.ERR_REQEUST_PARAMS, "login params bind error")
-		return
-	}
-	c.RetSuccess(ctx, gin.H{"msg": "ok"})
+type LoginReq struct {
+	Name string `json:"username" binding:"required"`
+	Pwd  string `json:"password" binding:"required"`
+}
+
+type LoginResp struct {
+	Msg string `json:"msg"`
+}
+
+func (c *ExampleController) Login(ctx context.Context, req *LoginReq) (*LoginResp, error) {
+	logger.Info("login: ", req.Name)
+	return &LoginResp{Msg: "ok"}, nil
 }
 
 func (c *ExampleController) GetInfo(ctx *gin.Context) {
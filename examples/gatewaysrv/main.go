@@ -50,6 +50,7 @@ func main() {
 			AddInterceptor(1, MatchHandler).
 			AddInterceptor(3, AuthHandler).
 			AddInterceptor(4, PermissionHandler).
+			WithRoutes(func() []gateway.Route { return conf.Routes }).
 			AddRpcEndpoint(proto.NewExampleGw()).
 			AddRpcEndpoint(proto.NewTestGw()).
 			AddRpcEndpoint(proto.NewHelloGw())).
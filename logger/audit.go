@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"io"
+	"sync/atomic"
+)
+
+const FIELD_ACTION = "action"
+
+var (
+	auditOut = &switchWriter{}
+	auditOn  atomic.Bool
+	_audit   = zerolog.New(auditOut).With().Timestamp().Str("log", "audit").Logger()
+)
+
+// AuditConf is the audit stream, kept apart from the logs with its own sinks and retention,
+// it is never sampled nor filtered by the levels
+type AuditConf struct {
+	Enable bool       `yaml:"enable"`
+	Sinks  []SinkConf `yaml:"sinks"`
+}
+
+func init() {
+	auditOut.set(io.Discard)
+}
+
+// Audit writes an audit event of the action with the request id, user id and service of ctx
+func Audit(ctx context.Context, action string, vals ...Val) {
+	if !auditOn.Load() {
+		return
+	}
+	ev := _audit.Log().Str(FIELD_ACTION, action)
+	if ctx != nil {
+		if r, ok := ctx.Value(requestKey{}).(*request); ok {
+			ev = ev.Str(FIELD_REQUEST_ID, r.id)
+			if r.userID != "" {
+				ev = ev.Str(FIELD_USER_ID, r.userID)
+			}
+		}
+	}
+	if service != "" {
+		ev = ev.Str(FIELD_SERVICE, service)
+	}
+	for _, v := range vals {
+		ev = ev.Any(v.K, v.V)
+	}
+	ev.Send()
+}
@@ -0,0 +1,209 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HEADER_REQUEST_ID = "X-Request-Id"
+	// HEADER_USER_ID is set by the auth filter of the entrance, like a gateway interceptor,
+	// the gateway drops the one sent by the client
+	HEADER_USER_ID = "X-User-Id"
+
+	FIELD_REQUEST_ID = "requestId"
+	FIELD_TRACE_ID   = "traceId"
+	FIELD_USER_ID    = "userId"
+	FIELD_SERVICE    = "service"
+)
+
+var (
+	service string
+)
+
+type loggerKey struct{}
+
+type requestKey struct{}
+
+type request struct {
+	id     string
+	userID string
+}
+
+// Logger is a child logger carrying fields, built by With, Module or FromContext
+type Logger struct {
+	l      zerolog.Logger
+	module string
+}
+
+// SetService sets the service name carried by the loggers of FromContext
+func SetService(name string) {
+	service = name
+}
+
+// With returns a child logger of the global one with the fields
+func With(vals ...Val) *Logger {
+	return &Logger{l: withVals(_log.With(), vals).Logger()}
+}
+
+// NewContext returns ctx carrying the logger, it is returned by FromContext
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or a child logger of the global one with the service name
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	if service == "" {
+		return &Logger{l: _log}
+	}
+	return With(Val{K: FIELD_SERVICE, V: service})
+}
+
+// ContextWith adds the fields to the logger carried by ctx, like the user id known after auth
+func ContextWith(ctx context.Context, vals ...Val) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(vals...))
+}
+
+// Extract reads the request id and user id by get into ctx, a request id is generated if absent.
+// The logger carried by the returned ctx has the request id, trace id, user id and service name
+func Extract(ctx context.Context, get func(k string) string, traceID string) context.Context {
+	r := &request{
+		id:     get(HEADER_REQUEST_ID),
+		userID: get(HEADER_USER_ID),
+	}
+	if r.id == "" {
+		r.id = NewRequestID()
+	}
+	ctx = context.WithValue(ctx, requestKey{}, r)
+	vals := []Val{{K: FIELD_REQUEST_ID, V: r.id}}
+	if traceID != "" {
+		vals = append(vals, Val{K: FIELD_TRACE_ID, V: traceID})
+	}
+	if r.userID != "" {
+		vals = append(vals, Val{K: FIELD_USER_ID, V: r.userID})
+	}
+	if service != "" {
+		vals = append(vals, Val{K: FIELD_SERVICE, V: service})
+	}
+	return NewContext(ctx, With(vals...))
+}
+
+// Inject writes the request id and user id of ctx by set, for the calls to other services
+func Inject(ctx context.Context, set func(k, v string)) {
+	r, ok := ctx.Value(requestKey{}).(*request)
+	if !ok {
+		return
+	}
+	set(HEADER_REQUEST_ID, r.id)
+	if r.userID != "" {
+		set(HEADER_USER_ID, r.userID)
+	}
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	if r, ok := ctx.Value(requestKey{}).(*request); ok {
+		return r.id
+	}
+	return ""
+}
+
+func UserIDFromContext(ctx context.Context) string {
+	if r, ok := ctx.Value(requestKey{}).(*request); ok {
+		return r.userID
+	}
+	return ""
+}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (l *Logger) With(vals ...Val) *Logger {
+	return &Logger{l: withVals(l.l.With(), vals).Logger(), module: l.module}
+}
+
+// Module returns a copy of the logger whose level is the one of the module
+func (l *Logger) Module(name string) *Logger {
+	return &Logger{l: l.l, module: name}
+}
+
+func (l *Logger) Debug(msg ...any) {
+	if !enabled(l.module, zerolog.DebugLevel) {
+		return
+	}
+	l.l.Debug().Msg(fmt.Sprint(msg...))
+}
+
+func (l *Logger) Info(msg ...any) {
+	if !enabled(l.module, zerolog.InfoLevel) {
+		return
+	}
+	l.l.Info().Msg(fmt.Sprint(msg...))
+}
+
+func (l *Logger) Infof(format string, msg ...any) {
+	if !enabled(l.module, zerolog.InfoLevel) {
+		return
+	}
+	l.l.Info().Msgf(format, msg...)
+}
+
+func (l *Logger) Warn(msg ...any) {
+	if !enabled(l.module, zerolog.WarnLevel) {
+		return
+	}
+	l.l.Warn().Msg(fmt.Sprint(msg...))
+}
+
+func (l *Logger) Warnf(format string, msg ...any) {
+	if !enabled(l.module, zerolog.WarnLevel) {
+		return
+	}
+	l.l.Warn().Msgf(format, msg...)
+}
+
+func (l *Logger) Error(msg string, err error, vals ...Val) {
+	if !enabled(l.module, zerolog.ErrorLevel) {
+		return
+	}
+	ev := l.l.Error().Stack()
+	if err != nil {
+		ev = ev.Err(err)
+	}
+	for _, v := range vals {
+		ev = ev.Any(v.K, v.V)
+	}
+	ev.Msg(msg)
+}
+
+func (l *Logger) Errorf(format string, err error, vars ...any) {
+	if !enabled(l.module, zerolog.ErrorLevel) {
+		return
+	}
+	ev := l.l.Error().Stack()
+	if err != nil {
+		ev = ev.Err(err)
+	}
+	ev.Msg(fmt.Sprintf(format, vars...))
+}
+
+func withVals(c zerolog.Context, vals []Val) zerolog.Context {
+	for _, v := range vals {
+		if str, ok := v.V.(string); ok {
+			c = c.Str(v.K, str)
+		} else {
+			c = c.Interface(v.K, v.V)
+		}
+	}
+	return c
+}
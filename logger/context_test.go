@@ -0,0 +1,43 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestFromContext(t *testing.T) {
+	var buf bytes.Buffer
+	old, lvl := _log, zerolog.GlobalLevel()
+	_log = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	SetService("test-srv")
+	defer func() {
+		_log = old
+		zerolog.SetGlobalLevel(lvl)
+		SetService("")
+	}()
+
+	headers := map[string]string{HEADER_USER_ID: "u1"}
+	ctx := Extract(context.Background(), func(k string) string { return headers[k] }, "trace1")
+	rid := RequestIDFromContext(ctx)
+	if len(rid) != 32 || UserIDFromContext(ctx) != "u1" {
+		t.Fatalf("request id %q user id %q", rid, UserIDFromContext(ctx))
+	}
+	FromContext(ContextWith(ctx, Val{K: "k", V: 1})).Info("hello")
+	out := buf.String()
+	for _, f := range []string{`"requestId":"` + rid + `"`, `"traceId":"trace1"`, `"userId":"u1"`, `"service":"test-srv"`, `"k":1`} {
+		if !strings.Contains(out, f) {
+			t.Errorf("missing %s in %s", f, out)
+		}
+	}
+
+	out2 := make(map[string]string)
+	Inject(ctx, func(k, v string) { out2[k] = v })
+	if out2[HEADER_REQUEST_ID] != rid || out2[HEADER_USER_ID] != "u1" {
+		t.Fatalf("injected %v", out2)
+	}
+}
@@ -0,0 +1,170 @@
+package logger
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	curLevels = func() *atomic.Pointer[levels] {
+		p := &atomic.Pointer[levels]{}
+		p.Store(&levels{root: zerolog.DebugLevel})
+		return p
+	}()
+	levelsMu sync.Mutex
+)
+
+type levels struct {
+	root      zerolog.Level
+	modules   map[string]zerolog.Level
+	overrides map[string]override
+}
+
+type override struct {
+	level zerolog.Level
+	until time.Time
+}
+
+type LevelInfo struct {
+	Root      string                  `json:"root"`
+	Modules   map[string]string       `json:"modules,omitempty"`
+	Overrides map[string]OverrideInfo `json:"overrides,omitempty"`
+}
+
+type OverrideInfo struct {
+	Level    string    `json:"level"`
+	ExpireAt time.Time `json:"expireAt"`
+}
+
+// Module returns a logger whose level is the one of the module, see LogConf.Modules
+func Module(name string) *Logger {
+	return &Logger{l: _log, module: name}
+}
+
+// SetLevel raises or lowers the level of a module for ttl, the empty module is the root one.
+// The config level is restored once expired or by ResetLevel
+func SetLevel(module, level string, ttl time.Duration) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl %s", ttl)
+	}
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	next := curLevels.Load().clone()
+	next.overrides[strings.ToLower(module)] = override{level: lvl, until: time.Now().Add(ttl)}
+	curLevels.Store(next)
+	return nil
+}
+
+// ResetLevel drops the override of SetLevel
+func ResetLevel(module string) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	next := curLevels.Load().clone()
+	delete(next.overrides, strings.ToLower(module))
+	curLevels.Store(next)
+}
+
+// Levels returns the config levels and the unexpired overrides
+func Levels() LevelInfo {
+	cur := curLevels.Load()
+	info := LevelInfo{
+		Root:      cur.root.String(),
+		Modules:   make(map[string]string, len(cur.modules)),
+		Overrides: make(map[string]OverrideInfo),
+	}
+	for m, l := range cur.modules {
+		info.Modules[m] = l.String()
+	}
+	now := time.Now()
+	for m, o := range cur.overrides {
+		if o.until.After(now) {
+			info.Overrides[m] = OverrideInfo{Level: o.level.String(), ExpireAt: o.until}
+		}
+	}
+	return info
+}
+
+// setLevels replaces the config levels, overrides are kept
+func setLevels(root string, modules map[string]string) error {
+	var errs []string
+	rl, err := parseLevel(root)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	ml := make(map[string]zerolog.Level, len(modules))
+	for m, l := range modules {
+		lvl, err := parseLevel(l)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("module %s: %s", m, err.Error()))
+			continue
+		}
+		ml[strings.ToLower(m)] = lvl
+	}
+	levelsMu.Lock()
+	next := curLevels.Load().clone()
+	next.root = rl
+	next.modules = ml
+	curLevels.Store(next)
+	levelsMu.Unlock()
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// enabled checks the override, then the module level, then the root level
+func enabled(module string, lvl zerolog.Level) bool {
+	cur := curLevels.Load()
+	if len(cur.overrides) > 0 {
+		if o, ok := cur.overrides[module]; ok && o.until.After(time.Now()) {
+			return lvl >= o.level
+		}
+	}
+	if module != "" {
+		if l, ok := cur.modules[module]; ok {
+			return lvl >= l
+		}
+		if len(cur.overrides) > 0 {
+			if o, ok := cur.overrides[""]; ok && o.until.After(time.Now()) {
+				return lvl >= o.level
+			}
+		}
+	}
+	return lvl >= cur.root
+}
+
+// parseLevel takes the empty level as debug
+func parseLevel(level string) (zerolog.Level, error) {
+	if level == "" {
+		return zerolog.DebugLevel, nil
+	}
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil {
+		return zerolog.DebugLevel, err
+	}
+	return lvl, nil
+}
+
+// clone drops the expired overrides
+func (l *levels) clone() *levels {
+	next := &levels{
+		root:      l.root,
+		modules:   l.modules,
+		overrides: make(map[string]override, len(l.overrides)),
+	}
+	now := time.Now()
+	for m, o := range l.overrides {
+		if o.until.After(now) {
+			next.overrides[m] = o
+		}
+	}
+	return next
+}
@@ -0,0 +1,37 @@
+package logger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+	old := curLevels.Load()
+	defer curLevels.Store(old)
+	if err := setLevels("info", map[string]string{"DB": "debug", "gateway": "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	if !enabled("db", 0) || enabled("gateway", 1) || enabled("", 0) || !enabled("rpc", 1) {
+		t.Fatalf("config levels not applied: %+v", Levels())
+	}
+	if err := SetLevel("gateway", "debug", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevel("", "error", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !enabled("gateway", 0) || enabled("rpc", 1) || !enabled("db", 0) {
+		t.Fatalf("overrides not applied: %+v", Levels())
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !enabled("rpc", 1) || len(Levels().Overrides) != 1 {
+		t.Fatalf("expired override applied: %+v", Levels())
+	}
+	ResetLevel("gateway")
+	if enabled("gateway", 1) {
+		t.Fatalf("reset override applied: %+v", Levels())
+	}
+	if err := SetLevel("db", "verbose", time.Hour); err == nil {
+		t.Fatal("invalid level accepted")
+	}
+}
@@ -9,17 +9,28 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type LogConf struct {
-	Level    string            `yaml:"level"`
+	Level string `yaml:"level"`
+	// Modules are levels of modules like db: debug, gateway: warn, overriding Level
+	Modules  map[string]string `yaml:"modules"`
 	ErrStack bool              `yaml:"errStack"`
 	Debug    bool              `yaml:"debug"`
 	Caller   bool              `yaml:"caller"`
 	File     lumberjack.Logger `yaml:"file"`
+	// Format of the file without Sinks, console or json
+	Format string `yaml:"format"`
+	// Sinks replace the output by Debug and File, every line goes to all sinks
+	Sinks    []SinkConf   `yaml:"sinks"`
+	Sampling SamplingConf `yaml:"sampling"`
+	Audit    AuditConf    `yaml:"audit"`
 }
 
 const (
@@ -36,8 +47,14 @@ const (
 )
 
 var (
-	_conf LogConf
-	_log  zerolog.Logger
+	_output string
+	_log    zerolog.Logger
+	_sinks  *dispatcher
+	_audits *dispatcher
+	out     = &switchWriter{}
+	caller  atomic.Bool
+	stack   atomic.Bool
+	confMu  sync.Mutex
 )
 
 type Val struct {
@@ -46,6 +63,18 @@ type Val struct {
 }
 
 func init() {
+	out.set(stderrWriter())
+	_log = zerolog.New(out).With().Timestamp().Stack().Logger().Hook(callerHook{})
+	// levels are checked by the loggers of this package per module
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	// the zerolog globals are set once here, Configure only flips the flag read by them
+	zerolog.ErrorStackMarshaler = func(err error) interface{} {
+		if !stack.Load() {
+			return nil
+		}
+		return marshalStack(err)
+	}
+	// bootstrap by log.yml for the logs before config.Init, which configures again by the config package
 	var err error
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(util.RunningSpace() + "conf")
@@ -56,63 +85,177 @@ func init() {
 		log.Err(err).Msg("log config file load failed")
 		return
 	}
-	err = viper.UnmarshalKey("log", &_conf)
+	var conf LogConf
+	err = viper.UnmarshalKey("log", &conf)
 	if err != nil {
 		log.Err(err).Msg("log config parse failed")
 		return
 	}
-	// config logger
-	lvl, err := zerolog.ParseLevel(_conf.Level)
-	if err == nil {
-		zerolog.SetGlobalLevel(lvl)
-	}
-	if _conf.ErrStack {
-		//zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
-		zerolog.ErrorStackMarshaler = marshalStack
-	}
-	ctx := zerolog.New(os.Stderr).With().Timestamp().Stack()
-	if _conf.Caller {
-		ctx = ctx.Caller()
-	}
-	_log = ctx.Logger()
-	writer := zerolog.ConsoleWriter{
-		TimeFormat: time.DateTime + ".000",
-	}
-	if !_conf.Debug {
-		//_log = _log.Output(&_conf.File)
-		writer.FormatLevel = formatLevelFile()
-		writer.NoColor = true
-		writer.Out = &_conf.File
-		_log = _log.Output(writer)
+	Configure(&conf)
+}
+
+// Configure applies the config, levels change at once and the sinks are only rebuilt when their config changed
+func Configure(conf *LogConf) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	if err := setLevels(conf.Level, conf.Modules); err != nil {
+		_log.Error().Err(err).Msg("log level config invalid")
+	}
+	caller.Store(conf.Caller)
+	stack.Store(conf.ErrStack)
+	output, _ := json.Marshal([]any{conf.Debug, conf.Format, fileConf(&conf.File), conf.Sinks, conf.Sampling, conf.Audit})
+	if string(output) == _output {
+		return
+	}
+	sinks := conf.Sinks
+	if len(sinks) == 0 {
+		if conf.Debug || conf.File.Filename == "" {
+			sinks = []SinkConf{{Type: SINK_STDERR, Format: conf.Format}}
+		} else {
+			format := conf.Format
+			if format == "" {
+				format = FORMAT_CONSOLE
+			}
+			sinks = []SinkConf{{Type: SINK_FILE, Format: format, File: fileConf(&conf.File)}}
+		}
+	}
+	d, err := newDispatcher(sinks, conf.Debug, conf.Sampling)
+	if err != nil {
+		_log.Error().Err(err).Msg("log sinks config invalid")
+		return
+	}
+	var audits *dispatcher
+	if conf.Audit.Enable {
+		if audits, err = newDispatcher(conf.Audit.Sinks, false, SamplingConf{}); err != nil {
+			d.Close()
+			_log.Error().Err(err).Msg("audit log sinks config invalid")
+			return
+		}
+	}
+	out.set(d)
+	if _sinks != nil {
+		_sinks.Close()
+	}
+	_sinks = d
+	auditOn.Store(audits != nil)
+	if audits != nil {
+		auditOut.set(audits)
 	} else {
-		zerolog.InterfaceMarshalFunc = stackMarshal
-		writer.FormatLevel = formatLevelConsole()
-		writer.Out = os.Stderr
-		_log = _log.Output(writer)
+		auditOut.set(io.Discard)
+	}
+	if _audits != nil {
+		_audits.Close()
+	}
+	_audits = audits
+	_output = string(output)
+}
+
+// Close flushes and closes the sinks, the logs are written to stderr after it
+func Close() error {
+	confMu.Lock()
+	defer confMu.Unlock()
+	out.set(stderrWriter())
+	auditOn.Store(false)
+	auditOut.set(io.Discard)
+	var err error
+	if _sinks != nil {
+		err = _sinks.Close()
+		_sinks = nil
+	}
+	if _audits != nil {
+		if e := _audits.Close(); e != nil && err == nil {
+			err = e
+		}
+		_audits = nil
+	}
+	_output = ""
+	return err
+}
+
+func stderrWriter() io.Writer {
+	return zerolog.ConsoleWriter{
+		Out:         os.Stderr,
+		TimeFormat:  time.DateTime + ".000",
+		FormatLevel: formatLevelConsole(),
+	}
+}
+
+// switchWriter lets the output be replaced while loggers are in use, set waits for the writes
+// to the old output, so it can be closed once set returns
+type switchWriter struct {
+	mu sync.RWMutex
+	w  io.Writer
+}
+
+func (s *switchWriter) set(w io.Writer) {
+	s.mu.Lock()
+	s.w = w
+	s.mu.Unlock()
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.w.Write(p)
+}
+
+func (s *switchWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if lw, ok := s.w.(zerolog.LevelWriter); ok {
+		return lw.WriteLevel(level, p)
+	}
+	return s.w.Write(p)
+}
+
+// callerHook adds the caller when log.caller is on
+type callerHook struct{}
+
+func (callerHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if caller.Load() {
+		e.Caller(4)
 	}
 }
 
 func Debug(msg ...any) {
+	if !enabled("", zerolog.DebugLevel) {
+		return
+	}
 	_log.Debug().Msg(fmt.Sprint(msg...))
 }
 
 func Info(msg ...any) {
+	if !enabled("", zerolog.InfoLevel) {
+		return
+	}
 	_log.Info().Msg(fmt.Sprint(msg...))
 }
 
 func Infof(format string, msg ...any) {
+	if !enabled("", zerolog.InfoLevel) {
+		return
+	}
 	_log.Info().Msgf(format, msg...)
 }
 
 func Warn(msg ...any) {
+	if !enabled("", zerolog.WarnLevel) {
+		return
+	}
 	_log.Warn().Msg(fmt.Sprint(msg...))
 }
 
 func Warnf(format string, msg ...any) {
+	if !enabled("", zerolog.WarnLevel) {
+		return
+	}
 	_log.Warn().Msgf(format, msg...)
 }
 
 func Err(err error) {
+	if !enabled("", zerolog.ErrorLevel) {
+		return
+	}
 	ev := _log.Error().Stack()
 	if err != nil {
 		ev = ev.Err(err)
@@ -121,6 +264,9 @@ func Err(err error) {
 }
 
 func Error(msg string, err error, vals ...Val) {
+	if !enabled("", zerolog.ErrorLevel) {
+		return
+	}
 	ev := _log.Error().Stack()
 	if err != nil {
 		ev = ev.Err(err)
@@ -134,6 +280,9 @@ func Error(msg string, err error, vals ...Val) {
 }
 
 func Errorf(format string, err error, vars ...any) {
+	if !enabled("", zerolog.ErrorLevel) {
+		return
+	}
 	ev := _log.Error().Stack()
 	if err != nil {
 		ev = ev.Err(err)
@@ -231,10 +380,6 @@ func colorize(s interface{}, c int) string {
 	return fmt.Sprintf("\x1b[%dm%v\x1b[0m", c, s)
 }
 
-func stackMarshal(v any) ([]byte, error) {
-	return json.Marshal(v)
-}
-
 type state struct {
 	b []byte
 }
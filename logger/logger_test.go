@@ -1,9 +1,14 @@
 package logger
 
 import (
+	"bytes"
 	"errors"
 	"github.com/billyyoyo/microj/errs"
+	"github.com/rs/zerolog"
+	"io"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLogger(t *testing.T) {
@@ -11,7 +16,6 @@ func TestLogger(t *testing.T) {
 	Info("hello world")
 	Warn("hello world")
 	Error("fuck", test1(), Val{"", ""})
-	Fatal("broken", test1())
 }
 
 func TestError(t *testing.T) {
@@ -29,3 +33,52 @@ func test2() error {
 func test3() error {
 	return errors.New("db can not access")
 }
+
+func TestErrStack(t *testing.T) {
+	old := stack.Load()
+	defer stack.Store(old)
+	for _, on := range []bool{true, false} {
+		stack.Store(on)
+		var buf bytes.Buffer
+		l := zerolog.New(&buf).With().Stack().Logger()
+		l.Error().Err(test1()).Msg("bad db")
+		if got := strings.Contains(buf.String(), `"stack":`); got != on {
+			t.Errorf("errStack %v, stack logged %v: %s", on, got, buf.String())
+		}
+	}
+}
+
+type slowWriter struct {
+	started chan bool
+	release chan bool
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	close(w.started)
+	<-w.release
+	return len(p), nil
+}
+
+func TestSwitchWriterWaitsWrites(t *testing.T) {
+	var sw switchWriter
+	old := slowWriter{started: make(chan bool), release: make(chan bool)}
+	sw.set(old)
+	go sw.Write([]byte("in flight"))
+	<-old.started
+	switched := make(chan bool)
+	go func() {
+		sw.set(io.Discard)
+		close(switched)
+	}()
+	select {
+	case <-switched:
+		t.Fatal("switched while a write to the old output is in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(old.release)
+	select {
+	case <-switched:
+	case <-time.After(time.Second):
+		t.Fatal("switch not done after the write")
+	}
+}
@@ -0,0 +1,250 @@
+package logger
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SINK_STDERR = "stderr"
+	SINK_STDOUT = "stdout"
+	SINK_FILE   = "file"
+	SINK_SYSLOG = "syslog"
+	SINK_HTTP   = "http"
+
+	FORMAT_CONSOLE = "console"
+	FORMAT_JSON    = "json"
+)
+
+var (
+	sinks = map[string]func(conf SinkConf) (Sink, error){
+		SINK_STDERR: func(conf SinkConf) (Sink, error) {
+			return nopCloser{os.Stderr}, nil
+		},
+		SINK_STDOUT: func(conf SinkConf) (Sink, error) {
+			return nopCloser{os.Stdout}, nil
+		},
+		SINK_FILE: func(conf SinkConf) (Sink, error) {
+			if conf.File.Filename == "" {
+				return nil, fmt.Errorf("no filename of file sink")
+			}
+			return conf.File.logger(), nil
+		},
+		SINK_HTTP: newHttpSink,
+	}
+	sinksMu sync.Mutex
+)
+
+// Sink receives the json lines of logs, a sink must copy the line if it is kept after Write returns
+type Sink interface {
+	io.Writer
+	io.Closer
+}
+
+// LevelSink is a sink knowing the level of the line, like syslog mapping the level to its severity
+type LevelSink interface {
+	Sink
+	WriteLevel(level zerolog.Level, p []byte) (int, error)
+}
+
+type SinkConf struct {
+	Type string `yaml:"type"`
+	// Format is console or json, json by default except the stderr and stdout sinks
+	Format string `yaml:"format"`
+	// Level is the lowest level written to the sink, all levels by default
+	Level string   `yaml:"level"`
+	File  FileConf `yaml:"file"`
+	// Network and Addr of the syslog sink, like udp and localhost:514, the local syslog if empty
+	Network string `yaml:"network"`
+	Addr    string `yaml:"addr"`
+	Tag     string `yaml:"tag"`
+	// Url of the http sink which posts the lines batched in ndjson
+	Url           string            `yaml:"url"`
+	Headers       map[string]string `yaml:"headers"`
+	BatchSize     int               `yaml:"batchSize"`
+	BufferSize    int               `yaml:"bufferSize"`
+	FlushInterval int64             `yaml:"flushInterval"` // second
+	// Block the logging when the buffer is full, lines are dropped if false
+	Block bool `yaml:"block"`
+}
+
+// FileConf is the rotation config of the file sinks, same as lumberjack
+type FileConf struct {
+	Filename   string `yaml:"filename"`
+	MaxSize    int    `yaml:"maxsize"`
+	MaxAge     int    `yaml:"maxage"`
+	MaxBackups int    `yaml:"maxbackups"`
+	LocalTime  bool   `yaml:"localtime"`
+	Compress   bool   `yaml:"compress"`
+}
+
+// SamplingConf keeps Burst info and lower logs every Period seconds, then one in every Thereafter
+type SamplingConf struct {
+	Enable     bool   `yaml:"enable"`
+	Burst      uint32 `yaml:"burst"`
+	Period     int64  `yaml:"period"` // second
+	Thereafter uint32 `yaml:"thereafter"`
+}
+
+// RegSink adds a sink type used by log.sinks
+func RegSink(name string, fn func(conf SinkConf) (Sink, error)) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks[name] = fn
+}
+
+func (f FileConf) logger() *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   f.Filename,
+		MaxSize:    f.MaxSize,
+		MaxAge:     f.MaxAge,
+		MaxBackups: f.MaxBackups,
+		LocalTime:  f.LocalTime,
+		Compress:   f.Compress,
+	}
+}
+
+func fileConf(l *lumberjack.Logger) FileConf {
+	return FileConf{
+		Filename:   l.Filename,
+		MaxSize:    l.MaxSize,
+		MaxAge:     l.MaxAge,
+		MaxBackups: l.MaxBackups,
+		LocalTime:  l.LocalTime,
+		Compress:   l.Compress,
+	}
+}
+
+func (s SamplingConf) sampler() zerolog.Sampler {
+	if !s.Enable || (s.Burst == 0 && s.Thereafter <= 1) {
+		return nil
+	}
+	var next zerolog.Sampler
+	if s.Thereafter > 0 {
+		next = &zerolog.BasicSampler{N: s.Thereafter}
+	}
+	if s.Burst == 0 {
+		return next
+	}
+	period := time.Duration(s.Period) * time.Second
+	if period <= 0 {
+		period = time.Second
+	}
+	// all beyond the burst are dropped without Thereafter
+	return &zerolog.BurstSampler{Burst: s.Burst, Period: period, NextSampler: next}
+}
+
+type output struct {
+	w     io.Writer
+	level zerolog.Level
+	sink  Sink
+}
+
+// dispatcher writes every line to the sinks whose level is reached, info and lower lines are sampled
+type dispatcher struct {
+	outs    []output
+	sampler zerolog.Sampler
+}
+
+func newDispatcher(confs []SinkConf, color bool, sampling SamplingConf) (*dispatcher, error) {
+	d := &dispatcher{sampler: sampling.sampler()}
+	for _, c := range confs {
+		o, err := newOutput(c, color)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.outs = append(d.outs, o)
+	}
+	return d, nil
+}
+
+func newOutput(c SinkConf, color bool) (output, error) {
+	typ := strings.ToLower(c.Type)
+	sinksMu.Lock()
+	fn, ok := sinks[typ]
+	sinksMu.Unlock()
+	if !ok {
+		return output{}, fmt.Errorf("unknown log sink %s", c.Type)
+	}
+	lvl := zerolog.TraceLevel
+	if c.Level != "" {
+		var err error
+		if lvl, err = parseLevel(c.Level); err != nil {
+			return output{}, fmt.Errorf("log sink %s: %s", c.Type, err.Error())
+		}
+	}
+	s, err := fn(c)
+	if err != nil {
+		return output{}, fmt.Errorf("log sink %s: %s", c.Type, err.Error())
+	}
+	format := strings.ToLower(c.Format)
+	std := typ == SINK_STDERR || typ == SINK_STDOUT
+	if format == "" && std {
+		format = FORMAT_CONSOLE
+	}
+	o := output{w: s, level: lvl, sink: s}
+	if format == FORMAT_CONSOLE {
+		cw := zerolog.ConsoleWriter{Out: s, TimeFormat: time.DateTime + ".000"}
+		if std && color {
+			cw.FormatLevel = formatLevelConsole()
+		} else {
+			cw.FormatLevel = formatLevelFile()
+			cw.NoColor = true
+		}
+		o.w = cw
+	} else if _, ok := s.(LevelSink); ok {
+		o.w = nil
+	}
+	return o, nil
+}
+
+func (d *dispatcher) Write(p []byte) (int, error) {
+	return d.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (d *dispatcher) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if d.sampler != nil && level <= zerolog.InfoLevel && level != zerolog.NoLevel && !d.sampler.Sample(level) {
+		return len(p), nil
+	}
+	var err error
+	for _, o := range d.outs {
+		if level != zerolog.NoLevel && level < o.level {
+			continue
+		}
+		var e error
+		if o.w == nil {
+			_, e = o.sink.(LevelSink).WriteLevel(level, p)
+		} else {
+			_, e = o.w.Write(p)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return len(p), err
+}
+
+func (d *dispatcher) Close() error {
+	var err error
+	for _, o := range d.outs {
+		if e := o.sink.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,194 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShipBatch    = 500
+	defaultShipBuffer   = 10000
+	defaultShipInterval = 2
+	shipRetries         = 3
+)
+
+// httpSink ships the lines in ndjson batches by a goroutine, the buffer decouples the logging from the
+// collector, once it is full the logging is blocked or the lines are dropped by SinkConf.Block
+type httpSink struct {
+	url      string
+	headers  map[string]string
+	batch    int
+	interval time.Duration
+	block    bool
+	cli      *http.Client
+	queue    chan []byte
+	flush    chan chan bool
+	stop     chan bool
+	stopped  chan bool
+	once     sync.Once
+	dropped  atomic.Int64
+}
+
+func newHttpSink(conf SinkConf) (Sink, error) {
+	if conf.Url == "" {
+		return nil, fmt.Errorf("no url of http sink")
+	}
+	s := &httpSink{
+		url:      conf.Url,
+		headers:  conf.Headers,
+		batch:    conf.BatchSize,
+		interval: time.Duration(conf.FlushInterval) * time.Second,
+		block:    conf.Block,
+		cli:      &http.Client{Timeout: 10 * time.Second},
+		flush:    make(chan chan bool),
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	if s.batch <= 0 {
+		s.batch = defaultShipBatch
+	}
+	if s.interval <= 0 {
+		s.interval = defaultShipInterval * time.Second
+	}
+	size := conf.BufferSize
+	if size <= 0 {
+		size = defaultShipBuffer
+	}
+	s.queue = make(chan []byte, size)
+	go s.run()
+	return s, nil
+}
+
+func (s *httpSink) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+	if s.block {
+		select {
+		case s.queue <- line:
+		case <-s.stopped:
+		}
+		return len(p), nil
+	}
+	select {
+	case s.queue <- line:
+	default:
+		s.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// Flush ships the buffered lines
+func (s *httpSink) Flush() {
+	done := make(chan bool)
+	select {
+	case s.flush <- done:
+		<-done
+	case <-s.stopped:
+	}
+}
+
+// Close ships the buffered lines and stops the goroutine
+func (s *httpSink) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
+	s.cli.CloseIdleConnections()
+	return nil
+}
+
+func (s *httpSink) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	n := 0
+	send := func() {
+		if n == 0 {
+			return
+		}
+		s.post(buf.Bytes())
+		buf.Reset()
+		n = 0
+	}
+	add := func(line []byte) {
+		buf.Write(line)
+		n++
+		if n >= s.batch {
+			send()
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case line := <-s.queue:
+				add(line)
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case line := <-s.queue:
+			add(line)
+		case <-ticker.C:
+			send()
+			if d := s.dropped.Swap(0); d > 0 {
+				fmt.Fprintf(os.Stderr, "log http sink buffer full, %d lines dropped\n", d)
+			}
+		case done := <-s.flush:
+			drain()
+			close(done)
+		case <-s.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// post retries with backoff, the batch is dropped after the retries
+func (s *httpSink) post(body []byte) {
+	var err error
+	for i := 0; i < shipRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+		}
+		if err = s.send(body); err == nil {
+			return
+		}
+	}
+	// the logger can't log its own failure, which may loop
+	fmt.Fprintf(os.Stderr, "log http sink post error: %s\n", err.Error())
+}
+
+func (s *httpSink) send(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"github.com/rs/zerolog"
+	"log/syslog"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	RegSink(SINK_SYSLOG, newSyslogSink)
+}
+
+// syslogSink maps the levels to the syslog severities, the writer redials once the connection is lost
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(conf SinkConf) (Sink, error) {
+	tag := conf.Tag
+	if tag == "" {
+		tag = filepath.Base(os.Args[0])
+	}
+	w, err := syslog.Dial(conf.Network, conf.Addr, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(p []byte) (int, error) {
+	return s.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (s *syslogSink) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	msg := string(p)
+	var err error
+	switch level {
+	case zerolog.TraceLevel, zerolog.DebugLevel:
+		err = s.w.Debug(msg)
+	case zerolog.InfoLevel:
+		err = s.w.Info(msg)
+	case zerolog.WarnLevel:
+		err = s.w.Warning(msg)
+	case zerolog.ErrorLevel:
+		err = s.w.Err(msg)
+	case zerolog.FatalLevel:
+		err = s.w.Crit(msg)
+	case zerolog.PanicLevel:
+		err = s.w.Emerg(msg)
+	default:
+		err = s.w.Notice(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+type bufSink struct {
+	bytes.Buffer
+}
+
+func (b *bufSink) Close() error {
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	all, warn := &bufSink{}, &bufSink{}
+	RegSink("buf-all", func(conf SinkConf) (Sink, error) { return all, nil })
+	RegSink("buf-warn", func(conf SinkConf) (Sink, error) { return warn, nil })
+	d, err := newDispatcher([]SinkConf{{Type: "buf-all", Format: FORMAT_JSON}, {Type: "buf-warn", Level: "warn"}},
+		false, SamplingConf{Enable: true, Burst: 2, Period: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := zerolog.New(d)
+	for i := 0; i < 5; i++ {
+		l.Info().Int("i", i).Msg("sampled")
+	}
+	l.Warn().Msg("kept")
+	lines := strings.Split(strings.TrimSpace(all.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("sampled lines %q", lines)
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(lines[2]), &m); err != nil || m["level"] != "warn" {
+		t.Fatalf("not json line %q", lines[2])
+	}
+	if warn.String() != `{"level":"warn","message":"kept"}`+"\n" {
+		t.Fatalf("warn sink got %q", warn.String())
+	}
+	if _, err := newDispatcher([]SinkConf{{Type: "none"}}, false, SamplingConf{}); err == nil {
+		t.Fatal("unknown sink accepted")
+	}
+}
+
+func TestHttpSink(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			got = append(got, sc.Text())
+		}
+	}))
+	defer collector.Close()
+	s, err := newHttpSink(SinkConf{Type: SINK_HTTP, Url: collector.URL, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := zerolog.New(s)
+	for i := 0; i < 3; i++ {
+		l.Info().Int("i", i).Send()
+	}
+	s.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 3 || got[2] != `{"level":"info","i":2}` {
+		t.Fatalf("collector got %q", got)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	buf := &bufSink{}
+	RegSink("buf-audit", func(conf SinkConf) (Sink, error) { return buf, nil })
+	Configure(&LogConf{Debug: true, Audit: AuditConf{Enable: true, Sinks: []SinkConf{{Type: "buf-audit"}}}})
+	defer Close()
+	ctx := Extract(context.Background(), func(k string) string { return map[string]string{HEADER_USER_ID: "u1"}[k] }, "")
+	Audit(ctx, "user.login", Val{K: "ip", V: "127.0.0.1"})
+	var m map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("audit line %q", buf.String())
+	}
+	if m[FIELD_ACTION] != "user.login" || m[FIELD_USER_ID] != "u1" || m["ip"] != "127.0.0.1" {
+		t.Fatalf("audit event %v", m)
+	}
+}
@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	NAMESPACE = "microj"
+
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DefBuckets are latency buckets in seconds
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	collectors   = make(map[string]Collector)
+	collectorsMu sync.RWMutex
+)
+
+// Collector writes one metric family in the prometheus text format
+type Collector interface {
+	Name() string
+	Collect(w io.Writer)
+}
+
+// Sample is a value of a func metric, Values are in the order of the labels
+type Sample struct {
+	Values []string
+	Value  float64
+}
+
+// Register adds the collector, a collector with the same name is returned instead if already registered
+func Register(c Collector) Collector {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	if old, ok := collectors[c.Name()]; ok {
+		return old
+	}
+	collectors[c.Name()] = c
+	return c
+}
+
+// Unregister removes the collector by name
+func Unregister(name string) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	delete(collectors, name)
+}
+
+// Write writes all registered metrics sorted by name
+func Write(w io.Writer) {
+	collectorsMu.RLock()
+	all := make([]Collector, 0, len(collectors))
+	for _, c := range collectors {
+		all = append(all, c)
+	}
+	collectorsMu.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name() < all[j].Name()
+	})
+	bw := bufio.NewWriter(w)
+	for _, c := range all {
+		c.Collect(bw)
+	}
+	bw.Flush()
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		Write(w)
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHead(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "), d.name, d.typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counter
+}
+
+type counter struct {
+	values []string
+	value  float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: TYPE_COUNTER, labels: labels},
+		series: make(map[string]*counter),
+	}
+	ret, ok := Register(c).(*CounterVec)
+	if !ok {
+		panic(fmt.Sprintf("metric %s is already registered with another type", name))
+	}
+	return ret
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	k := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[k]
+	if !ok {
+		s = &counter{values: values}
+		c.series[k] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) Collect(w io.Writer) {
+	c.mu.Lock()
+	samples := make([]Sample, 0, len(c.series))
+	for _, s := range c.series {
+		samples = append(samples, Sample{Values: s.values, Value: s.value})
+	}
+	c.mu.Unlock()
+	writeSamples(w, &c.desc, samples)
+}
+
+// HistogramVec counts observations into buckets partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec uses DefBuckets if buckets is nil
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: TYPE_HISTOGRAM, labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	ret, ok := Register(h).(*HistogramVec)
+	if !ok {
+		panic(fmt.Sprintf("metric %s is already registered with another type", name))
+	}
+	return ret
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	k := h.key(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) Collect(w io.Writer) {
+	h.mu.Lock()
+	all := make([]histogram, 0, len(h.series))
+	for _, s := range h.series {
+		all = append(all, histogram{
+			values: s.values,
+			counts: append([]uint64{}, s.counts...),
+			sum:    s.sum,
+			count:  s.count,
+		})
+	}
+	h.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].values, "\xff") < strings.Join(all[j].values, "\xff")
+	})
+	h.writeHead(w)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, s := range all {
+		values := append(append([]string{}, s.values...), "")
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			values[len(values)-1] = formatFloat(b)
+			writeLine(w, h.name+"_bucket", labels, values, float64(cum))
+		}
+		values[len(values)-1] = "+Inf"
+		writeLine(w, h.name+"_bucket", labels, values, float64(s.count))
+		writeLine(w, h.name+"_sum", h.labels, s.values, s.sum)
+		writeLine(w, h.name+"_count", h.labels, s.values, float64(s.count))
+	}
+}
+
+// funcCollector reads the samples on every collection, used for values owned by others like pool stats
+type funcCollector struct {
+	desc
+	fn func() []Sample
+}
+
+func NewGaugeFunc(name, help string, labels []string, fn func() []Sample) Collector {
+	return Register(&funcCollector{
+		desc: desc{name: name, help: help, typ: TYPE_GAUGE, labels: labels},
+		fn:   fn,
+	})
+}
+
+// NewCounterFunc is for cumulative values like hits of a pool
+func NewCounterFunc(name, help string, labels []string, fn func() []Sample) Collector {
+	return Register(&funcCollector{
+		desc: desc{name: name, help: help, typ: TYPE_COUNTER, labels: labels},
+		fn:   fn,
+	})
+}
+
+func (f *funcCollector) Collect(w io.Writer) {
+	writeSamples(w, &f.desc, f.fn())
+}
+
+func writeSamples(w io.Writer, d *desc, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Values, "\xff") < strings.Join(samples[j].Values, "\xff")
+	})
+	d.writeHead(w)
+	for _, s := range samples {
+		writeLine(w, d.name, d.labels, s.Values, s.Value)
+	}
+}
+
+func writeLine(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, l := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, l)
+			io.WriteString(w, `="`)
+			io.WriteString(w, escape(values[i]))
+			io.WriteString(w, `"`)
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " ")
+	io.WriteString(w, formatFloat(v))
+	io.WriteString(w, "\n")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
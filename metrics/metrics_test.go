@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "test requests", "path", "status")
+	c.Inc("/a", "200")
+	c.Add(2, "/a", "200")
+	c.Inc(`/"b"`, "500")
+	if NewCounterVec("test_requests_total", "test requests", "path", "status") != c {
+		t.Fatal("same name registered twice")
+	}
+	h := NewHistogramVec("test_duration_seconds", "test duration", []float64{0.1, 1}, "path")
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(5, "/a")
+	NewGaugeFunc("test_pool_open", "test pool", nil, func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+	defer func() {
+		Unregister("test_requests_total")
+		Unregister("test_duration_seconds")
+		Unregister("test_pool_open")
+	}()
+
+	var buf bytes.Buffer
+	Write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{path="/a",status="200"} 3`,
+		`test_requests_total{path="/\"b\"",status="500"} 1`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{path="/a",le="0.1"} 1`,
+		`test_duration_seconds_bucket{path="/a",le="1"} 2`,
+		`test_duration_seconds_bucket{path="/a",le="+Inf"} 3`,
+		`test_duration_seconds_sum{path="/a"} 5.55`,
+		`test_duration_seconds_count{path="/a"} 3`,
+		"test_pool_open 3",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	c := NewCounterVec("test_mismatch_total", "test", "a")
+	defer Unregister("test_mismatch_total")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("mismatched label values not rejected")
+		}
+	}()
+	c.Inc("1", "2")
+}
+
+func TestRegisterTypeConflict(t *testing.T) {
+	NewCounterVec("test_conflict", "test")
+	defer Unregister("test_conflict")
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "test_conflict") {
+			t.Fatalf("conflicting metric type recovered %v", r)
+		}
+	}()
+	NewHistogramVec("test_conflict", "test", nil)
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/db"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/trace"
+	"gorm.io/gorm"
+	"strconv"
+	"time"
+)
+
+const (
+	STATUS_PENDING = 0
+	STATUS_SENT    = 1
+	// STATUS_DEAD is a message failed after outbox.maxAttempts, it is kept for the inspection and never relayed
+	STATUS_DEAD = 2
+
+	logModule = "outbox"
+)
+
+// Outbox is the table of the messages to publish, add &outbox.Outbox{} to the models of db.InitDataSource
+// to create it by the ddl
+type Outbox struct {
+	ID       int64  `gorm:"primarykey;column:id;type:bigint;"`
+	Topic    string `gorm:"column:topic;type:varchar(255);not null"`
+	Head     string `gorm:"column:head;type:text"`
+	Body     []byte `gorm:"column:body;type:mediumblob"`
+	Status   int    `gorm:"column:status;type:tinyint;not null;default:0;index:idx_outbox_relay,priority:1"`
+	Attempts int    `gorm:"column:attempts;type:int;not null;default:0"`
+	// NextAt is when the message is relayed, it is put off by the delays after a failure
+	NextAt time.Time `gorm:"column:next_at;not null;index:idx_outbox_relay,priority:2"`
+	// LockedBy and LockedUntil lease the message to a relay, another relay takes it over once the lease expires
+	LockedBy    string     `gorm:"column:locked_by;type:varchar(64);not null;default:''"`
+	LockedUntil time.Time  `gorm:"column:locked_until;not null"`
+	Error       string     `gorm:"column:error;type:varchar(1024);not null;default:''"`
+	CreatedAt   time.Time  `gorm:"column:created_at"`
+	SentAt      *time.Time `gorm:"column:sent_at;index"`
+}
+
+// Enqueue inserts the message by tx, it is published by the relay once tx is committed,
+// so the message is never lost or sent for a rolled back change.
+// The trace and request of tx.Statement.Context are kept in the head for the consumers
+func Enqueue(tx *gorm.DB, topic string, msg broker.Message) error {
+	head := make(map[string]string, len(msg.Head)+4)
+	for k, v := range msg.Head {
+		head[k] = v
+	}
+	if ctx := tx.Statement.Context; ctx != nil {
+		trace.Inject(ctx, func(k, v string) {
+			head[k] = v
+		})
+		logger.Inject(ctx, func(k, v string) {
+			head[k] = v
+		})
+	}
+	id := db.NextID()
+	// kept by the republishing after a lease expired, so the consumers can dedup it
+	if head[broker.HEAD_MESSAGE_ID] == "" {
+		head[broker.HEAD_MESSAGE_ID] = strconv.FormatInt(id, 10)
+	}
+	bs, err := json.Marshal(head)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, "outbox head encode error", err)
+	}
+	o := &Outbox{
+		ID:     id,
+		Topic:  topic,
+		Head:   string(bs),
+		Body:   msg.Body,
+		Status: STATUS_PENDING,
+	}
+	if err = o.insert(tx); err != nil {
+		return errs.Wrap(errs.ERRCODE_DB, fmt.Sprintf("outbox enqueue %s error", topic), err)
+	}
+	return nil
+}
+
+// insert takes the times from the database, the relay compares them with NOW(3) rather than the clock of the app
+func (o *Outbox) insert(tx *gorm.DB) error {
+	now := gorm.Expr("NOW(3)")
+	return tx.Model(&Outbox{}).Create(map[string]any{
+		"id":           o.ID,
+		"topic":        o.Topic,
+		"head":         o.Head,
+		"body":         o.Body,
+		"status":       o.Status,
+		"next_at":      now,
+		"locked_until": now,
+		"created_at":   now,
+	}).Error
+}
+
+// EnqueueValue encodes v by broker.Encode like broker.Publish
+func EnqueueValue[T any](tx *gorm.DB, topic string, v T) error {
+	msg, err := broker.Encode(v, "")
+	if err != nil {
+		return err
+	}
+	return Enqueue(tx, topic, msg)
+}
+
+// message restores the head, a broken head is dropped rather than blocking the message
+func (o *Outbox) message() broker.Message {
+	msg := broker.Message{Head: make(map[string]string), Body: o.Body}
+	if o.Head != "" {
+		if err := json.Unmarshal([]byte(o.Head), &msg.Head); err != nil {
+			logger.Error("outbox head decode error", err, logger.Val{K: "id", V: o.ID})
+			msg.Head = make(map[string]string)
+		}
+	}
+	return msg
+}
@@ -0,0 +1,32 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	o := &Outbox{Head: `{"content-type":"application/json"}`, Body: []byte("1")}
+	if msg := o.message(); msg.Head["content-type"] != "application/json" || string(msg.Body) != "1" {
+		t.Fatalf("message %s", msg)
+	}
+	o.Head = "{broken"
+	if msg := o.message(); msg.Head == nil || len(msg.Head) != 0 {
+		t.Fatalf("message of broken head %s", msg)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	r := NewRelay(nil, Options{Delays: []int64{100, 1000}})
+	if r.opts.MaxAttempts != defaultMaxAttempts || r.opts.Retention != defaultRetention {
+		t.Fatalf("default options %+v", r.opts)
+	}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: time.Second, 5: time.Second} {
+		if d := r.delay(attempt); d != want {
+			t.Fatalf("delay of attempt %d is %s", attempt, d)
+		}
+	}
+	if d := NewRelay(nil, Options{}).delay(1); d != defaultInterval*time.Millisecond {
+		t.Fatalf("delay without delays %s", d)
+	}
+}
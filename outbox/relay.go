@@ -0,0 +1,283 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/db"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/trace"
+	"gorm.io/gorm"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultInterval    = 1000
+	defaultBatchSize   = 100
+	defaultLease       = 30
+	defaultMaxAttempts = 10
+	defaultRetention   = 168
+
+	maxErrorLen   = 1024
+	purgeInterval = time.Hour
+)
+
+var relayed = metrics.NewCounterVec(metrics.NAMESPACE+"_outbox_relayed_total",
+	"Total number of outbox messages relayed to the broker.", "topic", "result")
+
+// Options of outbox, the relays of all instances share the table, a message is leased to one relay at a time
+// and published at least once, a message may be published again if its relay dies before marking it sent
+type Options struct {
+	Enable bool `yaml:"enable"`
+	// Interval of polling the table in millisecond
+	Interval int64 `yaml:"interval"`
+	// BatchSize of the messages leased by a poll
+	BatchSize int `yaml:"batchSize"`
+	// Lease in second, it must be longer than publishing a batch
+	Lease int64 `yaml:"lease"`
+	// MaxAttempts before the message is marked dead, 10 by default, -1 retries forever
+	MaxAttempts int `yaml:"maxAttempts"`
+	// Delays between the attempts in millisecond, the last one is reused for the rest
+	Delays []int64 `yaml:"delays"`
+	// Retention of the sent messages in hour, they are deleted after it, -1 keeps them forever
+	Retention int64 `yaml:"retention"`
+}
+
+// Relay publishes the pending messages of the table through the broker
+type Relay struct {
+	opts Options
+	orm  *gorm.DB
+	stop chan bool
+	done chan bool
+}
+
+// Init starts the relay of outbox, it is called after db.InitDataSource and stopped before the broker disconnected
+func Init() {
+	var opts Options
+	if config.IsSet("outbox") {
+		if err := config.Scan("outbox", &opts); err != nil {
+			logger.Error("outbox config error", err)
+			return
+		}
+	}
+	if !opts.Enable {
+		return
+	}
+	r := NewRelay(db.Gorm(), opts)
+	r.Start()
+	app.AddShutdownHook(app.SHUTDOWN_ORDER_BROKER-10, "outbox", r.Stop)
+}
+
+func NewRelay(orm *gorm.DB, opts Options) *Relay {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = defaultLease
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.Retention == 0 {
+		opts.Retention = defaultRetention
+	}
+	return &Relay{
+		opts: opts,
+		orm:  orm,
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+}
+
+func (r *Relay) Start() {
+	go r.run()
+	logger.Module(logModule).Infof("outbox relay started, interval %dms", r.opts.Interval)
+}
+
+// Stop waits for the batch in progress, the messages leased but not published are taken over after the lease
+func (r *Relay) Stop(ctx context.Context) error {
+	close(r.stop)
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Relay) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(time.Duration(r.opts.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	log := logger.Module(logModule)
+	var purged time.Time
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		if !broker.Connected() {
+			continue
+		}
+		// a full batch means more are pending
+		for {
+			n, err := r.relay(context.Background())
+			if err != nil {
+				log.Error("outbox relay error", err)
+				break
+			}
+			if n < r.opts.BatchSize {
+				break
+			}
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+		}
+		if r.opts.Retention > 0 && time.Since(purged) > purgeInterval {
+			purged = time.Now()
+			if err := r.purge(context.Background()); err != nil {
+				log.Error("outbox purge error", err)
+			}
+		}
+	}
+}
+
+// relay publishes a batch, it returns the number of the messages leased
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	rows, owner, err := r.claim(ctx)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	for i := range rows {
+		o := &rows[i]
+		if err = r.publish(o); err != nil {
+			r.fail(ctx, o, owner, err)
+			continue
+		}
+		r.sent(ctx, o, owner)
+	}
+	return len(rows), nil
+}
+
+// claim leases the due messages to a new owner, the update only takes the rows not leased by the other relays.
+// The times are compared on the clock of the database, so the skew between the instances can't take over a lease
+func (r *Relay) claim(ctx context.Context) ([]Outbox, string, error) {
+	var ids []int64
+	err := r.orm.WithContext(ctx).Model(&Outbox{}).
+		Where("status = ? AND next_at <= NOW(3) AND locked_until <= NOW(3)", STATUS_PENDING).
+		Order("id").Limit(r.opts.BatchSize).Pluck("id", &ids).Error
+	if err != nil {
+		return nil, "", errs.Wrap(errs.ERRCODE_DB, "outbox poll error", err)
+	}
+	if len(ids) == 0 {
+		return nil, "", nil
+	}
+	owner := logger.NewRequestID()
+	err = r.orm.WithContext(ctx).Model(&Outbox{}).
+		Where("id IN ? AND status = ? AND locked_until <= NOW(3)", ids, STATUS_PENDING).
+		Updates(map[string]any{"locked_by": owner, "locked_until": gorm.Expr("NOW(3) + INTERVAL ? SECOND", r.opts.Lease)}).Error
+	if err != nil {
+		return nil, "", errs.Wrap(errs.ERRCODE_DB, "outbox lease error", err)
+	}
+	var rows []Outbox
+	err = r.orm.WithContext(ctx).Where("locked_by = ? AND status = ?", owner, STATUS_PENDING).Order("id").Find(&rows).Error
+	if err != nil {
+		return nil, "", errs.Wrap(errs.ERRCODE_DB, "outbox lease error", err)
+	}
+	return rows, owner, nil
+}
+
+// publish continues the trace of the enqueuing request
+func (r *Relay) publish(o *Outbox) error {
+	msg := o.message()
+	ctx := trace.Extract(context.Background(), func(k string) string {
+		return msg.Head[k]
+	})
+	ctx = logger.Extract(ctx, func(k string) string {
+		return msg.Head[k]
+	}, "")
+	return broker.SendContext(ctx, o.Topic, msg)
+}
+
+func (r *Relay) sent(ctx context.Context, o *Outbox, owner string) {
+	now := gorm.Expr("NOW(3)")
+	res := r.orm.WithContext(ctx).Model(&Outbox{}).
+		Where("id = ? AND locked_by = ?", o.ID, owner).
+		Updates(map[string]any{"status": STATUS_SENT, "sent_at": now, "locked_by": "", "locked_until": now, "error": ""})
+	relayed.Inc(o.Topic, "ok")
+	log := logger.FromContext(ctx).Module(logModule)
+	if res.Error != nil {
+		// published again after the lease, the consumers must be idempotent
+		log.Error("outbox mark sent error", res.Error, logger.Val{K: "id", V: o.ID})
+	} else if res.RowsAffected == 0 {
+		log.Warnf("outbox message %d lease lost before marked sent, it may be published again", o.ID)
+	}
+}
+
+func (r *Relay) fail(ctx context.Context, o *Outbox, owner string, cause error) {
+	attempts := o.Attempts + 1
+	updates := map[string]any{
+		"attempts":     attempts,
+		"locked_by":    "",
+		"locked_until": gorm.Expr("NOW(3)"),
+		"error":        truncate(cause.Error(), maxErrorLen),
+	}
+	log := logger.FromContext(ctx).Module(logModule)
+	if r.opts.MaxAttempts > 0 && attempts >= r.opts.MaxAttempts {
+		updates["status"] = STATUS_DEAD
+		relayed.Inc(o.Topic, "dead")
+		log.Error(fmt.Sprintf("outbox message %d of %s dead after %d attempts", o.ID, o.Topic, attempts), cause)
+	} else {
+		updates["next_at"] = gorm.Expr("NOW(3) + INTERVAL ? MICROSECOND", r.delay(attempts).Microseconds())
+		relayed.Inc(o.Topic, "error")
+	}
+	err := r.orm.WithContext(ctx).Model(&Outbox{}).Where("id = ? AND locked_by = ?", o.ID, owner).Updates(updates).Error
+	if err != nil {
+		log.Error("outbox mark failed error", err, logger.Val{K: "id", V: o.ID})
+	}
+}
+
+func (r *Relay) delay(attempt int) time.Duration {
+	if len(r.opts.Delays) == 0 {
+		return time.Duration(r.opts.Interval) * time.Millisecond
+	}
+	i := attempt - 1
+	if i >= len(r.opts.Delays) {
+		i = len(r.opts.Delays) - 1
+	}
+	return time.Duration(r.opts.Delays[i]) * time.Millisecond
+}
+
+func (r *Relay) purge(ctx context.Context) error {
+	res := r.orm.WithContext(ctx).Where("status = ? AND sent_at < NOW(3) - INTERVAL ? HOUR", STATUS_SENT, r.opts.Retention).
+		Delete(&Outbox{})
+	if res.Error != nil {
+		return errs.Wrap(errs.ERRCODE_DB, "outbox purge error", res.Error)
+	}
+	if res.RowsAffected > 0 {
+		logger.FromContext(ctx).Module(logModule).Infof("outbox purged %d sent messages", res.RowsAffected)
+	}
+	return nil
+}
+
+// truncate cuts s to n bytes at most without splitting a rune
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,148 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newMockRelay(t *testing.T, opts Options) (*Relay, sqlmock.Sqlmock) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	orm, err := gorm.Open(mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true}),
+		&gorm.Config{SkipDefaultTransaction: true, Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRelay(orm, opts), mock
+}
+
+func sql(s string) string {
+	return regexp.QuoteMeta(s)
+}
+
+func TestClaim(t *testing.T) {
+	r, mock := newMockRelay(t, Options{BatchSize: 2, Lease: 30})
+	mock.ExpectQuery(sql("WHERE status = ? AND next_at <= NOW(3) AND locked_until <= NOW(3) ORDER BY id LIMIT 2")).
+		WithArgs(STATUS_PENDING).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	// the other relay took the second one in between
+	mock.ExpectExec(sql("`locked_until`=NOW(3) + INTERVAL ? SECOND WHERE id IN (?,?) AND status = ? AND locked_until <= NOW(3)")).
+		WithArgs(sqlmock.AnyArg(), int64(30), 1, 2, STATUS_PENDING).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(sql("WHERE locked_by = ? AND status = ?")).
+		WithArgs(sqlmock.AnyArg(), STATUS_PENDING).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "attempts"}).AddRow(1, "order.created", 0))
+	rows, owner, err := r.claim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].ID != 1 || owner == "" {
+		t.Fatalf("claimed %+v by %q", rows, owner)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(sql("next_at <= NOW(3)")).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	if rows, _, err = r.claim(context.Background()); err != nil || len(rows) != 0 {
+		t.Fatalf("claimed %+v without due messages, error %v", rows, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSentLeaseLost(t *testing.T) {
+	r, mock := newMockRelay(t, Options{})
+	o := &Outbox{ID: 7, Topic: "order.created"}
+	// the lease expired and another relay took the message
+	mock.ExpectExec(sql("`sent_at`=NOW(3),`status`=? WHERE id = ? AND locked_by = ?")).
+		WithArgs("", "", STATUS_SENT, int64(7), "owner").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	r.sent(context.Background(), o, "owner")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	r, mock := newMockRelay(t, Options{MaxAttempts: 3, Delays: []int64{100, 2000}})
+	o := &Outbox{ID: 7, Topic: "order.created", Attempts: 1}
+	mock.ExpectExec(sql("`next_at`=NOW(3) + INTERVAL ? MICROSECOND WHERE id = ? AND locked_by = ?")).
+		WithArgs(2, "broker down", "", int64(2*time.Second/time.Microsecond), int64(7), "owner").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	r.fail(context.Background(), o, "owner", errors.New("broker down"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	o.Attempts = 2
+	mock.ExpectExec(sql("`status`=? WHERE id = ? AND locked_by = ?")).
+		WithArgs(3, "broker down", "", STATUS_DEAD, int64(7), "owner").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	r.fail(context.Background(), o, "owner", errors.New("broker down"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	r, mock := newMockRelay(t, Options{Retention: 24})
+	mock.ExpectExec(sql("DELETE FROM")).
+		WithArgs(STATUS_SENT, int64(24)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	if err := r.purge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec(sql("sent_at < NOW(3) - INTERVAL ? HOUR")).WillReturnError(errors.New("db down"))
+	if err := r.purge(context.Background()); err == nil {
+		t.Fatal("purge error not returned")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"broker down", 20, "broker down"},
+		{"broker down", 6, "broker"},
+		{"消息发送失败", 7, "消息"},
+		{"消息发送失败", 6, "消息"},
+		{"消息", 2, ""},
+	} {
+		if got := truncate(c.s, c.n); got != c.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	r, mock := newMockRelay(t, Options{})
+	mock.ExpectExec(sql("(`body`,`created_at`,`head`,`id`,`locked_until`,`next_at`,`status`,`topic`) VALUES (?,NOW(3),?,?,NOW(3),NOW(3),?,?)")).
+		WithArgs([]byte("1"), `{"k":"v"}`, int64(7), STATUS_PENDING, "order.created").
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	o := &Outbox{ID: 7, Topic: "order.created", Head: `{"k":"v"}`, Body: []byte("1")}
+	if err := o.insert(r.orm); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,454 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ACKS_NONE   = "none"
+	ACKS_LEADER = "leader"
+	ACKS_ALL    = "all"
+
+	BALANCER_HASH       = "hash"
+	BALANCER_MURMUR2    = "murmur2"
+	BALANCER_ROUNDROBIN = "roundrobin"
+
+	OFFSET_FIRST = "first"
+	OFFSET_LAST  = "last"
+
+	defaultBatchTimeout = 10
+	defaultGroup        = "microj"
+	fetchErrorWait      = time.Second
+	commitTimeout       = 10 * time.Second
+)
+
+// Options of the kafka broker are read from broker.kafka, broker.addr are the bootstrap brokers
+// and broker.user/pwd authenticate by SASL/PLAIN
+type Options struct {
+	// Acks of the producer: none, leader or all, all by default
+	Acks string `yaml:"acks"`
+	// Balancer picks the partition by HEAD_PARTITION_KEY: hash, murmur2 compatible with the java clients,
+	// or roundrobin ignoring the keys. The messages without a key are always round-robin
+	Balancer string `yaml:"balancer"`
+	// Compression of the producer: gzip, snappy, lz4 or zstd
+	Compression string `yaml:"compression"`
+	BatchSize   int    `yaml:"batchSize"`
+	// BatchTimeout in millisecond, Send waits for it at most, 10 by default
+	BatchTimeout    int64 `yaml:"batchTimeout"`
+	AutoCreateTopic bool  `yaml:"autoCreateTopic"`
+	// StartOffset of a new group: first or last, first by default.
+	// The broadcast receivers always start from the last as every instance joins a group of its own
+	StartOffset string `yaml:"startOffset"`
+	// Instance names the broadcast groups of this instance like group.instance, the hostname by default.
+	// It must be stable across the restarts, or every start leaves a consumer group behind on the brokers
+	Instance string `yaml:"instance"`
+	MinBytes int    `yaml:"minBytes"`
+	MaxBytes int    `yaml:"maxBytes"`
+	// MaxWait, SessionTimeout, HeartbeatInterval and RebalanceTimeout in millisecond
+	MaxWait           int64 `yaml:"maxWait"`
+	SessionTimeout    int64 `yaml:"sessionTimeout"`
+	HeartbeatInterval int64 `yaml:"heartbeatInterval"`
+	RebalanceTimeout  int64 `yaml:"rebalanceTimeout"`
+}
+
+// writer and reader are implemented by kafka-go, the tests replace them by an in-process stand-in
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaBroker maps Receive once onto the consumer group of the group, and the broadcast onto a group
+// of this instance. The messages of a partition are handled one by one and committed once settled
+type kafkaBroker struct {
+	opts      Options
+	brokers   []string
+	user      string
+	pwd       string
+	instance  string
+	writer    writer
+	subs      []*subscription
+	lock      sync.Mutex
+	connected atomic.Bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	newWriter func() writer
+	newReader func(topic, group string, startOffset int64) reader
+}
+
+type subscription struct {
+	topic     string
+	group     string
+	broadcast bool
+	handler   broker.Handler
+	reader    reader
+}
+
+func init() {
+	broker.InvokeInitBroker = newBroker
+}
+
+func newBroker(opts broker.Options) (broker.Broker, error) {
+	if !opts.Enable {
+		return nil, nil
+	}
+	var o Options
+	if config.IsSet("broker.kafka") {
+		if err := config.Scan("broker.kafka", &o); err != nil {
+			return nil, errs.Wrap(errs.ERRCODE_BROKER, "kafka broker config error", err)
+		}
+	}
+	k := &kafkaBroker{
+		opts:     o,
+		user:     opts.User,
+		pwd:      opts.Pwd,
+		instance: instanceID(o),
+	}
+	for _, addr := range strings.Split(opts.Addr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			k.brokers = append(k.brokers, addr)
+		}
+	}
+	k.newWriter = k.kafkaWriter
+	k.newReader = k.kafkaReader
+	return k, nil
+}
+
+// instanceID is the configured instance, the hostname or a random one if neither is available
+func instanceID(o Options) string {
+	if o.Instance != "" {
+		return o.Instance
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	logger.Warn("no kafka instance or hostname, the broadcast groups are not reused after restart")
+	return logger.NewRequestID()[:12]
+}
+
+func (k *kafkaBroker) Init(opts broker.Options) error {
+	if len(k.brokers) == 0 {
+		return errs.New(errs.ERRCODE_BROKER, "broker addr is empty")
+	}
+	if _, err := k.acks(); err != nil {
+		return err
+	}
+	if _, err := k.compression(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (k *kafkaBroker) Connect() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.connected.Load() {
+		return nil
+	}
+	k.writer = k.newWriter()
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	for _, s := range k.subs {
+		k.start(s)
+	}
+	k.connected.Store(true)
+	logger.Info("kafka broker connected ", strings.Join(k.brokers, ","))
+	return nil
+}
+
+// Disconnect waits for the handling messages, the fetched messages not handled are redelivered to the group
+func (k *kafkaBroker) Disconnect() error {
+	k.lock.Lock()
+	if !k.connected.Load() {
+		k.lock.Unlock()
+		return nil
+	}
+	k.connected.Store(false)
+	k.cancel()
+	k.lock.Unlock()
+	k.wg.Wait()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	var err error
+	for _, s := range k.subs {
+		if e := s.reader.Close(); e != nil {
+			err = e
+		}
+		s.reader = nil
+	}
+	if e := k.writer.Close(); e != nil {
+		err = e
+	}
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, "kafka broker close error", err)
+	}
+	return nil
+}
+
+func (k *kafkaBroker) IsConnected() bool {
+	return k.connected.Load()
+}
+
+func (k *kafkaBroker) Receive(once bool, topic, group string, handler broker.Handler) error {
+	if topic == "" || strings.ContainsAny(topic, "*>") {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("invalid kafka topic %s, wildcards are not supported", topic))
+	}
+	if once && group == "" {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("no group of topic %s", topic))
+	}
+	if !once {
+		if group == "" {
+			group = defaultGroup
+		}
+		group = group + "." + k.instance
+	}
+	s := &subscription{topic: topic, group: group, broadcast: !once, handler: handler}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.subs = append(k.subs, s)
+	if k.connected.Load() {
+		k.start(s)
+	}
+	logger.Info(fmt.Sprintf("%s listen topic %s success", group, topic))
+	return nil
+}
+
+// Send takes HEAD_PARTITION_KEY as the key of the message and the rest of the head as the headers
+func (k *kafkaBroker) Send(topic string, msg broker.Message) error {
+	if !k.connected.Load() {
+		return errs.New(errs.ERRCODE_BROKER, "kafka broker not connected")
+	}
+	m := kafka.Message{Topic: topic, Value: msg.Body}
+	for key, v := range msg.Head {
+		if key == broker.HEAD_PARTITION_KEY {
+			m.Key = []byte(v)
+			continue
+		}
+		m.Headers = append(m.Headers, kafka.Header{Key: key, Value: []byte(v)})
+	}
+	if err := k.writer.WriteMessages(context.Background(), m); err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("kafka send %s error", topic), err)
+	}
+	return nil
+}
+
+func (k *kafkaBroker) start(s *subscription) {
+	offset := kafka.FirstOffset
+	if s.broadcast || strings.ToLower(k.opts.StartOffset) == OFFSET_LAST {
+		offset = kafka.LastOffset
+	}
+	s.reader = k.newReader(s.topic, s.group, offset)
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		k.consume(s)
+	}()
+}
+
+func (k *kafkaBroker) consume(s *subscription) {
+	for {
+		m, err := s.reader.FetchMessage(k.ctx)
+		if err != nil {
+			if k.ctx.Err() != nil {
+				return
+			}
+			logger.Error("kafka fetch error", err, logger.Val{K: "topic", V: s.topic}, logger.Val{K: "group", V: s.group})
+			select {
+			case <-time.After(fetchErrorWait):
+				continue
+			case <-k.ctx.Done():
+				return
+			}
+		}
+		if !k.handle(s, m) {
+			return
+		}
+	}
+}
+
+// handle redelivers the message in place until it is settled, so the order of the partition is kept.
+// The reader waits for broker.retry.delays meanwhile, which stalls all partitions it is assigned, so the
+// delays must be short and the long retries left to the dead letters.
+// It returns false once the broker is disconnecting and the message is left to the group
+func (k *kafkaBroker) handle(s *subscription, m kafka.Message) bool {
+	for count := 1; ; count++ {
+		a := &acker{}
+		msg := message(m)
+		msg.Head[broker.HEAD_DELIVERY_COUNT] = strconv.Itoa(count)
+		k.safeHandle(s, msg.WithAcker(a))
+		if !a.nak {
+			break
+		}
+		select {
+		case <-time.After(a.delay):
+		case <-k.ctx.Done():
+			return false
+		}
+	}
+	// committed even if disconnecting, the handled message would be redelivered otherwise
+	ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+	defer cancel()
+	if err := s.reader.CommitMessages(ctx, m); err != nil {
+		// redelivered after the rebalance, the handlers must be idempotent
+		logger.Error("kafka commit error", err,
+			logger.Val{K: "topic", V: s.topic},
+			logger.Val{K: "partition", V: m.Partition},
+			logger.Val{K: "offset", V: m.Offset})
+	}
+	return true
+}
+
+func (k *kafkaBroker) safeHandle(s *subscription, msg broker.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("kafka handler panic", nil,
+				logger.Val{K: "topic", V: s.topic},
+				logger.Val{K: "group", V: s.group},
+				logger.Val{K: "error", V: r})
+		}
+	}()
+	s.handler(msg)
+}
+
+func message(m kafka.Message) broker.Message {
+	msg := broker.Message{Head: make(map[string]string, len(m.Headers)+2), Body: m.Value}
+	for _, h := range m.Headers {
+		msg.Head[h.Key] = string(h.Value)
+	}
+	if len(m.Key) > 0 {
+		msg.Head[broker.HEAD_PARTITION_KEY] = string(m.Key)
+	}
+	return msg
+}
+
+// acker commits the message once the handler returns unless it is nak-ed, Term commits it as well
+// since kafka can't skip a message of the partition otherwise
+type acker struct {
+	nak   bool
+	delay time.Duration
+}
+
+func (a *acker) Ack() error {
+	a.nak = false
+	return nil
+}
+
+func (a *acker) Nak(delay time.Duration) error {
+	a.nak, a.delay = true, delay
+	return nil
+}
+
+func (a *acker) Term() error {
+	a.nak = false
+	return nil
+}
+
+func (a *acker) InProgress() error {
+	return nil
+}
+
+func (k *kafkaBroker) acks() (kafka.RequiredAcks, error) {
+	switch strings.ToLower(k.opts.Acks) {
+	case "", ACKS_ALL:
+		return kafka.RequireAll, nil
+	case ACKS_LEADER:
+		return kafka.RequireOne, nil
+	case ACKS_NONE:
+		return kafka.RequireNone, nil
+	}
+	return 0, errs.New(errs.ERRCODE_BROKER, "unknown kafka acks "+k.opts.Acks)
+}
+
+func (k *kafkaBroker) compression() (kafka.Compression, error) {
+	switch strings.ToLower(k.opts.Compression) {
+	case "":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	}
+	return 0, errs.New(errs.ERRCODE_BROKER, "unknown kafka compression "+k.opts.Compression)
+}
+
+func (k *kafkaBroker) balancer() kafka.Balancer {
+	switch strings.ToLower(k.opts.Balancer) {
+	case BALANCER_MURMUR2:
+		return kafka.Murmur2Balancer{}
+	case BALANCER_ROUNDROBIN:
+		return &kafka.RoundRobin{}
+	}
+	return &kafka.Hash{}
+}
+
+func (k *kafkaBroker) kafkaWriter() writer {
+	acks, _ := k.acks()
+	compression, _ := k.compression()
+	batchTimeout := k.opts.BatchTimeout
+	if batchTimeout <= 0 {
+		batchTimeout = defaultBatchTimeout
+	}
+	w := &kafka.Writer{
+		Addr:                   kafka.TCP(k.brokers...),
+		Balancer:               k.balancer(),
+		RequiredAcks:           acks,
+		Compression:            compression,
+		BatchSize:              k.opts.BatchSize,
+		BatchTimeout:           time.Duration(batchTimeout) * time.Millisecond,
+		AllowAutoTopicCreation: k.opts.AutoCreateTopic,
+		ErrorLogger:            kafka.LoggerFunc(errorLog),
+	}
+	if k.user != "" {
+		w.Transport = &kafka.Transport{SASL: plain.Mechanism{Username: k.user, Password: k.pwd}}
+	}
+	return w
+}
+
+// kafkaReader commits synchronously by CommitMessages
+func (k *kafkaBroker) kafkaReader(topic, group string, startOffset int64) reader {
+	dialer := &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true}
+	if k.user != "" {
+		dialer.SASLMechanism = plain.Mechanism{Username: k.user, Password: k.pwd}
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:           k.brokers,
+		GroupID:           group,
+		Topic:             topic,
+		Dialer:            dialer,
+		MinBytes:          k.opts.MinBytes,
+		MaxBytes:          k.opts.MaxBytes,
+		MaxWait:           time.Duration(k.opts.MaxWait) * time.Millisecond,
+		SessionTimeout:    time.Duration(k.opts.SessionTimeout) * time.Millisecond,
+		HeartbeatInterval: time.Duration(k.opts.HeartbeatInterval) * time.Millisecond,
+		RebalanceTimeout:  time.Duration(k.opts.RebalanceTimeout) * time.Millisecond,
+		StartOffset:       startOffset,
+		ErrorLogger:       kafka.LoggerFunc(errorLog),
+	})
+}
+
+func errorLog(msg string, args ...interface{}) {
+	logger.Warnf("kafka "+msg, args...)
+}
@@ -0,0 +1,319 @@
+package kafka
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/segmentio/kafka-go"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cluster is the in-process stand-in of kafka, a group shares the fetch position of every partition
+// and rewinds it to the committed offsets once a member leaves, like a rebalance
+type cluster struct {
+	mu         sync.Mutex
+	partitions int
+	topics     map[string][][]kafka.Message
+	groups     map[string]*group
+	rr         int
+}
+
+type group struct {
+	fetched   []int64
+	committed []int64
+}
+
+func newCluster(partitions int) *cluster {
+	return &cluster{
+		partitions: partitions,
+		topics:     make(map[string][][]kafka.Message),
+		groups:     make(map[string]*group),
+	}
+}
+
+func (c *cluster) topic(name string) [][]kafka.Message {
+	if _, ok := c.topics[name]; !ok {
+		c.topics[name] = make([][]kafka.Message, c.partitions)
+	}
+	return c.topics[name]
+}
+
+func (c *cluster) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range msgs {
+		parts := c.topic(m.Topic)
+		if len(m.Key) > 0 {
+			h := fnv.New32a()
+			h.Write(m.Key)
+			m.Partition = int(h.Sum32() % uint32(c.partitions))
+		} else {
+			m.Partition = c.rr % c.partitions
+			c.rr++
+		}
+		m.Offset = int64(len(parts[m.Partition]))
+		parts[m.Partition] = append(parts[m.Partition], m)
+	}
+	return nil
+}
+
+func (c *cluster) Close() error {
+	return nil
+}
+
+func (c *cluster) reader(topic, groupID string, startOffset int64) reader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := topic + " " + groupID
+	if _, ok := c.groups[key]; !ok {
+		g := &group{fetched: make([]int64, c.partitions), committed: make([]int64, c.partitions)}
+		if startOffset == kafka.LastOffset {
+			for p, msgs := range c.topic(topic) {
+				g.fetched[p], g.committed[p] = int64(len(msgs)), int64(len(msgs))
+			}
+		}
+		c.groups[key] = g
+	}
+	return &standinReader{c: c, topic: topic, group: c.groups[key]}
+}
+
+type standinReader struct {
+	c     *cluster
+	topic string
+	group *group
+}
+
+func (r *standinReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.c.mu.Lock()
+		for p, msgs := range r.c.topic(r.topic) {
+			if off := r.group.fetched[p]; off < int64(len(msgs)) {
+				r.group.fetched[p]++
+				r.c.mu.Unlock()
+				return msgs[off], nil
+			}
+		}
+		r.c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (r *standinReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.c.mu.Lock()
+	defer r.c.mu.Unlock()
+	for _, m := range msgs {
+		if m.Offset+1 > r.group.committed[m.Partition] {
+			r.group.committed[m.Partition] = m.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *standinReader) Close() error {
+	r.c.mu.Lock()
+	defer r.c.mu.Unlock()
+	copy(r.group.fetched, r.group.committed)
+	return nil
+}
+
+func newTestBroker(c *cluster) *kafkaBroker {
+	return &kafkaBroker{
+		brokers:   []string{"standin:9092"},
+		instance:  logger.NewRequestID()[:12],
+		newWriter: func() writer { return c },
+		newReader: c.reader,
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	c := newCluster(3)
+	b := newTestBroker(c)
+	got := make(chan broker.Message, 1)
+	b.Receive(true, "order.created", "billing", func(msg broker.Message) {
+		got <- msg
+	})
+	b.Connect()
+	defer b.Disconnect()
+
+	err := b.Send("order.created", broker.Message{
+		Head: map[string]string{"k": "v", broker.HEAD_PARTITION_KEY: "user-1"},
+		Body: []byte("1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-got
+	if string(msg.Body) != "1" || msg.Head["k"] != "v" || msg.Head[broker.HEAD_PARTITION_KEY] != "user-1" ||
+		msg.Head[broker.HEAD_DELIVERY_COUNT] != "1" {
+		t.Fatalf("received %s", msg)
+	}
+	for _, m := range c.topics["order.created"] {
+		if len(m) == 1 && (string(m[0].Key) != "user-1" || len(m[0].Headers) != 1) {
+			t.Fatalf("kafka message %+v", m[0])
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	c := newCluster(3)
+	var billing, audit1, audit2 atomic.Int32
+	b1, b2 := newTestBroker(c), newTestBroker(c)
+	b1.Receive(true, "order.paid", "billing", func(msg broker.Message) { billing.Add(1) })
+	b2.Receive(true, "order.paid", "billing", func(msg broker.Message) { billing.Add(1) })
+	b1.Receive(false, "order.paid", "audit", func(msg broker.Message) { audit1.Add(1) })
+	b2.Receive(false, "order.paid", "audit", func(msg broker.Message) { audit2.Add(1) })
+	b1.Connect()
+	defer b1.Disconnect()
+	b2.Connect()
+	defer b2.Disconnect()
+
+	for i := 0; i < 10; i++ {
+		b1.Send("order.paid", broker.Message{Body: []byte(strconv.Itoa(i))})
+	}
+	waitFor(t, func() bool {
+		return billing.Load() == 10 && audit1.Load() == 10 && audit2.Load() == 10
+	})
+	time.Sleep(10 * time.Millisecond)
+	if billing.Load() != 10 {
+		t.Fatalf("billing handled %d", billing.Load())
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	c := newCluster(3)
+	b := newTestBroker(c)
+	var mu sync.Mutex
+	seq := make(map[string][]string)
+	b.Receive(true, "user.updated", "search", func(msg broker.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := msg.Head[broker.HEAD_PARTITION_KEY]
+		seq[key] = append(seq[key], string(msg.Body))
+	})
+	b.Connect()
+	defer b.Disconnect()
+
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			b.Send("user.updated", broker.Message{Head: map[string]string{broker.HEAD_PARTITION_KEY: key}, Body: []byte(strconv.Itoa(i))})
+		}
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seq["a"])+len(seq["b"])+len(seq["c"]) == 15
+	})
+	for key, s := range seq {
+		for i, v := range s {
+			if v != strconv.Itoa(i) {
+				t.Fatalf("messages of %s out of order %v", key, s)
+			}
+		}
+	}
+}
+
+func TestCommitAfterSettled(t *testing.T) {
+	c := newCluster(1)
+	b := newTestBroker(c)
+	counts := make(chan string, 10)
+	b.Receive(true, "order.shipped", "notify", func(msg broker.Message) {
+		counts <- msg.Head[broker.HEAD_DELIVERY_COUNT]
+		if msg.Head[broker.HEAD_DELIVERY_COUNT] == "1" {
+			msg.Nak(time.Millisecond)
+		}
+	})
+	b.Connect()
+	b.Send("order.shipped", broker.Message{Body: []byte("1")})
+	if <-counts != "1" || <-counts != "2" {
+		t.Fatal("nak-ed message not redelivered")
+	}
+	waitFor(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.groups["order.shipped notify"].committed[0] == 1
+	})
+	b.Disconnect()
+
+	// a message not settled before disconnecting is redelivered to the group
+	b = newTestBroker(c)
+	fetched := make(chan bool, 1)
+	b.Receive(true, "order.shipped", "notify", func(msg broker.Message) {
+		fetched <- true
+		msg.Nak(time.Hour)
+	})
+	b.Connect()
+	b.Send("order.shipped", broker.Message{Body: []byte("2")})
+	<-fetched
+	b.Disconnect()
+
+	b = newTestBroker(c)
+	got := make(chan broker.Message, 1)
+	b.Receive(true, "order.shipped", "notify", func(msg broker.Message) {
+		got <- msg
+	})
+	b.Connect()
+	defer b.Disconnect()
+	select {
+	case msg := <-got:
+		if string(msg.Body) != "2" {
+			t.Fatalf("redelivered %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not redelivered")
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	if id := instanceID(Options{Instance: "order-1"}); id != "order-1" {
+		t.Fatalf("configured instance %s", id)
+	}
+	host, _ := os.Hostname()
+	if id := instanceID(Options{}); id == "" || host != "" && id != host {
+		t.Fatalf("default instance %s, hostname %s", id, host)
+	}
+}
+
+func TestRequestUnsupported(t *testing.T) {
+	var b broker.Broker = newTestBroker(newCluster(1))
+	broker.MqBroker = &b
+	defer func() {
+		broker.MqBroker = nil
+	}()
+	b.Connect()
+	defer b.Disconnect()
+	if err := broker.Respond("user.get", "users", func(msg broker.Message) (broker.Message, error) {
+		return msg, nil
+	}); err == nil {
+		t.Fatal("respond accepted")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := broker.Request(ctx, "user.get", broker.Message{Body: []byte("1")})
+	if me, ok := errs.FromError(err); !ok || me.Code() != errs.ERRCODE_BROKER {
+		t.Fatalf("request error %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("request waited for the timeout")
+	}
+}
@@ -0,0 +1,18 @@
+package kafka
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+)
+
+// Request is not supported, the emulated request-reply of the broker package would subscribe a reply topic
+// by a broadcast group, which misses the replies sent before the partitions are assigned and leaves
+// a topic and a group of every instance behind on the brokers
+func (k *kafkaBroker) Request(ctx context.Context, topic string, msg broker.Message) (broker.Message, error) {
+	return broker.Message{}, errs.New(errs.ERRCODE_BROKER, "request-reply is not supported by the kafka broker")
+}
+
+func (k *kafkaBroker) Respond(topic, group string, handler func(msg broker.Message) broker.Message) error {
+	return errs.New(errs.ERRCODE_BROKER, "request-reply is not supported by the kafka broker")
+}
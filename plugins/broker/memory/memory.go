@@ -0,0 +1,310 @@
+package memory
+
+import (
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MODE_SYNC  = "sync"
+	MODE_ASYNC = "async"
+
+	defaultBufferSize = 1024
+)
+
+// Options of the memory broker are read from broker.memory
+type Options struct {
+	// Mode is sync to handle the messages in Send, or async to handle them by a goroutine per subscription
+	Mode string `yaml:"mode"`
+	// BufferSize of every subscription in async mode, Send blocks once it is full
+	BufferSize int `yaml:"bufferSize"`
+}
+
+// memoryBroker delivers the messages in-process with the subject semantics of nats,
+// topics are tokens separated by '.', '*' matches a token and '>' matches the tail tokens
+type memoryBroker struct {
+	opts      Options
+	subs      []*subscription
+	lock      sync.RWMutex
+	connected atomic.Bool
+	wg        sync.WaitGroup
+	// next picks the queue group members round-robin
+	next map[string]*atomic.Uint64
+}
+
+type subscription struct {
+	once    bool
+	topic   []string
+	group   string
+	handler broker.Handler
+	// d delivers the messages in async mode, it is replaced once connected again
+	d *delivery
+}
+
+// delivery is the channel of a subscription in async mode, the senders block on it without the lock
+// of the broker, so the stop unblocks them and closed keeps them from sending on the closed channel
+type delivery struct {
+	ch     chan broker.Message
+	stop   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+func init() {
+	broker.InvokeInitBroker = newBroker
+}
+
+func newBroker(opts broker.Options) (broker.Broker, error) {
+	if !opts.Enable {
+		return nil, nil
+	}
+	var o Options
+	if config.IsSet("broker.memory") {
+		if err := config.Scan("broker.memory", &o); err != nil {
+			return nil, errs.Wrap(errs.ERRCODE_BROKER, "memory broker config error", err)
+		}
+	}
+	return New(o), nil
+}
+
+// New returns a memory broker, it is used directly by the tests without the config
+func New(opts Options) broker.Broker {
+	if opts.Mode == "" {
+		opts.Mode = MODE_SYNC
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	return &memoryBroker{
+		opts: opts,
+		next: make(map[string]*atomic.Uint64),
+	}
+}
+
+func (m *memoryBroker) Init(opts broker.Options) error {
+	return nil
+}
+
+func (m *memoryBroker) Connect() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.connected.Load() {
+		return nil
+	}
+	if m.async() {
+		for _, s := range m.subs {
+			m.start(s)
+		}
+	}
+	m.connected.Store(true)
+	logger.Info("memory broker connected, mode ", m.opts.Mode)
+	return nil
+}
+
+// Disconnect stops the delivery and waits for the buffered messages handled
+func (m *memoryBroker) Disconnect() error {
+	m.lock.Lock()
+	if !m.connected.Load() {
+		m.lock.Unlock()
+		return nil
+	}
+	m.connected.Store(false)
+	for _, s := range m.subs {
+		if s.d != nil {
+			s.d.close()
+			s.d = nil
+		}
+	}
+	m.lock.Unlock()
+	m.wg.Wait()
+	return nil
+}
+
+func (m *memoryBroker) IsConnected() bool {
+	return m.connected.Load()
+}
+
+func (m *memoryBroker) Receive(once bool, topic, group string, handler broker.Handler) error {
+	if topic == "" || !validTopic(topic) {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("invalid topic %s", topic))
+	}
+	if once && group == "" {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("no group of topic %s", topic))
+	}
+	s := &subscription{
+		once:    once,
+		topic:   strings.Split(topic, "."),
+		group:   group,
+		handler: handler,
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subs = append(m.subs, s)
+	if once {
+		key := queueKey(s)
+		if _, ok := m.next[key]; !ok {
+			m.next[key] = &atomic.Uint64{}
+		}
+	}
+	if m.connected.Load() && m.async() {
+		m.start(s)
+	}
+	logger.Info(fmt.Sprintf("%s listen topic %s success", group, topic))
+	return nil
+}
+
+// Send delivers to every plain subscription and one member of every queue group matching the topic
+func (m *memoryBroker) Send(topic string, msg broker.Message) error {
+	if strings.ContainsAny(topic, "*>") || !validTopic(topic) {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("invalid topic %s", topic))
+	}
+	tokens := strings.Split(topic, ".")
+	m.lock.RLock()
+	if !m.connected.Load() {
+		m.lock.RUnlock()
+		return errs.New(errs.ERRCODE_BROKER, "memory broker not connected")
+	}
+	var targets []*subscription
+	groups := make(map[string][]*subscription)
+	var order []string
+	for _, s := range m.subs {
+		if !match(s.topic, tokens) {
+			continue
+		}
+		if !s.once {
+			targets = append(targets, s)
+			continue
+		}
+		key := queueKey(s)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+	for _, key := range order {
+		members := groups[key]
+		i := m.next[key].Add(1) - 1
+		targets = append(targets, members[i%uint64(len(members))])
+	}
+	if m.async() {
+		ds := make([]*delivery, 0, len(targets))
+		for _, s := range targets {
+			ds = append(ds, s.d)
+		}
+		m.lock.RUnlock()
+		// a full channel blocks only this sender, Receive and Disconnect go on
+		for _, d := range ds {
+			if d == nil || !d.send(copyMessage(msg)) {
+				return errs.New(errs.ERRCODE_BROKER, "memory broker disconnected while sending")
+			}
+		}
+		return nil
+	}
+	m.lock.RUnlock()
+	for _, s := range targets {
+		handle(s, copyMessage(msg))
+	}
+	return nil
+}
+
+func (m *memoryBroker) async() bool {
+	return m.opts.Mode == MODE_ASYNC
+}
+
+func (m *memoryBroker) start(s *subscription) {
+	s.d = &delivery{ch: make(chan broker.Message, m.opts.BufferSize), stop: make(chan struct{})}
+	m.wg.Add(1)
+	go func(ch chan broker.Message) {
+		defer m.wg.Done()
+		for msg := range ch {
+			handle(s, msg)
+		}
+	}(s.d.ch)
+}
+
+// send reports false if the delivery is closed before the message is buffered
+func (d *delivery) send(msg broker.Message) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case d.ch <- msg:
+		return true
+	case <-d.stop:
+		return false
+	}
+}
+
+// close unblocks the senders first, the buffered messages are still handled
+func (d *delivery) close() {
+	close(d.stop)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	close(d.ch)
+}
+
+// handle keeps a panic of the handler from breaking the sender or the delivery goroutine
+func handle(s *subscription, msg broker.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("memory broker handler panic", nil,
+				logger.Val{K: "topic", V: strings.Join(s.topic, ".")},
+				logger.Val{K: "group", V: s.group},
+				logger.Val{K: "error", V: r})
+		}
+	}()
+	s.handler(msg)
+}
+
+// copyMessage keeps the subscribers from sharing the head and body with the sender
+func copyMessage(msg broker.Message) broker.Message {
+	head := make(map[string]string, len(msg.Head))
+	for k, v := range msg.Head {
+		head[k] = v
+	}
+	body := make([]byte, len(msg.Body))
+	copy(body, msg.Body)
+	return broker.Message{Head: head, Body: body}
+}
+
+// queueKey groups the members subscribing the same topic with the same group like nats
+func queueKey(s *subscription) string {
+	return strings.Join(s.topic, ".") + " " + s.group
+}
+
+func validTopic(topic string) bool {
+	tokens := strings.Split(topic, ".")
+	for i, t := range tokens {
+		if t == "" || (t == ">" && i != len(tokens)-1) {
+			return false
+		}
+		if len(t) > 1 && strings.ContainsAny(t, "*>") {
+			return false
+		}
+	}
+	return true
+}
+
+func match(pattern, tokens []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) {
+			return false
+		}
+		if p != "*" && p != tokens[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(tokens)
+}
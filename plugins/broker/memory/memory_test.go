@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"github.com/billyyoyo/microj/broker"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		ok             bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.*", "order.created", true},
+		{"order.*", "order.created.v1", false},
+		{"order.>", "order.created.v1", true},
+		{"order.>", "order", false},
+		{"*.created", "user.created", true},
+		{"order", "order.created", false},
+	}
+	for _, c := range cases {
+		if match(strings.Split(c.pattern, "."), strings.Split(c.topic, ".")) != c.ok {
+			t.Errorf("match %s %s should be %v", c.pattern, c.topic, c.ok)
+		}
+	}
+	for _, bad := range []string{"a..b", "a.>.b", "a.b*", ""} {
+		if validTopic(bad) {
+			t.Errorf("invalid topic %q accepted", bad)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	b := New(Options{})
+	var got []string
+	record := func(name string) broker.Handler {
+		return func(msg broker.Message) {
+			got = append(got, name+":"+string(msg.Body))
+		}
+	}
+	b.Receive(false, "order.>", "", record("all"))
+	b.Receive(true, "order.created", "billing", record("billing-1"))
+	b.Receive(true, "order.created", "billing", record("billing-2"))
+	b.Receive(false, "order.created", "", func(msg broker.Message) {
+		panic("handler failed")
+	})
+	if err := b.Send("order.created", broker.Message{Body: []byte("1")}); err == nil {
+		t.Fatal("sent before connected")
+	}
+	b.Connect()
+	defer b.Disconnect()
+	b.Send("order.created", broker.Message{Body: []byte("1")})
+	b.Send("order.created", broker.Message{Body: []byte("2")})
+	b.Send("order.paid", broker.Message{Body: []byte("3")})
+	want := "all:1 billing-1:1 all:2 billing-2:2 all:3"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	b := New(Options{Mode: MODE_ASYNC, BufferSize: 4})
+	b.Connect()
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		b.Receive(true, "job.*", "workers", func(msg broker.Message) {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			counts[name]++
+			mu.Unlock()
+		})
+	}
+	for i := 0; i < 30; i++ {
+		b.Send("job.run", broker.Message{Head: map[string]string{"i": "x"}})
+	}
+	b.Disconnect()
+	if counts["a"] != 10 || counts["b"] != 10 || counts["c"] != 10 {
+		t.Fatalf("queue group delivered %v", counts)
+	}
+}
+
+func TestAsyncFullBuffer(t *testing.T) {
+	b := New(Options{Mode: MODE_ASYNC, BufferSize: 1})
+	b.Connect()
+	release := make(chan struct{})
+	b.Receive(false, "job.run", "", func(msg broker.Message) {
+		<-release
+	})
+	// one in the handler and one in the buffer, the third blocks
+	b.Send("job.run", broker.Message{})
+	b.Send("job.run", broker.Message{})
+	sent := make(chan error)
+	go func() {
+		sent <- b.Send("job.run", broker.Message{})
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("sent to a full buffer: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// not blocked by the sender
+	if err := b.Receive(false, "job.done", "", func(msg broker.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	disconnected := make(chan bool)
+	go func() {
+		b.Disconnect()
+		close(disconnected)
+	}()
+	select {
+	case err := <-sent:
+		if err == nil {
+			t.Fatal("blocked send succeeded after disconnected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after disconnected")
+	}
+	close(release)
+	<-disconnected
+}
@@ -0,0 +1,343 @@
+package nats
+
+import (
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/nats-io/nats.go"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DELIVER_ALL      = "all"
+	DELIVER_NEW      = "new"
+	DELIVER_LAST     = "last"
+	DELIVER_SEQUENCE = "sequence"
+	DELIVER_TIME     = "time"
+)
+
+// JetStreamOptions of broker.jetstream turn the broker durable, the messages are stored by the streams
+// and redelivered until the handlers ack them
+type JetStreamOptions struct {
+	Enable  bool         `yaml:"enable"`
+	Streams []StreamConf `yaml:"streams"`
+	// Consumer is the default of all consumers, Consumers override it by the group
+	Consumer  ConsumerConf            `yaml:"consumer"`
+	Consumers map[string]ConsumerConf `yaml:"consumers"`
+	// ManualAck leaves the messages to the handlers, otherwise the messages not settled by the handlers
+	// are acked once the handlers return and nak-ed once they panic
+	ManualAck bool `yaml:"manualAck"`
+}
+
+// StreamConf is created or updated by Connect, which fails if it can not be set up
+type StreamConf struct {
+	Name     string   `yaml:"name"`
+	Subjects []string `yaml:"subjects"`
+	// Storage is file or memory
+	Storage string `yaml:"storage"`
+	// Retention is limits, interest or workqueue
+	Retention  string `yaml:"retention"`
+	MaxAge     int64  `yaml:"maxAge"` // second
+	MaxMsgs    int64  `yaml:"maxMsgs"`
+	MaxBytes   int64  `yaml:"maxBytes"`
+	Replicas   int    `yaml:"replicas"`
+	Duplicates int64  `yaml:"duplicates"` // second
+}
+
+type ConsumerConf struct {
+	AckWait int64 `yaml:"ackWait"` // second
+	// MaxDeliver must be greater than broker.retry.maxAttempts, -1 or 0 is unlimited
+	MaxDeliver int `yaml:"maxDeliver"`
+	// Backoff are the redelivery delays in second, MaxDeliver must be greater than its length
+	Backoff       []int64 `yaml:"backoff"`
+	MaxAckPending int     `yaml:"maxAckPending"`
+	// Deliver is where a new consumer starts: all, new, last, sequence by StartSeq or time by StartTime,
+	// it has no effect on the existing durable consumers
+	Deliver   string `yaml:"deliver"`
+	StartSeq  uint64 `yaml:"startSeq"`
+	StartTime string `yaml:"startTime"` // RFC3339
+}
+
+func (n *natsBroker) setupStreams() error {
+	for _, s := range n.jsOpts.Streams {
+		cfg, err := s.config()
+		if err != nil {
+			return err
+		}
+		if _, err = n.js.StreamInfo(s.Name); err == nats.ErrStreamNotFound {
+			_, err = n.js.AddStream(cfg)
+		} else if err == nil {
+			_, err = n.js.UpdateStream(cfg)
+		}
+		if err != nil {
+			return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("jetstream stream %s setup error", s.Name), err)
+		}
+		logger.Info("jetstream stream ready ", s.Name)
+	}
+	return nil
+}
+
+func (s StreamConf) config() (*nats.StreamConfig, error) {
+	cfg := &nats.StreamConfig{
+		Name:       s.Name,
+		Subjects:   s.Subjects,
+		MaxAge:     time.Duration(s.MaxAge) * time.Second,
+		MaxMsgs:    s.MaxMsgs,
+		MaxBytes:   s.MaxBytes,
+		Replicas:   s.Replicas,
+		Duplicates: time.Duration(s.Duplicates) * time.Second,
+	}
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	switch strings.ToLower(s.Storage) {
+	case "", "file":
+		cfg.Storage = nats.FileStorage
+	case "memory":
+		cfg.Storage = nats.MemoryStorage
+	default:
+		return nil, errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("unknown storage %s of stream %s", s.Storage, s.Name))
+	}
+	switch strings.ToLower(s.Retention) {
+	case "", "limits":
+		cfg.Retention = nats.LimitsPolicy
+	case "interest":
+		cfg.Retention = nats.InterestPolicy
+	case "workqueue":
+		cfg.Retention = nats.WorkQueuePolicy
+	default:
+		return nil, errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("unknown retention %s of stream %s", s.Retention, s.Name))
+	}
+	return cfg, nil
+}
+
+// consumerConf merges the config of the group into the default one
+func (n *natsBroker) consumerConf(group string) ConsumerConf {
+	c := n.jsOpts.Consumer
+	o, ok := n.jsOpts.Consumers[group]
+	if !ok {
+		return c
+	}
+	if o.AckWait > 0 {
+		c.AckWait = o.AckWait
+	}
+	if o.MaxDeliver != 0 {
+		c.MaxDeliver = o.MaxDeliver
+	}
+	if len(o.Backoff) > 0 {
+		c.Backoff = o.Backoff
+	}
+	if o.MaxAckPending != 0 {
+		c.MaxAckPending = o.MaxAckPending
+	}
+	if o.Deliver != "" || o.StartSeq > 0 || o.StartTime != "" {
+		c.Deliver, c.StartSeq, c.StartTime = o.Deliver, o.StartSeq, o.StartTime
+	}
+	return c
+}
+
+// checkMaxDeliver keeps the server from dropping a message before it is dead-lettered, the retries of
+// broker.retry are the redeliveries nak-ed by the handlers, so maxDeliver must leave one more delivery
+// than maxAttempts for the ack timeouts and the dead letter errors
+func (n *natsBroker) checkMaxDeliver(maxAttempts int) error {
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	groups := []string{""}
+	for group := range n.jsOpts.Consumers {
+		groups = append(groups, group)
+	}
+	for _, group := range groups {
+		if c := n.consumerConf(group); c.MaxDeliver > 0 && c.MaxDeliver <= maxAttempts {
+			return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("jetstream maxDeliver %d of consumer '%s' must be greater than broker.retry.maxAttempts %d",
+				c.MaxDeliver, group, maxAttempts))
+		}
+	}
+	return nil
+}
+
+func (c ConsumerConf) subOpts(durable bool) ([]nats.SubOpt, error) {
+	opts := []nats.SubOpt{nats.ManualAck(), nats.AckExplicit()}
+	if c.AckWait > 0 {
+		opts = append(opts, nats.AckWait(time.Duration(c.AckWait)*time.Second))
+	}
+	if c.MaxDeliver != 0 {
+		opts = append(opts, nats.MaxDeliver(c.MaxDeliver))
+	}
+	if len(c.Backoff) > 0 {
+		backoff := make([]time.Duration, len(c.Backoff))
+		for i, b := range c.Backoff {
+			backoff[i] = time.Duration(b) * time.Second
+		}
+		opts = append(opts, nats.BackOff(backoff))
+	}
+	if c.MaxAckPending != 0 {
+		opts = append(opts, nats.MaxAckPending(c.MaxAckPending))
+	}
+	deliver := strings.ToLower(c.Deliver)
+	if deliver == "" {
+		switch {
+		case c.StartSeq > 0:
+			deliver = DELIVER_SEQUENCE
+		case c.StartTime != "":
+			deliver = DELIVER_TIME
+		case !durable:
+			// a broadcast receiver only gets the messages sent since it is online, like the core nats
+			deliver = DELIVER_NEW
+		default:
+			deliver = DELIVER_ALL
+		}
+	}
+	switch deliver {
+	case DELIVER_ALL:
+		opts = append(opts, nats.DeliverAll())
+	case DELIVER_NEW:
+		opts = append(opts, nats.DeliverNew())
+	case DELIVER_LAST:
+		opts = append(opts, nats.DeliverLast())
+	case DELIVER_SEQUENCE:
+		opts = append(opts, nats.StartSequence(c.StartSeq))
+	case DELIVER_TIME:
+		t, err := time.Parse(time.RFC3339, c.StartTime)
+		if err != nil {
+			return nil, errs.Wrap(errs.ERRCODE_BROKER, "invalid consumer start time "+c.StartTime, err)
+		}
+		opts = append(opts, nats.StartTime(t))
+	default:
+		return nil, errs.New(errs.ERRCODE_BROKER, "unknown consumer deliver "+c.Deliver)
+	}
+	return opts, nil
+}
+
+// jsReceive subscribes a durable consumer shared by the group if once, or an ephemeral one of this instance
+func (n *natsBroker) jsReceive(once bool, topic, group string, handler broker.Handler) error {
+	opts, err := n.consumerConf(group).subOpts(once)
+	if err != nil {
+		return err
+	}
+	cb := n.jsHandler(topic, handler)
+	if once {
+		name := consumerName(group, topic)
+		_, err = n.js.QueueSubscribe(topic, name, cb, append(opts, nats.Durable(name))...)
+	} else {
+		_, err = n.js.Subscribe(topic, cb, opts...)
+	}
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("jetstream subscribe %s error", topic), err)
+	}
+	return nil
+}
+
+func (n *natsBroker) jsHandler(topic string, handler broker.Handler) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		msg, err := fromMsg(m)
+		if err != nil {
+			// a broken message is never handled successfully
+			logger.Error("jetstream message decode error", err, logger.Val{K: "topic", V: m.Subject})
+			m.Term()
+			return
+		}
+		if meta, err := m.Metadata(); err == nil {
+			msg.Head[broker.HEAD_DELIVERY_COUNT] = strconv.FormatUint(meta.NumDelivered, 10)
+		}
+		a := &jsAcker{m: m, topic: topic, autoAck: !n.jsOpts.ManualAck}
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("jetstream handler panic", nil, logger.Val{K: "topic", V: topic}, logger.Val{K: "error", V: r})
+				if !a.settled.Load() {
+					a.Nak(0)
+				}
+				return
+			}
+			if !a.detached.Load() {
+				a.settle()
+			}
+		}()
+		handler(msg.WithAcker(a))
+	}
+}
+
+// jsSend sets the message id, so a message sent again within the duplicates window of the stream,
+// like by the outbox relay or the delay scheduler after a lost ack, is stored once
+func (n *natsBroker) jsSend(topic string, msg broker.Message) error {
+	var opts []nats.PubOpt
+	if id := msg.Head[broker.HEAD_MESSAGE_ID]; id != "" {
+		opts = append(opts, nats.MsgId(id))
+	}
+	if _, err := n.js.PublishMsg(newMsg(topic, msg), opts...); err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("jetstream publish %s error", topic), err)
+	}
+	return nil
+}
+
+// consumerName is the durable name of the group on the topic, durable names can't contain the subject tokens.
+// The bytes other than letters and digits are escaped as _XX in hex and the group and topic are joined by -,
+// so the names of different groups or topics never collide, like order.created with order_created
+func consumerName(group, topic string) string {
+	return escapeName(group) + "-" + escapeName(topic)
+}
+
+func escapeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type jsAcker struct {
+	m        *nats.Msg
+	topic    string
+	autoAck  bool
+	settled  atomic.Bool
+	detached atomic.Bool
+}
+
+// Detach lets the workers of the consumer pipeline settle the message after the callback returns
+func (a *jsAcker) Detach() func() {
+	a.detached.Store(true)
+	return a.settle
+}
+
+// settle acks the message not settled by the handler unless manualAck
+func (a *jsAcker) settle() {
+	if a.autoAck && !a.settled.Load() {
+		if err := a.Ack(); err != nil {
+			logger.Error("jetstream ack error", err, logger.Val{K: "topic", V: a.topic})
+		}
+	}
+}
+
+func (a *jsAcker) Ack() error {
+	a.settled.Store(true)
+	return a.m.Ack()
+}
+
+func (a *jsAcker) Nak(delay time.Duration) error {
+	a.settled.Store(true)
+	if delay > 0 {
+		return a.m.NakWithDelay(delay)
+	}
+	return a.m.Nak()
+}
+
+func (a *jsAcker) Term() error {
+	a.settled.Store(true)
+	return a.m.Term()
+}
+
+func (a *jsAcker) InProgress() error {
+	return a.m.InProgress()
+}
@@ -0,0 +1,207 @@
+package nats
+
+import (
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/nats-io/nats.go"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamConfig(t *testing.T) {
+	cfg, err := StreamConf{Name: "ORDERS", Subjects: []string{"order.>"}, Storage: "memory",
+		Retention: "workqueue", MaxAge: 3600}.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage != nats.MemoryStorage || cfg.Retention != nats.WorkQueuePolicy ||
+		cfg.MaxAge != time.Hour || cfg.MaxMsgs != -1 {
+		t.Fatalf("stream config %+v", cfg)
+	}
+	if _, err = (StreamConf{Name: "ORDERS", Storage: "disk"}).config(); err == nil {
+		t.Fatal("unknown storage accepted")
+	}
+}
+
+func TestConsumerConf(t *testing.T) {
+	n := &natsBroker{jsOpts: JetStreamOptions{
+		Consumer: ConsumerConf{AckWait: 30, MaxDeliver: 5, Backoff: []int64{1, 5}},
+		Consumers: map[string]ConsumerConf{
+			"billing": {MaxDeliver: 10, StartTime: "2024-01-01T00:00:00Z"},
+		},
+	}}
+	c := n.consumerConf("billing")
+	if c.AckWait != 30 || c.MaxDeliver != 10 || len(c.Backoff) != 2 || c.StartTime == "" {
+		t.Fatalf("merged consumer config %+v", c)
+	}
+	if _, err := c.subOpts(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (ConsumerConf{Deliver: DELIVER_TIME, StartTime: "yesterday"}).subOpts(true); err == nil {
+		t.Fatal("invalid start time accepted")
+	}
+	if _, err := (ConsumerConf{Deliver: "first"}).subOpts(false); err == nil {
+		t.Fatal("unknown deliver accepted")
+	}
+	if name := consumerName("billing", "order.*.>"); name != "billing-order_2E_2A_2E_3E" {
+		t.Fatalf("consumer name %s", name)
+	}
+	names := make(map[string]bool)
+	for _, c := range [][2]string{{"billing", "order.created"}, {"billing", "order_created"}, {"billing", "order.*"},
+		{"billing", "order.any"}, {"billing_order", "created"}, {"billing", "order-created"}, {"billing-order", "created"}} {
+		name := consumerName(c[0], c[1])
+		if names[name] {
+			t.Errorf("consumer name %s of %v collides", name, c)
+		}
+		names[name] = true
+	}
+}
+
+func TestCheckMaxDeliver(t *testing.T) {
+	n := &natsBroker{jsOpts: JetStreamOptions{
+		Consumer:  ConsumerConf{MaxDeliver: 5},
+		Consumers: map[string]ConsumerConf{"billing": {MaxDeliver: 3}},
+	}}
+	if err := n.checkMaxDeliver(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.checkMaxDeliver(3); err == nil {
+		t.Fatal("maxDeliver of billing not greater than maxAttempts accepted")
+	}
+	n.jsOpts.Consumer.MaxDeliver = -1
+	n.jsOpts.Consumers = nil
+	if err := n.checkMaxDeliver(10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", "localhost:4222", time.Second)
+	if err != nil {
+		t.Skip("no nats server on localhost:4222")
+	}
+	conn.Close()
+	nc, err := nats.Connect("nats://localhost:4222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.AccountInfo(); err != nil {
+		t.Skip("jetstream not enabled on localhost:4222")
+	}
+	stream := fmt.Sprintf("MICROJ_TEST_%d", time.Now().UnixNano())
+	prefix := strings.ToLower(stream)
+	if _, err = js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{prefix + ".>"},
+		Storage: nats.MemoryStorage, Duplicates: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	defer js.DeleteStream(stream)
+	n := &natsBroker{conn: nc, js: js, jsOpts: JetStreamOptions{Enable: true}}
+	pending := func(topic, group string) int {
+		ci, err := js.ConsumerInfo(stream, consumerName(group, topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ci.NumAckPending
+	}
+
+	// a message sent again with the same id is stored once
+	topic := prefix + ".dedup"
+	for i := 0; i < 2; i++ {
+		msg := broker.Message{Head: map[string]string{broker.HEAD_MESSAGE_ID: "m-1"}, Body: []byte("hello")}
+		if err = n.jsSend(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := js.StreamInfo(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Fatalf("stored %d messages with the same id", info.State.Msgs)
+	}
+
+	// nak-ed once the handler panics, acked once it returns
+	topic = prefix + ".panic"
+	deliveries := make(chan string, 2)
+	if err = n.jsReceive(true, topic, "test", func(msg broker.Message) {
+		deliveries <- msg.Head[broker.HEAD_DELIVERY_COUNT]
+		if msg.Head[broker.HEAD_DELIVERY_COUNT] == "1" {
+			panic("handler failed")
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.jsSend(topic, broker.Message{Head: map[string]string{}, Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2"} {
+		select {
+		case got := <-deliveries:
+			if got != want {
+				t.Fatalf("delivery %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivery %s not received", want)
+		}
+	}
+	waitFor(t, "message not acked after the handler returned", func() bool {
+		return pending(topic, "test") == 0
+	})
+
+	// the workers of the consumer pipeline settle the detached message once it is handled
+	initBroker := broker.InvokeInitBroker
+	defer func() {
+		broker.InvokeInitBroker = initBroker
+	}()
+	broker.InvokeInitBroker = func(opts broker.Options) (broker.Broker, error) {
+		b, err := newBroker(opts)
+		if err != nil {
+			return nil, err
+		}
+		b.(*natsBroker).jsOpts = JetStreamOptions{Enable: true}
+		return b, nil
+	}
+	broker.Init(broker.Options{Enable: true, Addr: "localhost:4222"})
+	defer broker.Disconnect()
+	topic = prefix + ".detach"
+	handling, release := make(chan bool, 1), make(chan bool)
+	if err = broker.Recv(true, topic, "test", func(msg broker.Message) {
+		handling <- true
+		<-release
+	}, broker.WithConcurrency(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = broker.Send(topic, broker.Message{Head: map[string]string{}, Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("detached message not handled")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pending(topic, "test") != 1 {
+		t.Fatal("detached message acked before it was handled")
+	}
+	close(release)
+	waitFor(t, "detached message not acked after it was handled", func() bool {
+		return pending(topic, "test") == 0
+	})
+}
@@ -0,0 +1,43 @@
+package nats
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/nats-io/nats.go"
+)
+
+// legacyPrefix starts the json envelope of the messages sent by the json encoder of the former versions
+var legacyPrefix = []byte(`{"head":`)
+
+// newMsg sends the head as the nats headers and the body as is, the servers before 2.2 without headers
+// are not supported
+func newMsg(topic string, msg broker.Message) *nats.Msg {
+	m := nats.NewMsg(topic)
+	for k, v := range msg.Head {
+		m.Header.Set(k, v)
+	}
+	m.Data = msg.Body
+	return m
+}
+
+// fromMsg also decodes the json envelope sent by the former versions during a rolling upgrade
+func fromMsg(m *nats.Msg) (broker.Message, error) {
+	if len(m.Header) == 0 && bytes.HasPrefix(m.Data, legacyPrefix) {
+		var msg broker.Message
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			return broker.Message{}, err
+		}
+		if msg.Head == nil {
+			msg.Head = make(map[string]string)
+		}
+		return msg, nil
+	}
+	msg := broker.Message{Head: make(map[string]string, len(m.Header)), Body: m.Data}
+	for k, v := range m.Header {
+		if len(v) > 0 {
+			msg.Head[k] = v[0]
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,26 @@
+package nats
+
+import (
+	"encoding/json"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/nats-io/nats.go"
+	"testing"
+)
+
+func TestMsg(t *testing.T) {
+	m := newMsg("order.created", broker.Message{Head: map[string]string{"content-type": "application/json"}, Body: []byte(`{"id":1}`)})
+	msg, err := fromMsg(m)
+	if err != nil || msg.Head["content-type"] != "application/json" || string(msg.Body) != `{"id":1}` {
+		t.Fatalf("message %s, error %v", msg, err)
+	}
+
+	data, _ := json.Marshal(broker.Message{Head: map[string]string{"k": "v"}, Body: []byte("1")})
+	msg, err = fromMsg(&nats.Msg{Subject: "order.created", Data: data})
+	if err != nil || msg.Head["k"] != "v" || string(msg.Body) != "1" {
+		t.Fatalf("legacy message %s, error %v", msg, err)
+	}
+	msg, err = fromMsg(&nats.Msg{Subject: "order.created", Data: []byte("raw")})
+	if err != nil || msg.Head == nil || string(msg.Body) != "raw" {
+		t.Fatalf("raw message %s, error %v", msg, err)
+	}
+}
@@ -3,6 +3,7 @@ package nats
 import (
 	"fmt"
 	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
 	"github.com/billyyoyo/microj/errs"
 	"github.com/billyyoyo/microj/logger"
 	"github.com/nats-io/nats.go"
@@ -13,12 +14,16 @@ import (
 
 type natsBroker struct {
 	conn          *nats.Conn
-	client        *nats.EncodedConn
 	addr          string
 	user          string
 	pwd           string
 	topicHandlers []topicHandler
 	lock          sync.Mutex
+	closed        chan bool
+	// ready is closed once Connect returns, the connect callback waits for the jetstream context and streams
+	ready  chan bool
+	js     nats.JetStreamContext
+	jsOpts JetStreamOptions
 }
 type topicHandler struct {
 	once    bool
@@ -37,7 +42,18 @@ func newBroker(opts broker.Options) (broker.Broker, error) {
 			addr:   opts.Addr,
 			user:   opts.User,
 			pwd:    opts.Pwd,
-			client: nil,
+			closed: make(chan bool),
+			ready:  make(chan bool),
+		}
+		if config.IsSet("broker.jetstream") {
+			if err := config.Scan("broker.jetstream", &b.jsOpts); err != nil {
+				return nil, errs.Wrap(errs.ERRCODE_BROKER, "jetstream config error", err)
+			}
+		}
+		if b.jsOpts.Enable {
+			if err := b.checkMaxDeliver(opts.Retry.MaxAttempts); err != nil {
+				return nil, err
+			}
 		}
 		return b, nil
 	}
@@ -57,6 +73,7 @@ func (n *natsBroker) Init(opts broker.Options) error {
 }
 
 func (n *natsBroker) Connect() error {
+	defer close(n.ready)
 	var options []nats.Option
 	if n.user != "" && n.pwd != "" {
 		options = append(options, nats.UserInfo(n.user, n.pwd))
@@ -75,19 +92,35 @@ func (n *natsBroker) Connect() error {
 	if err != nil {
 		return errs.Wrap(errs.ERRCODE_BROKER, err.Error(), err)
 	}
-	n.client, err = nats.NewEncodedConn(n.conn, nats.JSON_ENCODER)
-	if err != nil {
-		return errs.Wrap(errs.ERRCODE_BROKER, err.Error(), err)
+	if n.jsOpts.Enable {
+		if n.js, err = n.conn.JetStream(); err != nil {
+			return errs.Wrap(errs.ERRCODE_BROKER, err.Error(), err)
+		}
+		// the streams are ready before any send or receive
+		if err = n.setupStreams(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Disconnect drains the subscriptions so in-flight messages are handled, then waits for the connection closed
 func (n *natsBroker) Disconnect() error {
-	n.client.Drain()
-	n.client.Close()
+	if n.conn == nil {
+		return nil
+	}
+	if err := n.conn.Drain(); err != nil {
+		n.conn.Close()
+		return errs.Wrap(errs.ERRCODE_BROKER, err.Error(), err)
+	}
+	<-n.closed
 	return nil
 }
 
+func (n *natsBroker) IsConnected() bool {
+	return n.conn != nil && n.conn.IsConnected()
+}
+
 func (n *natsBroker) Receive(once bool, topic, group string, handler broker.Handler) error {
 	if n.conn.IsConnected() {
 		return n.receive(once, topic, group, handler)
@@ -106,10 +139,12 @@ func (n *natsBroker) receive(once bool, topic, group string, handler broker.Hand
 	n.lock.Lock()
 	defer n.lock.Unlock()
 	var err error
-	if once {
-		_, err = n.client.QueueSubscribe(topic, group, handler)
+	if n.js != nil {
+		err = n.jsReceive(once, topic, group, handler)
+	} else if once {
+		_, err = n.conn.QueueSubscribe(topic, group, msgHandler(handler))
 	} else {
-		_, err = n.client.Subscribe(topic, handler)
+		_, err = n.conn.Subscribe(topic, msgHandler(handler))
 	}
 	if err != nil {
 		logger.Error(fmt.Sprintf("%s listen topic %s failed", group, topic), err)
@@ -120,8 +155,24 @@ func (n *natsBroker) receive(once bool, topic, group string, handler broker.Hand
 }
 
 func (n *natsBroker) Send(topic string, msg broker.Message) error {
-	err := n.client.Publish(topic, msg)
-	return errs.Wrap(errs.ERRCODE_BROKER, err.Error(), err)
+	if n.js != nil {
+		return n.jsSend(topic, msg)
+	}
+	if err := n.conn.PublishMsg(newMsg(topic, msg)); err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, err.Error(), err)
+	}
+	return nil
+}
+
+func msgHandler(handler broker.Handler) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		msg, err := fromMsg(m)
+		if err != nil {
+			logger.Error("nats message decode error", err, logger.Val{K: "topic", V: m.Subject})
+			return
+		}
+		handler(msg)
+	}
 }
 
 func (n *natsBroker) onDisconnectError(nc *nats.Conn, err error) {
@@ -134,9 +185,11 @@ func (n *natsBroker) onReconnect(nc *nats.Conn) {
 
 func (n *natsBroker) onClose(nc *nats.Conn) {
 	logger.Info("nats client closed ")
+	close(n.closed)
 }
 
 func (n *natsBroker) onConnect(nc *nats.Conn) {
+	<-n.ready
 	nc.RTT()
 	logger.Info("nats client connect success ")
 	for i := 0; i < len(n.topicHandlers); i++ {
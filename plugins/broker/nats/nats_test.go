@@ -0,0 +1,42 @@
+package nats
+
+import (
+	"github.com/billyyoyo/microj/broker"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNats(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", "localhost:4222", time.Second)
+	if err != nil {
+		t.Skip("no nats server on localhost:4222")
+	}
+	conn.Close()
+	broker.Init(broker.Options{Enable: true, Addr: "localhost:4222"})
+	defer broker.Disconnect()
+	if !broker.Connected() {
+		t.Fatal("nats broker not connected")
+	}
+	got := make(chan broker.Message, 1)
+	if err := broker.Recv(false, "test.roundtrip", "nats", func(msg broker.Message) {
+		select {
+		case got <- msg:
+		default:
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	body := time.Now().Format(time.RFC3339Nano)
+	if err := broker.Send("test.roundtrip", broker.Message{Head: map[string]string{"token": "1111"}, Body: []byte(body)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-got:
+		if string(msg.Body) != body || msg.Head["token"] != "1111" {
+			t.Fatalf("received %v %s", msg.Head, msg.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
@@ -0,0 +1,52 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/nats-io/nats.go"
+)
+
+// Request uses the inbox of the core nats connection, also in jetstream mode, where the topic must not be
+// captured by a stream whose publish ack would be taken as the reply. A topic without subscribers fails
+// at once with ERRCODE_BROKER instead of waiting for the timeout
+func (n *natsBroker) Request(ctx context.Context, topic string, msg broker.Message) (broker.Message, error) {
+	m, err := n.conn.RequestMsgWithContext(ctx, newMsg(topic, msg))
+	if err != nil {
+		if err == nats.ErrNoResponders {
+			return broker.Message{}, errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("no responders of %s", topic))
+		}
+		return broker.Message{}, err
+	}
+	reply, err := fromMsg(m)
+	if err != nil {
+		return broker.Message{}, errs.Wrap(errs.ERRCODE_BROKER, "reply decode error", err)
+	}
+	return reply, nil
+}
+
+func (n *natsBroker) Respond(topic, group string, handler func(msg broker.Message) broker.Message) error {
+	cb := func(m *nats.Msg) {
+		msg, err := fromMsg(m)
+		if err != nil {
+			logger.Error("request decode error", err, logger.Val{K: "topic", V: topic})
+			return
+		}
+		if err = m.RespondMsg(newMsg(m.Reply, handler(msg))); err != nil {
+			logger.Error("reply error", err, logger.Val{K: "topic", V: topic})
+		}
+	}
+	var err error
+	if group != "" {
+		_, err = n.conn.QueueSubscribe(topic, group, cb)
+	} else {
+		_, err = n.conn.Subscribe(topic, cb)
+	}
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("respond topic %s error", topic), err)
+	}
+	logger.Info(fmt.Sprintf("%s respond topic %s success", group, topic))
+	return nil
+}
@@ -0,0 +1,553 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/db"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	goredis "github.com/go-redis/redis/v8"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OFFSET_FIRST = "first"
+	OFFSET_LAST  = "last"
+
+	FIELD_HEAD = "head"
+	FIELD_BODY = "body"
+
+	defaultPrefix        = "stream:"
+	defaultBlock         = 1000
+	defaultCount         = 10
+	defaultClaimIdle     = 60000
+	defaultClaimInterval = 30000
+	readErrorWait        = time.Second
+)
+
+// Options of the redis broker are read from broker.redis, the client of db.InitRedis is shared
+type Options struct {
+	// Prefix of the stream keys, the stream of order.created is stream:order.created by default
+	Prefix string `yaml:"prefix"`
+	// MaxLen trims the stream by XADD MAXLEN, 0 keeps all entries
+	MaxLen int64 `yaml:"maxLen"`
+	// MaxAge in second trims the older entries by XADD MINID, it requires redis 6.2
+	MaxAge int64 `yaml:"maxAge"`
+	// ExactTrim trims by =, otherwise by ~ which is much cheaper and keeps a few more entries
+	ExactTrim bool `yaml:"exactTrim"`
+	// StartOffset of a new group: first or last, first by default
+	StartOffset string `yaml:"startOffset"`
+	// Block of XREAD and XREADGROUP in millisecond, Disconnect waits for it at most
+	Block int64 `yaml:"block"`
+	Count int64 `yaml:"count"`
+	// ClaimIdle in millisecond, the pending entries idle longer are claimed from the crashed consumers
+	// by XAUTOCLAIM, it must be longer than handling a message and the retry delays
+	ClaimIdle int64 `yaml:"claimIdle"`
+	// ClaimInterval of XAUTOCLAIM in millisecond
+	ClaimInterval int64 `yaml:"claimInterval"`
+	// Instance is the consumer name of this instance in the groups, the hostname by default. It must be
+	// stable across the restarts and unique among the running instances. The consumers of the stopped
+	// instances are deleted once their pending entries are claimed
+	Instance string `yaml:"instance"`
+}
+
+// redisBroker maps Receive once onto the consumer group of the group by XREADGROUP, and the broadcast onto
+// XREAD of the new entries. The entries of a group are acked once settled, the ones left pending by a crash
+// or a panic are claimed by the other consumers of the group after ClaimIdle
+type redisBroker struct {
+	opts      Options
+	client    goredis.UniversalClient
+	consumer  string
+	subs      []*subscription
+	lock      sync.Mutex
+	connected atomic.Bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+type subscription struct {
+	once    bool
+	topic   string
+	stream  string
+	group   string
+	handler broker.Handler
+}
+
+func init() {
+	broker.InvokeInitBroker = newBroker
+}
+
+func newBroker(opts broker.Options) (broker.Broker, error) {
+	if !opts.Enable {
+		return nil, nil
+	}
+	var o Options
+	if config.IsSet("broker.redis") {
+		if err := config.Scan("broker.redis", &o); err != nil {
+			return nil, errs.Wrap(errs.ERRCODE_BROKER, "redis broker config error", err)
+		}
+	}
+	db.InitRedis()
+	client, ok := db.Redis().(goredis.UniversalClient)
+	if !ok {
+		return nil, errs.New(errs.ERRCODE_BROKER, "redis broker requires the client of db.InitRedis")
+	}
+	return New(client, o), nil
+}
+
+// New returns a redis broker on the client, it is used directly by the tests without the config
+func New(client goredis.UniversalClient, opts Options) broker.Broker {
+	if opts.Prefix == "" {
+		opts.Prefix = defaultPrefix
+	}
+	if opts.Block <= 0 {
+		opts.Block = defaultBlock
+	}
+	if opts.Count <= 0 {
+		opts.Count = defaultCount
+	}
+	if opts.ClaimIdle <= 0 {
+		opts.ClaimIdle = defaultClaimIdle
+	}
+	if opts.ClaimInterval <= 0 {
+		opts.ClaimInterval = defaultClaimInterval
+	}
+	return &redisBroker{
+		opts:     opts,
+		client:   client,
+		consumer: instanceID(opts),
+	}
+}
+
+// instanceID names the consumer by Instance, else the hostname, else a random id
+func instanceID(o Options) string {
+	if o.Instance != "" {
+		return o.Instance
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	logger.Warn("no redis instance or hostname, the consumer is not reused after restart")
+	return logger.NewRequestID()[:12]
+}
+
+func (r *redisBroker) Init(opts broker.Options) error {
+	return nil
+}
+
+func (r *redisBroker) Connect() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.connected.Load() {
+		return nil
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, s := range r.subs {
+		if err := r.start(s); err != nil {
+			r.cancel()
+			return err
+		}
+	}
+	r.connected.Store(true)
+	logger.Info("redis broker connected, consumer ", r.consumer)
+	return nil
+}
+
+// Disconnect waits for the handling messages, the client is closed by db
+func (r *redisBroker) Disconnect() error {
+	r.lock.Lock()
+	if !r.connected.Load() {
+		r.lock.Unlock()
+		return nil
+	}
+	r.connected.Store(false)
+	r.cancel()
+	r.lock.Unlock()
+	r.wg.Wait()
+	return nil
+}
+
+func (r *redisBroker) IsConnected() bool {
+	return r.connected.Load()
+}
+
+func (r *redisBroker) Receive(once bool, topic, group string, handler broker.Handler) error {
+	if topic == "" || strings.ContainsAny(topic, "*>") {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("invalid redis topic %s, wildcards are not supported", topic))
+	}
+	if once && group == "" {
+		return errs.New(errs.ERRCODE_BROKER, fmt.Sprintf("no group of topic %s", topic))
+	}
+	s := &subscription{
+		once:    once,
+		topic:   topic,
+		stream:  r.opts.Prefix + topic,
+		group:   group,
+		handler: handler,
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.connected.Load() {
+		if err := r.start(s); err != nil {
+			return err
+		}
+	}
+	r.subs = append(r.subs, s)
+	logger.Info(fmt.Sprintf("%s listen topic %s success", group, topic))
+	return nil
+}
+
+// Send appends the message by XADD and trims the stream by MaxLen or MaxAge
+func (r *redisBroker) Send(topic string, msg broker.Message) error {
+	head, err := json.Marshal(msg.Head)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, "message head encode error", err)
+	}
+	args := &goredis.XAddArgs{
+		Stream: r.opts.Prefix + topic,
+		Values: []interface{}{FIELD_HEAD, head, FIELD_BODY, msg.Body},
+		Approx: !r.opts.ExactTrim,
+	}
+	if r.opts.MaxLen > 0 {
+		args.MaxLen = r.opts.MaxLen
+	} else if r.opts.MaxAge > 0 {
+		args.MinID = strconv.FormatInt(time.Now().Add(-time.Duration(r.opts.MaxAge)*time.Second).UnixMilli(), 10)
+	}
+	if err = r.client.XAdd(context.Background(), args).Err(); err != nil {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("redis send %s error", topic), err)
+	}
+	return nil
+}
+
+func (r *redisBroker) start(s *subscription) error {
+	if !s.once {
+		last, err := r.lastID(s)
+		if err != nil {
+			return err
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.read(s, last)
+		}()
+		return nil
+	}
+	start := "0"
+	if strings.ToLower(r.opts.StartOffset) == OFFSET_LAST {
+		start = "$"
+	}
+	err := r.client.XGroupCreateMkStream(r.ctx, s.stream, s.group, start).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("redis group %s of %s create error", s.group, s.topic), err)
+	}
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		r.readGroup(s)
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.claim(s)
+	}()
+	return nil
+}
+
+// lastID is where the broadcast starts, "$" of XREAD would miss the entries added between the reads
+func (r *redisBroker) lastID(s *subscription) (string, error) {
+	msgs, err := r.client.XRevRangeN(r.ctx, s.stream, "+", "-", 1).Result()
+	if err != nil {
+		return "", errs.Wrap(errs.ERRCODE_BROKER, fmt.Sprintf("redis stream %s read error", s.stream), err)
+	}
+	if len(msgs) == 0 {
+		return "0-0", nil
+	}
+	return msgs[0].ID, nil
+}
+
+// read delivers the entries added since the subscription to every instance
+func (r *redisBroker) read(s *subscription, last string) {
+	for r.ctx.Err() == nil {
+		streams, err := r.client.XRead(r.ctx, &goredis.XReadArgs{
+			Streams: []string{s.stream, last},
+			Count:   r.opts.Count,
+			Block:   time.Duration(r.opts.Block) * time.Millisecond,
+		}).Result()
+		if err != nil {
+			if err != goredis.Nil && !r.wait(s, err) {
+				return
+			}
+			continue
+		}
+		for _, st := range streams {
+			for _, m := range st.Messages {
+				last = m.ID
+				r.safeHandle(s, message(m, 1))
+			}
+		}
+	}
+}
+
+func (r *redisBroker) readGroup(s *subscription) {
+	for r.ctx.Err() == nil {
+		streams, err := r.client.XReadGroup(r.ctx, &goredis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: r.consumer,
+			Streams:  []string{s.stream, ">"},
+			Count:    r.opts.Count,
+			Block:    time.Duration(r.opts.Block) * time.Millisecond,
+		}).Result()
+		if err != nil {
+			if err != goredis.Nil && !r.wait(s, err) {
+				return
+			}
+			continue
+		}
+		for _, st := range streams {
+			for _, m := range st.Messages {
+				r.handle(s, m, 1)
+			}
+		}
+	}
+}
+
+// claim takes over the entries of the group idle longer than ClaimIdle, left by the crashed consumers
+func (r *redisBroker) claim(s *subscription) {
+	ticker := time.NewTicker(time.Duration(r.opts.ClaimInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for start := "0-0"; ; {
+			next, msgs, err := r.autoClaim(s, start)
+			if err != nil {
+				if r.ctx.Err() == nil {
+					logger.Error("redis autoclaim error", err, logger.Val{K: "topic", V: s.topic}, logger.Val{K: "group", V: s.group})
+				}
+				break
+			}
+			counts := r.deliveryCounts(s, msgs)
+			for _, m := range msgs {
+				logger.Warnf("redis message %s of %s claimed by %s", m.ID, s.topic, r.consumer)
+				r.handle(s, m, counts[m.ID])
+			}
+			if next == "0-0" || next == "" || r.ctx.Err() != nil {
+				break
+			}
+			start = next
+		}
+		r.deleteConsumers(s)
+	}
+}
+
+// deleteConsumers removes the consumers idle longer than ClaimIdle without pending entries, which are
+// left by the stopped instances. A running consumer reads every Block, and is added back by its next read
+func (r *redisBroker) deleteConsumers(s *subscription) {
+	reply, err := r.client.Do(r.ctx, "XINFO", "CONSUMERS", s.stream, s.group).Slice()
+	if err != nil {
+		if r.ctx.Err() == nil {
+			logger.Error("redis consumers info error", err, logger.Val{K: "topic", V: s.topic}, logger.Val{K: "group", V: s.group})
+		}
+		return
+	}
+	for _, name := range idleConsumers(reply, r.consumer, r.opts.ClaimIdle) {
+		if err = r.client.XGroupDelConsumer(r.ctx, s.stream, s.group, name).Err(); err != nil {
+			logger.Error("redis consumer delete error", err, logger.Val{K: "topic", V: s.topic}, logger.Val{K: "consumer", V: name})
+			continue
+		}
+		logger.Infof("redis consumer %s of %s in %s deleted", name, s.topic, s.group)
+	}
+}
+
+// idleConsumers selects from the XINFO CONSUMERS reply the consumers other than self without pending
+// entries and idle at least claimIdle. The reply is parsed here since redis 7.2 adds the inactive field
+// which the client doesn't expect, an unknown idle of -1 is never selected
+func idleConsumers(reply []interface{}, self string, claimIdle int64) []string {
+	var names []string
+	for _, c := range reply {
+		fields, _ := c.([]interface{})
+		var name string
+		var pending, idle int64
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch k, _ := fields[i].(string); k {
+			case "name":
+				name, _ = fields[i+1].(string)
+			case "pending":
+				pending, _ = fields[i+1].(int64)
+			case "idle":
+				idle, _ = fields[i+1].(int64)
+			}
+		}
+		if name == "" || name == self || pending > 0 || idle < 0 || idle < claimIdle {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// autoClaim parses the reply itself, since the reply of redis 7 has the deleted ids as the third element
+func (r *redisBroker) autoClaim(s *subscription, start string) (string, []goredis.XMessage, error) {
+	reply, err := r.client.Do(r.ctx, "XAUTOCLAIM", s.stream, s.group, r.consumer,
+		r.opts.ClaimIdle, start, "COUNT", r.opts.Count).Slice()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) < 2 {
+		return "", nil, fmt.Errorf("unexpected xautoclaim reply %v", reply)
+	}
+	next, _ := reply[0].(string)
+	entries, _ := reply[1].([]interface{})
+	msgs := make([]goredis.XMessage, 0, len(entries))
+	for _, e := range entries {
+		// a deleted entry is nil in the reply of redis 6.2
+		entry, ok := e.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		m := goredis.XMessage{Values: make(map[string]interface{})}
+		m.ID, _ = entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if k, ok := fields[i].(string); ok {
+				m.Values[k] = fields[i+1]
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return next, msgs, nil
+}
+
+// deliveryCounts reads the counts increased by XAUTOCLAIM, 2 is taken if they are unknown
+func (r *redisBroker) deliveryCounts(s *subscription, msgs []goredis.XMessage) map[string]int {
+	counts := make(map[string]int, len(msgs))
+	for _, m := range msgs {
+		counts[m.ID] = 2
+	}
+	if len(msgs) == 0 {
+		return counts
+	}
+	pending, err := r.client.XPendingExt(r.ctx, &goredis.XPendingExtArgs{
+		Stream:   s.stream,
+		Group:    s.group,
+		Start:    msgs[0].ID,
+		End:      msgs[len(msgs)-1].ID,
+		Count:    int64(len(msgs)),
+		Consumer: r.consumer,
+	}).Result()
+	if err != nil {
+		return counts
+	}
+	for _, p := range pending {
+		if _, ok := counts[p.ID]; ok {
+			counts[p.ID] = int(p.RetryCount)
+		}
+	}
+	return counts
+}
+
+// handle acks the entry once settled, a nak-ed entry is redelivered in place after the delay while it stays pending.
+// The entry is left pending if the handler panics or the broker is disconnecting, and claimed after ClaimIdle
+func (r *redisBroker) handle(s *subscription, m goredis.XMessage, count int) {
+	for ; ; count++ {
+		a := &acker{}
+		if !r.safeHandle(s, message(m, count).WithAcker(a)) {
+			return
+		}
+		if !a.nak {
+			break
+		}
+		select {
+		case <-time.After(a.delay):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.opts.Block)*time.Millisecond+time.Second)
+	defer cancel()
+	if err := r.client.XAck(ctx, s.stream, s.group, m.ID).Err(); err != nil {
+		// claimed and handled again after ClaimIdle, the handlers must be idempotent
+		logger.Error("redis ack error", err, logger.Val{K: "topic", V: s.topic}, logger.Val{K: "id", V: m.ID})
+	}
+}
+
+// safeHandle returns false if the handler panics
+func (r *redisBroker) safeHandle(s *subscription, msg broker.Message) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.Error("redis handler panic", nil,
+				logger.Val{K: "topic", V: s.topic},
+				logger.Val{K: "group", V: s.group},
+				logger.Val{K: "error", V: e})
+		}
+	}()
+	s.handler(msg)
+	return true
+}
+
+// wait backs off after a read error, it returns false once the broker is disconnecting
+func (r *redisBroker) wait(s *subscription, err error) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	logger.Error("redis read error", err, logger.Val{K: "topic", V: s.topic}, logger.Val{K: "group", V: s.group})
+	select {
+	case <-time.After(readErrorWait):
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+func message(m goredis.XMessage, count int) broker.Message {
+	msg := broker.Message{Head: make(map[string]string)}
+	if h, ok := m.Values[FIELD_HEAD].(string); ok && h != "" {
+		if err := json.Unmarshal([]byte(h), &msg.Head); err != nil {
+			logger.Error("redis message head decode error", err, logger.Val{K: "id", V: m.ID})
+		}
+		if msg.Head == nil {
+			msg.Head = make(map[string]string)
+		}
+	}
+	if b, ok := m.Values[FIELD_BODY].(string); ok {
+		msg.Body = []byte(b)
+	}
+	msg.Head[broker.HEAD_DELIVERY_COUNT] = strconv.Itoa(count)
+	return msg
+}
+
+// acker acks the entry once the handler returns unless it is nak-ed, Term acks it as well
+type acker struct {
+	nak   bool
+	delay time.Duration
+}
+
+func (a *acker) Ack() error {
+	a.nak = false
+	return nil
+}
+
+func (a *acker) Nak(delay time.Duration) error {
+	a.nak, a.delay = true, delay
+	return nil
+}
+
+func (a *acker) Term() error {
+	a.nak = false
+	return nil
+}
+
+func (a *acker) InProgress() error {
+	return nil
+}
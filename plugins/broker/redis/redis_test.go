@@ -0,0 +1,162 @@
+package redis
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/billyyoyo/microj/broker"
+	"github.com/billyyoyo/microj/logger"
+	goredis "github.com/go-redis/redis/v8"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBroker(t *testing.T, s *miniredis.Miniredis, opts Options) *redisBroker {
+	client := goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { client.Close() })
+	if opts.Block == 0 {
+		opts.Block = 50
+	}
+	if opts.Instance == "" {
+		opts.Instance = logger.NewRequestID()[:12]
+	}
+	return New(client, opts).(*redisBroker)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	s := miniredis.RunT(t)
+	b := newTestBroker(t, s, Options{})
+	got := make(chan broker.Message, 1)
+	b.Receive(true, "order.created", "billing", func(msg broker.Message) {
+		got <- msg
+	})
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	if err := b.Send("order.created", broker.Message{Head: map[string]string{"k": "v"}, Body: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-got
+	if string(msg.Body) != "1" || msg.Head["k"] != "v" || msg.Head[broker.HEAD_DELIVERY_COUNT] != "1" {
+		t.Fatalf("received %s", msg)
+	}
+	waitFor(t, func() bool {
+		p, err := b.client.XPending(context.Background(), "stream:order.created", "billing").Result()
+		return err == nil && p.Count == 0
+	})
+}
+
+func TestGroups(t *testing.T) {
+	s := miniredis.RunT(t)
+	var billing, audit1, audit2 atomic.Int32
+	b1, b2 := newTestBroker(t, s, Options{}), newTestBroker(t, s, Options{})
+	b1.Receive(true, "order.paid", "billing", func(msg broker.Message) { billing.Add(1) })
+	b2.Receive(true, "order.paid", "billing", func(msg broker.Message) { billing.Add(1) })
+	b1.Receive(false, "order.paid", "", func(msg broker.Message) { audit1.Add(1) })
+	b2.Receive(false, "order.paid", "", func(msg broker.Message) { audit2.Add(1) })
+	b1.Connect()
+	defer b1.Disconnect()
+	b2.Connect()
+	defer b2.Disconnect()
+
+	for i := 0; i < 10; i++ {
+		b1.Send("order.paid", broker.Message{Body: []byte(strconv.Itoa(i))})
+	}
+	waitFor(t, func() bool {
+		return billing.Load() == 10 && audit1.Load() == 10 && audit2.Load() == 10
+	})
+	time.Sleep(20 * time.Millisecond)
+	if billing.Load() != 10 {
+		t.Fatalf("billing handled %d", billing.Load())
+	}
+}
+
+func TestClaim(t *testing.T) {
+	s := miniredis.RunT(t)
+	crashed := newTestBroker(t, s, Options{})
+	crashed.Receive(true, "order.shipped", "notify", func(msg broker.Message) {
+		panic("notify down")
+	})
+	crashed.Connect()
+	defer crashed.Disconnect()
+	crashed.Send("order.shipped", broker.Message{Body: []byte("1")})
+	waitFor(t, func() bool {
+		p, err := crashed.client.XPending(context.Background(), "stream:order.shipped", "notify").Result()
+		return err == nil && p.Count == 1
+	})
+	crashed.Disconnect()
+
+	b := newTestBroker(t, s, Options{ClaimIdle: 50, ClaimInterval: 20})
+	got := make(chan broker.Message, 1)
+	b.Receive(true, "order.shipped", "notify", func(msg broker.Message) {
+		got <- msg
+	})
+	b.Connect()
+	defer b.Disconnect()
+	select {
+	case msg := <-got:
+		if string(msg.Body) != "1" || msg.Head[broker.HEAD_DELIVERY_COUNT] != "2" {
+			t.Fatalf("claimed %s", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not claimed")
+	}
+	waitFor(t, func() bool {
+		p, err := b.client.XPending(context.Background(), "stream:order.shipped", "notify").Result()
+		return err == nil && p.Count == 0
+	})
+}
+
+func TestIdleConsumers(t *testing.T) {
+	consumer := func(name string, pending, idle int64) []interface{} {
+		return []interface{}{"name", name, "pending", pending, "idle", idle, "inactive", idle}
+	}
+	reply := []interface{}{
+		consumer("self", 0, 1000),
+		consumer("stopped", 0, 1000),
+		consumer("pending", 1, 1000),
+		consumer("running", 0, 10),
+		consumer("unknown", 0, -1),
+	}
+	names := idleConsumers(reply, "self", 100)
+	if len(names) != 1 || names[0] != "stopped" {
+		t.Fatalf("idle consumers %v", names)
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	if id := instanceID(Options{Instance: "order-1"}); id != "order-1" {
+		t.Fatalf("instance %s", id)
+	}
+	host, _ := os.Hostname()
+	if id := instanceID(Options{}); id == "" || (host != "" && id != host) {
+		t.Fatalf("instance %s of host %s", id, host)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	s := miniredis.RunT(t)
+	b := newTestBroker(t, s, Options{MaxLen: 5, ExactTrim: true})
+	b.Connect()
+	defer b.Disconnect()
+	for i := 0; i < 10; i++ {
+		b.Send("user.login", broker.Message{Body: []byte(strconv.Itoa(i))})
+	}
+	if n, _ := b.client.XLen(context.Background(), "stream:user.login").Result(); n != 5 {
+		t.Fatalf("stream length %d", n)
+	}
+}
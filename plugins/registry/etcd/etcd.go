@@ -101,6 +101,7 @@ func (e *etcdRegistry) loop() {
 			e.services = nil
 			e.client.Delete(context.Background(), e.self.Path)
 			e.leaseId = 0
+			registry.NotifyRegistered(false)
 			e.watchCancel()
 			return
 		default:
@@ -128,6 +129,7 @@ func (e *etcdRegistry) loop() {
 			logger.Info("lease keep alive failed", err.Error(), "retry: ", e.keepaliveRetry)
 			if e.keepaliveRetry >= MAX_KEEPALIVE_RETRY {
 				e.leaseId = 0
+				registry.NotifyRegistered(false)
 				e.mu.Lock()
 				logger.Info("release all services cache")
 				e.services = nil
@@ -198,6 +200,7 @@ func (e *etcdRegistry) reg() error {
 		return err
 	}
 	logger.Info(fmt.Sprintf("register success %s LeaseID: %x\n", e.self.String(), e.leaseId))
+	registry.NotifyRegistered(true)
 	return nil
 }
 
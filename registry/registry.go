@@ -3,6 +3,8 @@ package registry
 import (
 	"fmt"
 	"github.com/billyyoyo/microj/logger"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -12,7 +14,10 @@ const (
 var (
 	ServiceRegistry    *Registry
 	InvokeInitRegistry func(opts Options) (Registry, error)
+	watcherMu          sync.RWMutex
 	watchers           []chan bool
+	regWatchers        []chan bool
+	registered         atomic.Bool
 )
 
 type Registry interface {
@@ -58,26 +63,45 @@ func (n *Node) Addr() string {
 }
 
 func Init(opts Options) {
+	if err := Setup(opts); err != nil {
+		return
+	}
+	if err := Register(); err != nil {
+		logger.Error("register error", err)
+		return
+	}
+}
+
+// Setup creates the registry without registering this service,
+// app registers it once all servers are ready
+func Setup(opts Options) error {
 	// todo 指向接口的指针，本不这样推荐使用，正确做法是把数据缓存部分单独创建结构体
 	ServiceRegistry = new(Registry)
 	reger, err := InvokeInitRegistry(opts)
 	if err != nil {
 		logger.Error("init error", err)
-		return
+		return err
 	}
 	ServiceRegistry = &reger
-	Register()
-	if err != nil {
-		logger.Error("register error", err)
-		return
-	}
+	return nil
+}
+
+// Enabled reports whether a registry plugin is initialized
+func Enabled() bool {
+	return ServiceRegistry != nil && *ServiceRegistry != nil
 }
 
 func Register() error {
+	if !Enabled() {
+		return nil
+	}
 	return (*ServiceRegistry).Register()
 }
 
 func Deregister() error {
+	if !Enabled() {
+		return nil
+	}
 	return (*ServiceRegistry).Deregister()
 }
 
@@ -90,11 +114,40 @@ func ListServices() ([]string, error) {
 }
 
 func AddWatcher(watcher chan bool) {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
 	watchers = append(watchers, watcher)
 }
 
 func NotifyWatcher() {
-	for _, ch := range watchers {
+	watcherMu.RLock()
+	chs := watchers
+	watcherMu.RUnlock()
+	for _, ch := range chs {
 		ch <- true
 	}
 }
+
+// AddRegisterWatcher receives true when this service is registered and false when the registration is lost
+func AddRegisterWatcher(watcher chan bool) {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+	regWatchers = append(regWatchers, watcher)
+}
+
+// Registered reports whether this service is registered right now
+func Registered() bool {
+	return registered.Load()
+}
+
+func NotifyRegistered(ok bool) {
+	registered.Store(ok)
+	watcherMu.RLock()
+	defer watcherMu.RUnlock()
+	for _, ch := range regWatchers {
+		select {
+		case ch <- ok:
+		default:
+		}
+	}
+}
@@ -4,24 +4,65 @@ import (
 	"context"
 	"fmt"
 	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/config"
 	"github.com/billyyoyo/microj/errs"
 	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/trace"
 	"github.com/billyyoyo/microj/util"
 	"github.com/gin-gonic/gin"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"path"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const METHOD_ANY = "ANY"
+
+const logModule = "api"
+
+var (
+	methods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodPost:    true,
+		http.MethodPut:     true,
+		http.MethodPatch:   true,
+		http.MethodDelete:  true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		METHOD_ANY:         true,
+	}
+
+	apiRequests = metrics.NewCounterVec(metrics.NAMESPACE+"_api_requests_total",
+		"Total number of http requests handled by the api server.", "method", "route", "status")
+	apiLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_api_request_duration_seconds",
+		"Latency of http requests handled by the api server.", nil, "method", "route")
+)
+
 type Api struct {
-	Method string
-	Path   string
-	Func   gin.HandlerFunc
+	Method  string
+	Path    string
+	Func    gin.HandlerFunc
+	Filters []gin.HandlerFunc
+	// Req and Resp are set by Typed and only used by the api docs
+	Req  reflect.Type
+	Resp reflect.Type
+}
+
+// Group shares the path prefix and filters with all its apis
+type Group struct {
+	Prefix  string
+	Filters []gin.HandlerFunc
+	Apis    []Api
 }
 
 type ApiServer struct {
 	apis    []Api
+	groups  []Group
 	filters []gin.HandlerFunc
 	s       *http.Server
 }
@@ -30,35 +71,48 @@ func (s *ApiServer) Init() {
 
 }
 
-func (s *ApiServer) Run() {
+func (s *ApiServer) Run(ready func()) error {
 	logger.Info("init http api server")
 	gin.SetMode(app.Mode())
 	router := gin.New()
+	router.ContextWithFallback = true
+	router.Use(apiContext())
 	router.Use(apiLogger())
+	router.Use(apiMetrics())
 	router.Use(apiRecover())
 	if len(s.filters) > 0 {
 		for _, f := range s.filters {
 			router.Use(f)
 		}
 	}
-	for _, api := range s.apis {
-		if strings.ToLower(api.Method) == "get" {
-			router.GET(api.Path, api.Func)
-		} else if strings.ToLower(api.Method) == "post" {
-			router.POST(api.Path, api.Func)
-		}
+	config.SetDefault("api.docPath", "")
+	if err := s.register(router, config.GetString("api.docPath")); err != nil {
+		return err
 	}
 	s.s = &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", app.Addr(), app.Port()),
+		Addr:    app.ListenAddr("api"),
 		Handler: router,
 	}
-	if err := s.s.ListenAndServe(); err != nil {
-		logger.Fatal("server startup failed", err)
+	listener, err := net.Listen("tcp", s.s.Addr)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_COMMON, "api server listen error", err)
+	}
+	logger.Info("api server listen on ", s.s.Addr)
+	ready()
+	if err = s.s.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return errs.Wrap(errs.ERRCODE_COMMON, "api server serve error", err)
 	}
+	return nil
 }
 
-func (s *ApiServer) Stop() {
-	s.s.Shutdown(context.Background())
+func (s *ApiServer) Stop(ctx context.Context) {
+	if s.s == nil {
+		return
+	}
+	if err := s.s.Shutdown(ctx); err != nil {
+		logger.Error("api server shutdown error", err)
+		s.s.Close()
+	}
 }
 
 func (s *ApiServer) RegFilter(fs []gin.HandlerFunc) *ApiServer {
@@ -70,6 +124,88 @@ func (s *ApiServer) RegController(arr []Api) *ApiServer {
 	return s
 }
 
+// RegGroup registers apis under the prefix, filters only run for the apis of this group
+func (s *ApiServer) RegGroup(prefix string, filters []gin.HandlerFunc, arr []Api) *ApiServer {
+	s.groups = append(s.groups, Group{
+		Prefix:  prefix,
+		Filters: filters,
+		Apis:    arr,
+	})
+	return s
+}
+
+// register adds the routes to the router, the conflicts validate misses like /u/:id and /u/:name
+// make gin panic, which is returned as an error instead of crashing the goroutine of Run
+func (s *ApiServer) register(router *gin.Engine, docPath string) (err error) {
+	if err = s.validate(); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errs.NewInternal(fmt.Sprintf("register routes error: %v", r))
+		}
+	}()
+	regApis(&router.RouterGroup, s.apis)
+	for _, g := range s.groups {
+		rg := router.Group(g.Prefix, g.Filters...)
+		regApis(rg, g.Apis)
+	}
+	if docPath != "" {
+		router.GET(docPath, func(ctx *gin.Context) {
+			ctx.JSON(http.StatusOK, app.SuccessResult(s.Docs()))
+		})
+	}
+	return nil
+}
+
+func regApis(rg *gin.RouterGroup, apis []Api) {
+	for _, api := range apis {
+		handlers := append(append([]gin.HandlerFunc{}, api.Filters...), api.Func)
+		method := strings.ToUpper(api.Method)
+		if method == METHOD_ANY {
+			rg.Any(api.Path, handlers...)
+		} else {
+			rg.Handle(method, api.Path, handlers...)
+		}
+	}
+}
+
+// validate fails on unknown methods and duplicated routes before gin panics on them
+func (s *ApiServer) validate() error {
+	routes := make(map[string]map[string]bool)
+	check := func(prefix string, apis []Api) error {
+		for _, api := range apis {
+			method := strings.ToUpper(api.Method)
+			if !methods[method] {
+				return errs.NewInternal(fmt.Sprintf("unknown method %s of %s", api.Method, api.Path))
+			}
+			if api.Func == nil {
+				return errs.NewInternal(fmt.Sprintf("no handler of %s %s", api.Method, api.Path))
+			}
+			p := path.Join("/", prefix, api.Path)
+			ms, ok := routes[p]
+			if !ok {
+				ms = make(map[string]bool)
+				routes[p] = ms
+			}
+			if ms[method] || (len(ms) > 0 && (method == METHOD_ANY || ms[METHOD_ANY])) {
+				return errs.NewInternal(fmt.Sprintf("duplicate route %s %s", method, p))
+			}
+			ms[method] = true
+		}
+		return nil
+	}
+	if err := check("", s.apis); err != nil {
+		return err
+	}
+	for _, g := range s.groups {
+		if err := check(g.Prefix, g.Apis); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func apiLogger() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		start := time.Now()
@@ -80,7 +216,7 @@ func apiLogger() gin.HandlerFunc {
 		reqUri := ctx.Request.RequestURI
 		statusCode := ctx.Writer.Status()
 		clientIP := ctx.ClientIP()
-		logger.Infof("code=%d took=%dms ip=%s method=%s path=%s",
+		logger.FromContext(ctx).Module(logModule).Infof("code=%d took=%dms ip=%s method=%s path=%s",
 			statusCode,
 			latencyTime.Milliseconds(),
 			clientIP,
@@ -90,26 +226,66 @@ func apiLogger() gin.HandlerFunc {
 	}
 }
 
+// apiContext puts the span continuing the trace of the caller and the request logger into the
+// request context, so ctx of the handlers carries them since ContextWithFallback is on
+func apiContext() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		tctx, span := trace.Start(trace.Extract(ctx.Request.Context(), ctx.Request.Header.Get),
+			ctx.Request.Method+" "+ctx.Request.URL.Path, trace.SPAN_KIND_SERVER)
+		tctx = logger.Extract(tctx, ctx.Request.Header.Get, span.Context().TraceID.String())
+		ctx.Header(logger.HEADER_REQUEST_ID, logger.RequestIDFromContext(tctx))
+		ctx.Request = ctx.Request.WithContext(tctx)
+		ctx.Next()
+		if route := ctx.FullPath(); route != "" {
+			span.SetName(ctx.Request.Method + " " + route)
+			span.SetAttr("http.route", route)
+		}
+		span.SetAttr("http.method", ctx.Request.Method)
+		span.SetAttr("http.target", ctx.Request.URL.Path)
+		span.SetAttr("http.status_code", ctx.Writer.Status())
+		if len(ctx.Errors) > 0 {
+			span.SetError(ctx.Errors.Last())
+		}
+		span.End()
+	}
+}
+
+// apiMetrics labels requests by the route pattern, unmatched requests share one route
+func apiMetrics() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		apiRequests.Inc(method, route, strconv.Itoa(ctx.Writer.Status()))
+		apiLatency.Observe(time.Since(start).Seconds(), method, route)
+	}
+}
+
 func apiRecover() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		defer func() {
 			if err := recover(); err != nil {
 				req, _ := httputil.DumpRequest(ctx.Request, false)
+				log := logger.FromContext(ctx).Module(logModule)
 				if ne, ok := err.(errs.MicroError); ok {
 					ctx.JSON(http.StatusOK, app.FailedResult(ne.Code(), ne.Error()))
-					logger.Error("Recover from panic",
+					log.Error("Recover from panic",
 						err.(error),
 						logger.Val{K: "request", V: util.Bytes2str(req)},
 					)
 				} else if ne, ok := err.(error); ok {
 					ctx.JSON(http.StatusOK, app.FailedResult(errs.ERRCODE_COMMON, ne.Error()))
-					logger.Error("Recover from panic",
+					log.Error("Recover from panic",
 						err.(error),
 						logger.Val{K: "request", V: util.Bytes2str(req)},
 					)
 				} else {
 					ctx.JSON(http.StatusOK, app.FailedResult(errs.ERRCODE_COMMON, errs.ERRMSG_UNKNOWN))
-					logger.Error("Recover from panic",
+					log.Error("Recover from panic",
 						nil,
 						logger.Val{K: "request", V: util.Bytes2str(req)},
 						logger.Val{K: "error", V: err},
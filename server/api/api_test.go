@@ -0,0 +1,59 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"testing"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	h := func(ctx *gin.Context) {}
+	s := (&ApiServer{}).
+		RegController([]Api{
+			{Method: "get", Path: "/info", Func: h},
+			{Method: "put", Path: "/info", Func: h},
+			{Method: "any", Path: "/echo", Func: h},
+		}).
+		RegGroup("/v1", nil, []Api{
+			{Method: "delete", Path: "/info", Func: h},
+			{Method: "patch", Path: "/info", Func: h, Filters: []gin.HandlerFunc{h}},
+		})
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	invalids := [][]Api{
+		{{Method: "fetch", Path: "/info", Func: h}},
+		{{Method: "get", Path: "/info", Func: h}, {Method: "GET", Path: "/info", Func: h}},
+		{{Method: "get", Path: "/info", Func: h}, {Method: "any", Path: "/info", Func: h}},
+		{{Method: "get", Path: "/info"}},
+	}
+	for _, apis := range invalids {
+		if err := (&ApiServer{}).RegController(apis).validate(); err == nil {
+			t.Errorf("%v should be invalid", apis[len(apis)-1])
+		}
+	}
+	dup := (&ApiServer{}).
+		RegController([]Api{{Method: "get", Path: "/v1/info", Func: h}}).
+		RegGroup("/v1", nil, []Api{{Method: "get", Path: "/info", Func: h}})
+	if err := dup.validate(); err == nil {
+		t.Error("duplicate route across group should be invalid")
+	}
+}
+
+func TestRegisterConflicts(t *testing.T) {
+	h := func(ctx *gin.Context) {}
+	gin.SetMode(gin.TestMode)
+	for name, c := range map[string]struct {
+		apis    []Api
+		docPath string
+	}{
+		"wildcard": {[]Api{{Method: "get", Path: "/u/:id", Func: h}, {Method: "get", Path: "/u/:name", Func: h}}, ""},
+		"doc path": {[]Api{{Method: "get", Path: "/docs", Func: h}}, "/docs"},
+	} {
+		if err := (&ApiServer{}).RegController(c.apis).register(gin.New(), c.docPath); err == nil {
+			t.Errorf("%s conflict should be an error", name)
+		}
+	}
+	if err := (&ApiServer{}).RegController([]Api{{Method: "get", Path: "/u/:id", Func: h}}).register(gin.New(), "/docs"); err != nil {
+		t.Fatal(err)
+	}
+}
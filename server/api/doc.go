@@ -0,0 +1,97 @@
+package api
+
+import (
+	"path"
+	"reflect"
+	"strings"
+)
+
+const maxDocDepth = 5
+
+type ApiDoc struct {
+	Method string     `json:"method"`
+	Path   string     `json:"path"`
+	Req    []FieldDoc `json:"req,omitempty"`
+	Resp   []FieldDoc `json:"resp,omitempty"`
+}
+
+type FieldDoc struct {
+	Name   string     `json:"name"`
+	In     string     `json:"in,omitempty"` // uri, query, header or body
+	Type   string     `json:"type"`
+	Rule   string     `json:"rule,omitempty"`
+	Fields []FieldDoc `json:"fields,omitempty"`
+}
+
+// Docs describes all registered apis, request and response fields are only known for apis built by Typed
+func (s *ApiServer) Docs() []ApiDoc {
+	var docs []ApiDoc
+	for _, a := range s.apis {
+		docs = append(docs, apiDoc("", a))
+	}
+	for _, g := range s.groups {
+		for _, a := range g.Apis {
+			docs = append(docs, apiDoc(g.Prefix, a))
+		}
+	}
+	return docs
+}
+
+func apiDoc(prefix string, a Api) ApiDoc {
+	return ApiDoc{
+		Method: strings.ToUpper(a.Method),
+		Path:   path.Join("/", prefix, a.Path),
+		Req:    fieldDocs(a.Req, true, 0),
+		Resp:   fieldDocs(a.Resp, false, 0),
+	}
+}
+
+func fieldDocs(t reflect.Type, req bool, depth int) []FieldDoc {
+	for t != nil && (t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || depth > maxDocDepth {
+		return nil
+	}
+	var docs []FieldDoc
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Anonymous {
+			docs = append(docs, fieldDocs(f.Type, req, depth+1)...)
+			continue
+		}
+		d := FieldDoc{
+			Name: f.Name,
+			Type: f.Type.String(),
+			Rule: f.Tag.Get("binding"),
+		}
+		if req {
+			d.Name, d.In = fieldSource(f)
+		} else if n := tagName(f.Tag.Get("json")); n != "" {
+			d.Name = n
+		}
+		if d.Name == "-" {
+			continue
+		}
+		d.Fields = fieldDocs(f.Type, req, depth+1)
+		docs = append(docs, d)
+	}
+	return docs
+}
+
+func fieldSource(f reflect.StructField) (name, in string) {
+	for _, src := range [][2]string{{"uri", "uri"}, {"header", "header"}, {"form", "query"}, {"json", "body"}} {
+		if n := tagName(f.Tag.Get(src[0])); n != "" {
+			return n, src[1]
+		}
+	}
+	return f.Name, "body"
+}
+
+func tagName(tag string) string {
+	n, _, _ := strings.Cut(tag, ",")
+	return n
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// TypedFunc is a controller method with bound request and typed response,
+// ctx is the *gin.Context of the request
+type TypedFunc[Req, Resp any] func(ctx context.Context, req *Req) (*Resp, error)
+
+// Handle adapts a TypedFunc to gin, the request is bound from query (form tag), body (json or form),
+// header (header tag) and path (uri tag), then validated by the binding tags.
+// Validation failures and returned errors are answered with app.Result
+func Handle[Req, Resp any](fn TypedFunc[Req, Resp]) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req := new(Req)
+		if err := bind(ctx, req); err != nil {
+			logger.FromContext(ctx).Module(logModule).Warnf("api params bind error path=%s: %s", ctx.Request.URL.Path, err.Error())
+			ctx.JSON(http.StatusOK, app.FailedResult(errs.ERRCODE_INVALID_PARAMS, err.Error()))
+			return
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			ctx.Error(err)
+			if me, ok := errs.FromError(err); ok {
+				ctx.JSON(http.StatusOK, app.FailedResult(me.Code(), me.Error()))
+			} else {
+				logger.FromContext(ctx).Module(logModule).Error("api handle error", err, logger.Val{K: "path", V: ctx.Request.URL.Path})
+				ctx.JSON(http.StatusOK, app.FailedResult(errs.ERRCODE_COMMON, err.Error()))
+			}
+			return
+		}
+		ctx.JSON(http.StatusOK, app.SuccessResult(resp))
+	}
+}
+
+// Typed builds an Api whose request and response types are recorded for the api docs
+func Typed[Req, Resp any](method, path string, fn TypedFunc[Req, Resp], filters ...gin.HandlerFunc) Api {
+	return Api{
+		Method:  method,
+		Path:    path,
+		Func:    Handle(fn),
+		Filters: filters,
+		Req:     reflect.TypeOf((*Req)(nil)).Elem(),
+		Resp:    reflect.TypeOf((*Resp)(nil)).Elem(),
+	}
+}
+
+// bind applies the sources in a fixed order: query, body, header then path. Each source only sets
+// the fields carrying its own tag, gin falls back to the field name for untagged fields so the query
+// and header are mapped into a scratch value first. Header and path fields are set only from
+// their sources, a client can't override them through the query or the body
+func bind(ctx *gin.Context, ptr any) error {
+	t := reflect.TypeOf(ptr).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	dst := reflect.ValueOf(ptr).Elem()
+	query := ctx.Request.URL.Query()
+	if err := mapTagged(dst, query, "form", false); err != nil {
+		return errs.Wrap(errs.ERRCODE_INVALID_PARAMS, "bind query params error", err)
+	}
+	if err := bindBody(ctx, ptr); err != nil {
+		return errs.Wrap(errs.ERRCODE_INVALID_PARAMS, "bind body params error", err)
+	}
+	header := make(map[string][]string, len(ctx.Request.Header)*2)
+	for k, v := range ctx.Request.Header {
+		header[k] = v
+		header[strings.ToLower(k)] = v
+	}
+	if err := mapTagged(dst, header, "header", true); err != nil {
+		return errs.Wrap(errs.ERRCODE_INVALID_PARAMS, "bind header params error", err)
+	}
+	uri := make(map[string][]string, len(ctx.Params))
+	for _, p := range ctx.Params {
+		uri[p.Key] = []string{p.Value}
+	}
+	if err := mapTagged(dst, uri, "uri", true); err != nil {
+		return errs.Wrap(errs.ERRCODE_INVALID_PARAMS, "bind path params error", err)
+	}
+	if binding.Validator == nil {
+		return nil
+	}
+	return binding.Validator.ValidateStruct(ptr)
+}
+
+// mapTagged maps the form into a scratch value and copies the fields carrying the tag,
+// owned fields are always copied, the others only if the form has the key or a default
+func mapTagged(dst reflect.Value, form map[string][]string, tag string, owned bool) error {
+	src := reflect.New(dst.Type())
+	if err := binding.MapFormWithTag(src.Interface(), form, tag); err != nil {
+		return err
+	}
+	copyTagged(dst, src.Elem(), form, tag, owned)
+	return nil
+}
+
+func copyTagged(dst, src reflect.Value, form map[string][]string, tag string, owned bool) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !dst.Field(i).CanSet() {
+			continue
+		}
+		v, ok := f.Tag.Lookup(tag)
+		if !ok {
+			if f.Type.Kind() == reflect.Struct {
+				copyTagged(dst.Field(i), src.Field(i), form, tag, owned)
+			}
+			continue
+		}
+		name, opts, _ := strings.Cut(v, ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, present := form[name]; owned || present || strings.Contains(opts, "default=") {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+func bindBody(ctx *gin.Context, ptr any) error {
+	if ctx.Request.Body == nil || ctx.Request.ContentLength == 0 {
+		return nil
+	}
+	switch ctx.ContentType() {
+	case binding.MIMEJSON:
+		return json.NewDecoder(ctx.Request.Body).Decode(ptr)
+	case binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+		if err := ctx.Request.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+			return err
+		}
+		return binding.MapFormWithTag(ptr, ctx.Request.PostForm, "form")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type userReq struct {
+	Id    string `uri:"id" binding:"required"`
+	Token string `header:"Authorization" binding:"required"`
+	Page  int    `form:"page"`
+	Name  string `json:"name" binding:"required"`
+}
+
+type userResp struct {
+	Id   string `json:"id"`
+	Page int    `json:"page"`
+}
+
+func editUser(ctx context.Context, req *userReq) (*userResp, error) {
+	if req.Name == "forbidden" {
+		return nil, errs.New(510403, "no permission")
+	}
+	return &userResp{Id: req.Id, Page: req.Page}, nil
+}
+
+func TestHandle(t *testing.T) {
+	router := gin.New()
+	a := Typed("put", "/user/:id", editUser)
+	router.PUT(a.Path, a.Func)
+	cases := []struct {
+		body string
+		code int
+	}{
+		{`{"name":"billyyoyo"}`, 0},
+		{`{}`, errs.ERRCODE_INVALID_PARAMS},
+		{`{"name":"forbidden"}`, 510403},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPut, "/user/101?page=2", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "abc")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var r app.Result
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Code != c.code {
+			t.Errorf("%s: code %d, want %d, msg %s", c.body, r.Code, c.code, r.Msg)
+		}
+		if c.code == 0 && w.Body.String() != `{"code":0,"msg":"","data":{"id":"101","page":2}}` {
+			t.Errorf("body %s", w.Body.String())
+		}
+	}
+	doc := apiDoc("/v1", a)
+	if doc.Path != "/v1/user/:id" || len(doc.Req) != 4 || doc.Req[1].In != "header" || doc.Resp[0].Name != "id" {
+		t.Errorf("doc %+v", doc)
+	}
+}
+
+type overrideReq struct {
+	ID    string `uri:"id"`
+	Token string `header:"X-Token"`
+	Page  int    `form:"page,default=1"`
+	Role  string `json:"role"`
+}
+
+func TestBindOverride(t *testing.T) {
+	cases := []struct {
+		uri    string
+		header map[string]string
+		body   string
+		want   overrideReq
+	}{
+		// untagged sources don't fall back to the field name
+		{"/u/1?ID=99&Role=root", map[string]string{"Role": "admin", "Id": "98"}, `{}`, overrideReq{ID: "1", Page: 1}},
+		{"/u/1?page=3&X-Token=forged", map[string]string{"X-Token": "abc"}, `{"role":"user"}`, overrideReq{ID: "1", Token: "abc", Page: 3, Role: "user"}},
+		// header and path fields are only set from their sources
+		{"/u/1", nil, `{"ID":"99","Token":"forged","page":2}`, overrideReq{ID: "1", Page: 2}},
+	}
+	for _, c := range cases {
+		var got overrideReq
+		router := gin.New()
+		router.POST("/u/:id", func(ctx *gin.Context) {
+			if err := bind(ctx, &got); err != nil {
+				t.Error(err)
+			}
+		})
+		req := httptest.NewRequest(http.MethodPost, c.uri, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		if got != c.want {
+			t.Errorf("%s %s: bound %+v, want %+v", c.uri, c.body, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/util"
+	"github.com/valyala/fasthttp"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	NODE_STATE_ACTIVE int32 = iota
+	NODE_STATE_DRAINING
+	NODE_STATE_DISABLED
+)
+
+// nodeStat holds the live counters of one upstream node, all fields are updated atomically
+type nodeStat struct {
+	state    int32
+	requests int64
+	errors   int64
+	inflight int64
+	latency  int64 // total nanoseconds
+	maxLat   int64
+}
+
+func (n *nodeStat) available() bool {
+	if n == nil {
+		return true
+	}
+	return atomic.LoadInt32(&n.state) == NODE_STATE_ACTIVE
+}
+
+func (n *nodeStat) begin() {
+	atomic.AddInt64(&n.requests, 1)
+	atomic.AddInt64(&n.inflight, 1)
+}
+
+func (n *nodeStat) end(d time.Duration, err error) {
+	atomic.AddInt64(&n.inflight, -1)
+	atomic.AddInt64(&n.latency, int64(d))
+	if err != nil {
+		atomic.AddInt64(&n.errors, 1)
+	}
+	for {
+		max := atomic.LoadInt64(&n.maxLat)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&n.maxLat, max, int64(d)) {
+			break
+		}
+	}
+}
+
+func (n *nodeStat) stateName() string {
+	switch atomic.LoadInt32(&n.state) {
+	case NODE_STATE_DRAINING:
+		if atomic.LoadInt64(&n.inflight) == 0 {
+			return "drained"
+		}
+		return "draining"
+	case NODE_STATE_DISABLED:
+		return "disabled"
+	default:
+		return "active"
+	}
+}
+
+type NodeInfo struct {
+	Addr         string  `json:"addr"`
+	State        string  `json:"state"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	Inflight     int64   `json:"inflight"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+	MaxLatencyMs float64 `json:"maxLatencyMs"`
+}
+
+type EndpointInfo struct {
+	Key         string `json:"key"`
+	LBName      string `json:"lbName"`
+	ServiceName string `json:"serviceName"`
+}
+
+// WithRoutes sets the provider of the route table shown by the admin api,
+// routes usually live in a refreshable config so a func is taken instead of a copy
+func (s *GatewayServer) WithRoutes(fn func() []Route) *GatewayServer {
+	s.routes = fn
+	return s
+}
+
+// Upstreams returns the http client pool of every service with the stats of each node
+func (s *GatewayServer) Upstreams() map[string][]NodeInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ups := make(map[string][]NodeInfo)
+	for _, cli := range s.clients {
+		st, ok := s.stats[cli.Addr]
+		if !ok {
+			continue
+		}
+		info := NodeInfo{
+			Addr:         cli.Addr,
+			State:        st.stateName(),
+			Requests:     atomic.LoadInt64(&st.requests),
+			Errors:       atomic.LoadInt64(&st.errors),
+			Inflight:     atomic.LoadInt64(&st.inflight),
+			MaxLatencyMs: float64(atomic.LoadInt64(&st.maxLat)) / float64(time.Millisecond),
+		}
+		if done := info.Requests - info.Inflight; done > 0 {
+			info.AvgLatencyMs = float64(atomic.LoadInt64(&st.latency)) / float64(done) / float64(time.Millisecond)
+		}
+		ups[cli.Name] = append(ups[cli.Name], info)
+	}
+	return ups
+}
+
+// Endpoints returns the registered rpc doers sorted by route key
+func (s *GatewayServer) Endpoints() []EndpointInfo {
+	var eps []EndpointInfo
+	for k, d := range s.doers {
+		eps = append(eps, EndpointInfo{
+			Key:         k,
+			LBName:      d.LBName(),
+			ServiceName: d.ServiceName(),
+		})
+	}
+	sort.Slice(eps, func(i, j int) bool {
+		return eps[i].Key < eps[j].Key
+	})
+	return eps
+}
+
+// SetNodeState changes the state of an upstream node at runtime,
+// draining and disabled nodes receive no new requests until set back to active
+func (s *GatewayServer) SetNodeState(addr string, state int32) error {
+	s.mu.RLock()
+	st, ok := s.stats[addr]
+	s.mu.RUnlock()
+	if !ok {
+		return errs.New(errs.ERRCODE_GATEWAY, fmt.Sprintf("node %s not found", addr))
+	}
+	atomic.StoreInt32(&st.state, state)
+	logger.Infof("gateway node %s state changed to %s", addr, st.stateName())
+	return nil
+}
+
+func (s *GatewayServer) nodeStat(addr string) *nodeStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if st, ok := s.stats[addr]; ok {
+		return st
+	}
+	return &nodeStat{}
+}
+
+// runAdmin listens before the gateway is ready, so a bind error fails Run and Stop always sees the server
+func (s *GatewayServer) runAdmin(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_GATEWAY, "gateway admin listen error", err)
+	}
+	s.admin = &fasthttp.Server{
+		Handler: RecoverHandler(s.adminHandler),
+	}
+	logger.Info("init gateway admin server on ", addr)
+	go func(admin *fasthttp.Server) {
+		if err := admin.Serve(listener); err != nil {
+			logger.Error("gateway admin serve error", err)
+		}
+	}(s.admin)
+	return nil
+}
+
+func (s *GatewayServer) adminHandler(ctx *fasthttp.RequestCtx) {
+	method := util.Bytes2str(ctx.Method())
+	path := util.Bytes2str(ctx.Path())
+	if method != http.MethodGet && !s.adminAuthorized(ctx) {
+		ctx.Error("unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var data any
+	var err error
+	switch {
+	case method == http.MethodGet && path == "/routes":
+		var routes []Route
+		if s.routes != nil {
+			routes = s.routes()
+		}
+		data = routes
+	case method == http.MethodGet && path == "/endpoints":
+		data = s.Endpoints()
+	case method == http.MethodGet && path == "/upstreams":
+		data = s.Upstreams()
+	case method == http.MethodPost && path == "/upstreams/drain":
+		data, err = s.adminSetState(ctx, NODE_STATE_DRAINING)
+	case method == http.MethodPost && path == "/upstreams/disable":
+		data, err = s.adminSetState(ctx, NODE_STATE_DISABLED)
+	case method == http.MethodPost && path == "/upstreams/enable":
+		data, err = s.adminSetState(ctx, NODE_STATE_ACTIVE)
+	default:
+		ctx.Error("not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		RetFailed(ctx, errs.ERRCODE_GATEWAY, err.Error())
+		return
+	}
+	body, _ := app.SuccessResult(data).Marshal()
+	ctx.Success(CONTENT_TYPE, body)
+}
+
+// adminAuthorized checks the bearer token of gateway.admin.token, the state changing requests
+// are only taken from the loopback if no token is configured
+func (s *GatewayServer) adminAuthorized(ctx *fasthttp.RequestCtx) bool {
+	if s.adminToken == "" {
+		return ctx.RemoteIP().IsLoopback()
+	}
+	token := strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+func (s *GatewayServer) adminSetState(ctx *fasthttp.RequestCtx, state int32) (string, error) {
+	addr := string(ctx.QueryArgs().Peek("addr"))
+	if addr == "" {
+		return "", errs.New(errs.ERRCODE_GATEWAY, "query param addr is required")
+	}
+	return addr, s.SetNodeState(addr, state)
+}
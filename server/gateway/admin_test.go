@@ -0,0 +1,136 @@
+package gateway
+
+import (
+	"context"
+	"github.com/valyala/fasthttp"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newAdminServer(token string, addrs ...string) *GatewayServer {
+	s := &GatewayServer{stats: make(map[string]*nodeStat), adminToken: token}
+	for _, addr := range addrs {
+		s.clients = append(s.clients, &fasthttp.HostClient{Addr: addr, Name: "example"})
+		s.stats[addr] = &nodeStat{}
+	}
+	s.nextCli = s.roundRobinNext(0)
+	return s
+}
+
+func adminRequest(s *GatewayServer, method, uri, token, remote string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(remote)}, nil)
+	s.adminHandler(&ctx)
+	return &ctx
+}
+
+func TestAdminNodeState(t *testing.T) {
+	s := newAdminServer("", "10.0.0.1:80", "10.0.0.2:80")
+	state := func(addr string) string {
+		for _, n := range s.Upstreams()["example"] {
+			if n.Addr == addr {
+				return n.State
+			}
+		}
+		return ""
+	}
+	for _, c := range []struct {
+		path  string
+		state string
+	}{
+		{"/upstreams/drain", "drained"},
+		{"/upstreams/disable", "disabled"},
+		{"/upstreams/enable", "active"},
+	} {
+		ctx := adminRequest(s, http.MethodPost, c.path+"?addr=10.0.0.1:80", "", "127.0.0.1")
+		if ctx.Response.StatusCode() != http.StatusOK || !strings.Contains(string(ctx.Response.Body()), "10.0.0.1:80") {
+			t.Fatalf("%s: %d %s", c.path, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		if got := state("10.0.0.1:80"); got != c.state {
+			t.Fatalf("%s: state %s, want %s", c.path, got, c.state)
+		}
+	}
+	s.stats["10.0.0.1:80"].begin()
+	s.SetNodeState("10.0.0.1:80", NODE_STATE_DRAINING)
+	if got := state("10.0.0.1:80"); got != "draining" {
+		t.Fatalf("state with inflight requests %s", got)
+	}
+	if err := s.SetNodeState("10.0.0.9:80", NODE_STATE_DISABLED); err == nil {
+		t.Fatal("unknown node state changed")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := newAdminServer("", "10.0.0.1:80")
+	if ctx := adminRequest(s, http.MethodPost, "/upstreams/disable?addr=10.0.0.1:80", "", "192.168.1.9"); ctx.Response.StatusCode() != http.StatusUnauthorized {
+		t.Fatalf("remote request without token %d", ctx.Response.StatusCode())
+	}
+	if ctx := adminRequest(s, http.MethodGet, "/upstreams", "", "192.168.1.9"); ctx.Response.StatusCode() != http.StatusOK {
+		t.Fatalf("remote get %d", ctx.Response.StatusCode())
+	}
+
+	s = newAdminServer("secret", "10.0.0.1:80")
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		ctx := adminRequest(s, http.MethodPost, "/upstreams/disable?addr=10.0.0.1:80", token, "127.0.0.1")
+		if ctx.Response.StatusCode() != want {
+			t.Fatalf("token %q: %d, want %d", token, ctx.Response.StatusCode(), want)
+		}
+	}
+	if s.stats["10.0.0.1:80"].available() {
+		t.Fatal("node not disabled")
+	}
+}
+
+func TestNextCliSkipsUnavailable(t *testing.T) {
+	s := newAdminServer("", "10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	s.SetNodeState("10.0.0.1:80", NODE_STATE_DRAINING)
+	s.SetNodeState("10.0.0.2:80", NODE_STATE_DISABLED)
+	for i := 0; i < 4; i++ {
+		cli, err := s.selectCli("example")
+		if err != nil || cli.Addr != "10.0.0.3:80" {
+			t.Fatalf("selected %v, error %v", cli, err)
+		}
+	}
+	s.SetNodeState("10.0.0.3:80", NODE_STATE_DISABLED)
+	if _, err := s.selectCli("example"); err == nil {
+		t.Fatal("selected a node with all nodes unavailable")
+	}
+	s.SetNodeState("10.0.0.1:80", NODE_STATE_ACTIVE)
+	s.SetNodeState("10.0.0.2:80", NODE_STATE_ACTIVE)
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		cli, _ := s.selectCli("example")
+		seen[cli.Addr] = true
+	}
+	if len(seen) != 2 || !seen["10.0.0.1:80"] || !seen["10.0.0.2:80"] {
+		t.Fatalf("round robin over %v", seen)
+	}
+}
+
+func TestAdminBindError(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := newAdminServer("")
+	if err = s.runAdmin(ln.Addr().String()); err == nil || s.admin != nil {
+		t.Fatalf("admin bind error %v, server %v", err, s.admin)
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	s := newAdminServer("")
+	s.Stop(context.Background())
+	if err := s.Run(func() { t.Error("ready after stop") }); err != nil || s.s != nil {
+		t.Fatalf("run after stop: server %v, error %v", s.s, err)
+	}
+}
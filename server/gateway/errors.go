@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ERROR_MODE_LEGACY  = "legacy"
+	ERROR_MODE_STATUS  = "status"
+	ERROR_MODE_PROBLEM = "problem"
+
+	PROBLEM_CONTENT_TYPE = "application/problem+json"
+)
+
+var (
+	// CodeStatus maps errs codes to http status, codes not listed answer 500
+	CodeStatus = map[int]int{
+		errs.ERRCODE_COMMON:         http.StatusInternalServerError,
+		errs.ERRCODE_REMOTE_CALL:    http.StatusBadGateway,
+		errs.ERRCODE_BROKER:         http.StatusInternalServerError,
+		errs.ERRCODE_REGISTRY:       http.StatusServiceUnavailable,
+		errs.ERRCODE_CONFIG:         http.StatusInternalServerError,
+		errs.ERRCODE_GATEWAY:        http.StatusBadGateway,
+		errs.ERRCODE_NO_TOKEN:       http.StatusUnauthorized,
+		errs.ERRCODE_INVALID_PARAMS: http.StatusBadRequest,
+		errs.ERRCODE_TIMEOUT:        http.StatusGatewayTimeout,
+	}
+	// RpcCodeStatus maps grpc status codes to http status
+	RpcCodeStatus = map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           499,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	}
+)
+
+// ErrorResponder writes a failed gateway response, status is the http status the failure maps to,
+// code and msg are the business code and message carried in the body
+type ErrorResponder func(ctx *fasthttp.RequestCtx, status, code int, msg string)
+
+// LegacyErrorResponder always answers 200 with an app.Result envelope, kept for existing clients
+func LegacyErrorResponder(ctx *fasthttp.RequestCtx, status, code int, msg string) {
+	body, _ := app.FailedResult(code, msg).Marshal()
+	ctx.Success(CONTENT_TYPE, body)
+}
+
+// StatusErrorResponder answers the mapped http status with an app.Result envelope
+func StatusErrorResponder(ctx *fasthttp.RequestCtx, status, code int, msg string) {
+	body, _ := app.FailedResult(code, msg).Marshal()
+	writeError(ctx, status, CONTENT_TYPE, body)
+}
+
+// ProblemErrorResponder answers the mapped http status with a RFC 7807 problem+json body
+func ProblemErrorResponder(ctx *fasthttp.RequestCtx, status, code int, msg string) {
+	body, _ := json.Marshal(&Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   msg,
+		Instance: string(ctx.Request.URI().Path()),
+		Code:     code,
+	})
+	writeError(ctx, status, PROBLEM_CONTENT_TYPE, body)
+}
+
+// Problem is the RFC 7807 problem details object, Code is the business code extension member
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     int    `json:"code"`
+}
+
+func writeError(ctx *fasthttp.RequestCtx, status int, contentType string, body []byte) {
+	ctx.Response.Header.Set("Date", time.Now().Format(time.RFC1123))
+	ctx.Response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	ctx.SetStatusCode(status)
+	ctx.SetContentType(contentType)
+	ctx.SetBody(body)
+}
+
+func errorResponder(mode string) ErrorResponder {
+	switch mode {
+	case ERROR_MODE_STATUS:
+		return StatusErrorResponder
+	case ERROR_MODE_PROBLEM:
+		return ProblemErrorResponder
+	default:
+		return LegacyErrorResponder
+	}
+}
+
+// SetErrorResponder replaces the strategy chosen by gateway.errorMode
+func (s *GatewayServer) SetErrorResponder(r ErrorResponder) *GatewayServer {
+	s.errResp = r
+	return s
+}
+
+func (s *GatewayServer) fail(ctx *fasthttp.RequestCtx, status, code int, msg string) {
+	s.errResp(ctx, status, code, msg)
+}
+
+func (s *GatewayServer) failErr(ctx *fasthttp.RequestCtx, err error) {
+	hs, code, msg := ErrorStatus(err)
+	s.errResp(ctx, hs, code, msg)
+}
+
+// ErrorStatus resolves the http status, business code and message of an error
+// returned by an upstream call
+func ErrorStatus(err error) (httpStatus, code int, msg string) {
+	if me, ok := errs.FromError(err); ok {
+		return codeStatus(me.Code()), me.Code(), me.Error()
+	}
+	if st, ok := status.FromError(err); ok {
+		if hs, ok := RpcCodeStatus[st.Code()]; ok {
+			return hs, int(st.Code()), st.Message()
+		}
+		// business codes carried directly as grpc code by errs.NewRpcError
+		return codeStatus(int(st.Code())), int(st.Code()), st.Message()
+	}
+	if errors.Is(err, fasthttp.ErrTimeout) || errors.Is(err, fasthttp.ErrDialTimeout) {
+		return http.StatusGatewayTimeout, errs.ERRCODE_GATEWAY, err.Error()
+	}
+	return http.StatusBadGateway, errs.ERRCODE_GATEWAY, err.Error()
+}
+
+func codeStatus(code int) int {
+	if s, ok := CodeStatus[code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"github.com/billyyoyo/microj/errs"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   int
+	}{
+		{errs.New(errs.ERRCODE_NO_TOKEN, "no token"), http.StatusUnauthorized, errs.ERRCODE_NO_TOKEN},
+		{errs.New(errs.ERRCODE_INVALID_PARAMS, "id required"), http.StatusBadRequest, errs.ERRCODE_INVALID_PARAMS},
+		{errs.New(errs.ERRCODE_TIMEOUT, "broker request timeout"), http.StatusGatewayTimeout, errs.ERRCODE_TIMEOUT},
+		{errs.Wrap(errs.ERRCODE_REGISTRY, "no registry", fasthttp.ErrNoFreeConns), http.StatusServiceUnavailable, errs.ERRCODE_REGISTRY},
+		{status.Error(codes.DeadlineExceeded, "timeout"), http.StatusGatewayTimeout, int(codes.DeadlineExceeded)},
+		{status.Error(codes.NotFound, "not found"), http.StatusNotFound, int(codes.NotFound)},
+		{fasthttp.ErrTimeout, http.StatusGatewayTimeout, errs.ERRCODE_GATEWAY},
+		{fasthttp.ErrNoFreeConns, http.StatusBadGateway, errs.ERRCODE_GATEWAY},
+	}
+	for _, c := range cases {
+		s, code, _ := ErrorStatus(c.err)
+		if s != c.status || code != c.code {
+			t.Errorf("%v: got %d/%d, want %d/%d", c.err, s, code, c.status, c.code)
+		}
+	}
+}
+
+func TestProblemErrorResponder(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/server-rpc/example/call")
+	ProblemErrorResponder(&ctx, http.StatusServiceUnavailable, errs.ERRCODE_GATEWAY, "no service instance")
+	if ctx.Response.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("status %d", ctx.Response.StatusCode())
+	}
+	if string(ctx.Response.Header.ContentType()) != PROBLEM_CONTENT_TYPE {
+		t.Errorf("content type %s", ctx.Response.Header.ContentType())
+	}
+}
@@ -8,19 +8,22 @@ import (
 	"github.com/billyyoyo/microj/config"
 	"github.com/billyyoyo/microj/errs"
 	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
 	"github.com/billyyoyo/microj/registry"
+	"github.com/billyyoyo/microj/trace"
 	"github.com/billyyoyo/microj/util"
 	"github.com/valyala/fasthttp"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
 
 	"math/rand"
+	"net"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,10 +33,17 @@ const (
 	MICRO_SERVICE_SCHEMA = "micro-service-schema"
 
 	CONTENT_TYPE = "application/json"
+
+	logModule = "gateway"
 )
 
 var (
 	lbServiceRegexp *regexp.Regexp
+
+	gatewayRequests = metrics.NewCounterVec(metrics.NAMESPACE+"_gateway_requests_total",
+		"Total number of requests proxied by the gateway.", "schema", "service", "route", "status")
+	gatewayLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_gateway_request_duration_seconds",
+		"Latency of requests proxied by the gateway.", nil, "schema", "service", "route")
 )
 
 func init() {
@@ -57,6 +67,14 @@ type GatewayServer struct {
 	ip          string
 	s           *fasthttp.Server
 	timeout     int64
+	stats       map[string]*nodeStat
+	routes      func() []Route
+	admin       *fasthttp.Server
+	adminPort   int
+	lifeMu      sync.Mutex
+	stopped     bool
+	adminToken  string
+	errResp     ErrorResponder
 }
 
 type Route struct {
@@ -77,23 +95,71 @@ func (s *GatewayServer) Init() {
 	s.timeout = config.GetInt64("gateway.timeout")
 	s.fastWatcher = make(chan bool, 32)
 	s.doers = make(map[string]Doer)
+	s.stats = make(map[string]*nodeStat)
+	config.SetDefault("gateway.admin.port", 0)
+	s.adminPort = int(config.GetInt64("gateway.admin.port"))
+	s.adminToken = config.GetString("gateway.admin.token")
+	config.SetDefault("gateway.errorMode", ERROR_MODE_LEGACY)
+	s.errResp = errorResponder(config.GetString("gateway.errorMode"))
 	registry.AddWatcher(s.fastWatcher)
 	s.ip = util.GetIP()
 	go s.watch()
 }
 
-func (s *GatewayServer) Run() {
+func (s *GatewayServer) Run(ready func()) error {
 	sort.Sort(s.incep)
+	listener, err := s.listen()
+	if err != nil || listener == nil {
+		return err
+	}
+	ready()
+	if err = s.s.Serve(listener); err != nil {
+		return errs.Wrap(errs.ERRCODE_GATEWAY, "gateway serve error", err)
+	}
+	return nil
+}
+
+// listen binds the admin and the gateway ports under lifeMu, so a concurrent Stop sees both servers or neither
+func (s *GatewayServer) listen() (net.Listener, error) {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.stopped {
+		return nil, nil
+	}
+	if s.adminPort > 0 {
+		if err := s.runAdmin(fmt.Sprintf("%s:%d", app.Addr(), s.adminPort)); err != nil {
+			return nil, err
+		}
+	}
+	addr := app.ListenAddr("gateway")
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		if s.admin != nil {
+			s.admin.Shutdown()
+		}
+		return nil, errs.Wrap(errs.ERRCODE_GATEWAY, "gateway listen error", err)
+	}
 	s.s = &fasthttp.Server{
 		Handler: s.combineHandler(),
 	}
-	if err := s.s.ListenAndServe(fmt.Sprintf("%s:%d", app.Addr(), app.Port())); err != nil {
-		logger.Fatal("gateway startup failed", err)
-	}
+	logger.Info("gateway listen on ", addr)
+	return listener, nil
 }
 
-func (s *GatewayServer) Stop() {
-	s.s.Shutdown()
+func (s *GatewayServer) Stop(ctx context.Context) {
+	s.lifeMu.Lock()
+	s.stopped = true
+	admin, srv := s.admin, s.s
+	s.lifeMu.Unlock()
+	if admin != nil {
+		admin.ShutdownWithContext(ctx)
+	}
+	if srv == nil {
+		return
+	}
+	if err := srv.ShutdownWithContext(ctx); err != nil {
+		logger.Error("gateway shutdown error", err)
+	}
 }
 
 type interceptors []*interceptor
@@ -130,11 +196,20 @@ func (s *GatewayServer) AddRpcEndpoint(d Doer) *GatewayServer {
 }
 
 func (s *GatewayServer) combineHandler() fasthttp.RequestHandler {
-	h := s.exec
+	h := metricsHandler(s.exec)
 	for _, inp := range s.incep {
 		h = inp.next(h)
 	}
-	return h
+	return stripUserID(h)
+}
+
+// stripUserID drops the user id sent by the client before the interceptors run,
+// so the user id forwarded to the services is only the one set by an auth interceptor
+func stripUserID(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.Request.Header.Del(logger.HEADER_USER_ID)
+		next(ctx)
+	}
 }
 
 func (s *GatewayServer) exec(ctx *fasthttp.RequestCtx) {
@@ -147,12 +222,27 @@ func (s *GatewayServer) exec(ctx *fasthttp.RequestCtx) {
 	method := strings.ToUpper(util.Bytes2str(ctx.Method()))
 	path := util.Bytes2str(ctx.Path())
 	subPath := fmt.Sprintf("%s:///%s", serviceSchema, strings.ReplaceAll(path, servicePath, ""))
+	tctx, span := trace.Start(trace.Extract(context.Background(), func(k string) string {
+		return string(req.Header.Peek(k))
+	}), fmt.Sprintf("%s %s", method, servicePath), trace.SPAN_KIND_SERVER)
+	span.SetAttr("http.method", method)
+	span.SetAttr("http.target", path)
+	span.SetAttr("micro.service", serviceName)
+	tctx = logger.Extract(tctx, func(k string) string {
+		return string(req.Header.Peek(k))
+	}, span.Context().TraceID.String())
+	ctx.SetUserValue(requestCtxKey{}, tctx)
+	log := logger.FromContext(tctx).Module(logModule)
+	defer func() {
+		resp.Header.Set(logger.HEADER_REQUEST_ID, logger.RequestIDFromContext(tctx))
+		span.SetAttr("http.status_code", resp.StatusCode())
+		span.End()
+	}()
 	if serviceSchema == "api" {
 		cli, err := s.selectCli(serviceName)
 		if err != nil {
-			logger.Error("remote api call error", errors.New("no service instance"))
-			body, _ := app.FailedResult(errs.ERRCODE_GATEWAY, "no service instance").Marshal()
-			ctx.Success(CONTENT_TYPE, body)
+			log.Error("remote api call error", errors.New("no service instance"))
+			s.fail(ctx, http.StatusServiceUnavailable, errs.ERRCODE_GATEWAY, "no service instance")
 			return
 		}
 		req.Header.SetHost(cli.Addr)
@@ -160,25 +250,31 @@ func (s *GatewayServer) exec(ctx *fasthttp.RequestCtx) {
 		req.Header.Del(MICRO_SERVICE_NAME)
 		ctx.Request.SetRequestURI(subPath)
 		req.SetHost(cli.Addr)
-		if err := cli.DoTimeout(req, resp, time.Duration(s.timeout)*time.Second); err != nil {
-			logger.Error("remote api call error", err)
-			body, _ := app.FailedResult(errs.ERRCODE_GATEWAY, err.Error()).Marshal()
-			ctx.Success(CONTENT_TYPE, body)
+		trace.Inject(tctx, func(k, v string) {
+			req.Header.Set(k, v)
+		})
+		logger.Inject(tctx, func(k, v string) {
+			req.Header.Set(k, v)
+		})
+		span.SetAttr("net.peer.name", cli.Addr)
+		st := s.nodeStat(cli.Addr)
+		st.begin()
+		start := time.Now()
+		err = cli.DoTimeout(req, resp, time.Duration(s.timeout)*time.Second)
+		st.end(time.Since(start), err)
+		if err != nil {
+			log.Error("remote api call error", err)
+			span.SetError(err)
+			s.failErr(ctx, err)
 		}
 	} else if serviceSchema == "rpc" {
 		key := lbServiceRegexp.FindString(path)
 		if key == "" {
-			logger.Error("url parse error", errors.New("url parse error"))
-			body, _ := app.FailedResult(errs.ERRCODE_GATEWAY, "url parse error").Marshal()
-			ctx.Success(CONTENT_TYPE, body)
+			log.Error("url parse error", errors.New("url parse error"))
+			s.fail(ctx, http.StatusNotFound, errs.ERRCODE_GATEWAY, "url parse error")
 			return
 		}
 		if d, ok := s.doers[key]; ok {
-			token := ctx.Request.Header.Peek("Authorization")
-			c, cancel := context.WithTimeout(context.Background(), time.Duration(s.timeout)*time.Second)
-			pair := metadata.Pairs("Authorization", util.Bytes2str(token))
-			c = metadata.NewOutgoingContext(c, pair)
-			defer cancel()
 			var in []byte
 			switch method {
 			case http.MethodGet:
@@ -190,38 +286,36 @@ func (s *GatewayServer) exec(ctx *fasthttp.RequestCtx) {
 			case http.MethodDelete:
 				in = req.URI().FullURI()
 			default:
-				logger.Error("method not allowed", errors.New("method not allowed"))
-				body, _ := app.FailedResult(errs.ERRCODE_GATEWAY, "method not allowed").Marshal()
-				ctx.Success(CONTENT_TYPE, body)
+				log.Error("method not allowed", errors.New("method not allowed"))
+				resp.Header.Set("Allow", "GET, POST, PUT, DELETE")
+				s.fail(ctx, http.StatusMethodNotAllowed, errs.ERRCODE_GATEWAY, "method not allowed")
+				return
 			}
+			token := ctx.Request.Header.Peek("Authorization")
+			c, cancel := context.WithTimeout(tctx, time.Duration(s.timeout)*time.Second)
+			pair := metadata.Pairs("Authorization", util.Bytes2str(token))
+			c = metadata.NewOutgoingContext(c, pair)
+			defer cancel()
 			out, err := d.Do(c, method, path, in)
-			resp.Header.Set("Content-Type", "application/json")
-			resp.Header.Set("Date", time.Now().Format(time.RFC1123))
 			if err != nil {
-				var body []byte
-				if st, ok := status.FromError(err); ok {
-					body, _ = app.FailedResult(int(st.Code()), st.Message()).Marshal()
-				} else {
-					body, _ = app.FailedResult(errs.ERRCODE_GATEWAY, err.Error()).Marshal()
-				}
-				resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
-				logger.Error(err.Error(), err)
-				ctx.Success(CONTENT_TYPE, body)
+				log.Error(err.Error(), err)
+				span.SetError(err)
+				s.failErr(ctx, err)
 			} else {
+				resp.Header.Set("Content-Type", "application/json")
+				resp.Header.Set("Date", time.Now().Format(time.RFC1123))
 				resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
 				resp.SetBody(out)
 			}
 			return
 		} else {
-			logger.Error("remote api call error", errors.New("no endpoint instance"))
-			body, _ := app.FailedResult(errs.ERRCODE_GATEWAY, "no endpoint instance").Marshal()
-			ctx.Success(CONTENT_TYPE, body)
+			log.Error("remote api call error", errors.New("no endpoint instance"))
+			s.fail(ctx, http.StatusNotFound, errs.ERRCODE_GATEWAY, "no endpoint instance")
 			return
 		}
 	} else {
-		logger.Error("remote api call error", errors.New("no support schema"))
-		body, _ := app.FailedResult(errs.ERRCODE_GATEWAY, "no support schema").Marshal()
-		ctx.Success(CONTENT_TYPE, body)
+		log.Error("remote api call error", errors.New("no support schema"))
+		s.fail(ctx, http.StatusBadGateway, errs.ERRCODE_GATEWAY, "no support schema")
 	}
 }
 
@@ -262,8 +356,12 @@ func (s *GatewayServer) roundRobin() {
 			s.clients = append(s.clients[:i], s.clients[i+1:]...)
 		}
 	}
+	for _, d := range dels {
+		delete(s.stats, d)
+	}
 	for _, a := range adds {
 		n := mt[a]
+		s.stats[a] = &nodeStat{}
 		s.clients = append(s.clients, &fasthttp.HostClient{
 			Addr:      a,
 			Name:      n,
@@ -273,22 +371,26 @@ func (s *GatewayServer) roundRobin() {
 	}
 	s.mu.Unlock()
 
-	var i = s.r.Int()
-	s.nextCli = func(sn string) (*fasthttp.HostClient, error) {
+	s.nextCli = s.roundRobinNext(uint64(s.r.Int()))
+}
+
+// roundRobinNext picks the nodes of a service in turn, skipping the draining and disabled ones
+func (s *GatewayServer) roundRobinNext(start uint64) nextClient {
+	var i atomic.Uint64
+	i.Store(start)
+	return func(sn string) (*fasthttp.HostClient, error) {
 		var clis []*fasthttp.HostClient
+		s.mu.RLock()
 		for _, cli := range s.clients {
-			if sn == cli.Name {
+			if sn == cli.Name && s.stats[cli.Addr].available() {
 				clis = append(clis, cli)
 			}
 		}
+		s.mu.RUnlock()
 		if len(clis) == 0 {
 			return nil, errors.New("no available nodes")
 		}
-		s.mu.RLock()
-		node := clis[i%len(clis)]
-		i++
-		s.mu.RUnlock()
-		return node, nil
+		return clis[(i.Add(1)-1)%uint64(len(clis))], nil
 	}
 }
 func (s *GatewayServer) selectCli(serviceName string) (n *fasthttp.HostClient, err error) {
@@ -308,7 +410,7 @@ func LogHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 		reqUri := util.Bytes2str(ctx.Request.RequestURI())
 		statusCode := ctx.Response.StatusCode()
 		clientIP := ctx.RemoteIP().String()
-		logger.Infof("code=%d took=%dms ip=%s method=%s path=%s",
+		logger.FromContext(RequestContext(ctx)).Module(logModule).Infof("code=%d took=%dms ip=%s method=%s path=%s",
 			statusCode,
 			latencyTime.Milliseconds(),
 			clientIP,
@@ -318,20 +420,48 @@ func LogHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	}
 }
 
+type requestCtxKey struct{}
+
+// RequestContext returns the context of the request built by the gateway, it carries the span and
+// the request logger after the request is handled
+func RequestContext(ctx *fasthttp.RequestCtx) context.Context {
+	if c, ok := ctx.UserValue(requestCtxKey{}).(context.Context); ok {
+		return c
+	}
+	return context.Background()
+}
+
+// metricsHandler labels requests by the route headers set by the routing interceptor
+func metricsHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		schema := string(ctx.Request.Header.Peek(MICRO_SERVICE_SCHEMA))
+		service := string(ctx.Request.Header.Peek(MICRO_SERVICE_NAME))
+		route := string(ctx.Request.Header.Peek(MICRO_SERVICE_PATH))
+		next(ctx)
+		if route == "" {
+			route = "unmatched"
+		}
+		gatewayRequests.Inc(schema, service, route, strconv.Itoa(ctx.Response.StatusCode()))
+		gatewayLatency.Observe(time.Since(start).Seconds(), schema, service, route)
+	}
+}
+
 func RecoverHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		defer func() {
 			if err := recover(); err != nil {
 				req := ctx.Request.String()
+				log := logger.FromContext(RequestContext(ctx)).Module(logModule)
 				if ne, ok := err.(error); ok {
 					ctx.Error(ne.Error(), http.StatusInternalServerError)
-					logger.Error("Recover from panic",
+					log.Error("Recover from panic",
 						err.(error),
 						logger.Val{K: "request", V: req},
 					)
 				} else {
 					ctx.Error("unknown error", http.StatusInternalServerError)
-					logger.Error("Recover from panic",
+					log.Error("Recover from panic",
 						nil,
 						logger.Val{K: "request", V: req},
 						logger.Val{K: "error", V: err},
@@ -0,0 +1,34 @@
+package gateway
+
+import (
+	"github.com/billyyoyo/microj/logger"
+	"github.com/valyala/fasthttp"
+	"testing"
+)
+
+func TestStripUserID(t *testing.T) {
+	var got []string
+	record := func(ctx *fasthttp.RequestCtx) {
+		got = append(got, string(ctx.Request.Header.Peek(logger.HEADER_USER_ID)))
+	}
+	auth := func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			if string(ctx.Request.Header.Peek("Authorization")) == "Bearer 123" {
+				ctx.Request.Header.Set(logger.HEADER_USER_ID, "u-1")
+			}
+			next(ctx)
+		}
+	}
+	h := stripUserID(auth(record))
+	for _, token := range []string{"", "Bearer 123"} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.Set(logger.HEADER_USER_ID, "admin")
+		if token != "" {
+			ctx.Request.Header.Set("Authorization", token)
+		}
+		h(&ctx)
+	}
+	if len(got) != 2 || got[0] != "" || got[1] != "u-1" {
+		t.Fatalf("forwarded user ids %q", got)
+	}
+}
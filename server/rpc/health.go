@@ -0,0 +1,196 @@
+package rpc
+
+import (
+	"github.com/billyyoyo/microj/config"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/registry"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"sync"
+	"time"
+)
+
+// HealthChecker reports whether a service registered through RegService is able to serve
+type HealthChecker func() bool
+
+type healthReporter struct {
+	hs         *health.Server
+	mu         sync.Mutex
+	checks     map[string]HealthChecker
+	manual     map[string]bool
+	services   []string
+	registered bool
+	timeout    time.Duration
+	seq        int64
+	applied    int64
+	regWatcher chan bool
+	stop       chan bool
+}
+
+// RegHealthCheck lets a service report its own health, service is the full grpc service name
+// like proto.Example, the checker is polled every rpc.healthInterval seconds and
+// counts as NOT_SERVING if it doesn't return in rpc.healthTimeout seconds
+func (s *RpcServer) RegHealthCheck(service string, fn HealthChecker) *RpcServer {
+	s.healthReporter().checks[service] = fn
+	return s
+}
+
+// SetServingStatus pushes the health of a service, it is still reported NOT_SERVING
+// until this instance is registered
+func (s *RpcServer) SetServingStatus(service string, serving bool) {
+	h := s.healthReporter()
+	h.mu.Lock()
+	h.manual[service] = serving
+	h.mu.Unlock()
+	h.refresh()
+}
+
+func (s *RpcServer) healthReporter() *healthReporter {
+	if s.health == nil {
+		s.health = &healthReporter{
+			checks:     make(map[string]HealthChecker),
+			manual:     make(map[string]bool),
+			regWatcher: make(chan bool, 8),
+			stop:       make(chan bool),
+		}
+	}
+	return s.health
+}
+
+// regHealth registers health and reflection services after all business services are registered
+func (s *RpcServer) regHealth() {
+	config.SetDefault("rpc.health", true)
+	config.SetDefault("rpc.reflection", true)
+	config.SetDefault("rpc.healthInterval", 10)
+	config.SetDefault("rpc.healthTimeout", 3)
+	if config.GetBool("rpc.health") {
+		h := s.healthReporter()
+		h.hs = health.NewServer()
+		h.timeout = time.Duration(config.GetInt64("rpc.healthTimeout")) * time.Second
+		for name := range s.s.GetServiceInfo() {
+			h.services = append(h.services, name)
+		}
+		healthpb.RegisterHealthServer(s.s, h.hs)
+		registry.AddRegisterWatcher(h.regWatcher)
+		h.registered = !registry.Enabled() || registry.Registered()
+		h.refresh()
+		go h.watch(time.Duration(config.GetInt64("rpc.healthInterval")) * time.Second)
+	}
+	if config.GetBool("rpc.reflection") {
+		reflection.Register(s.s)
+	}
+}
+
+// shutdownHealth flips every service to NOT_SERVING, later updates are ignored
+func (s *RpcServer) shutdownHealth() {
+	if s.health == nil || s.health.hs == nil {
+		return
+	}
+	close(s.health.stop)
+	s.health.hs.Shutdown()
+	logger.Info("rpc health set to NOT_SERVING")
+}
+
+// watch refreshes the status every interval, only on the registration changes if interval <= 0
+func (h *healthReporter) watch(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case ok := <-h.regWatcher:
+			h.mu.Lock()
+			h.registered = ok
+			h.mu.Unlock()
+			h.refresh()
+		case <-tick:
+			h.refresh()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// refresh runs the checkers outside the lock, the results of a refresh are dropped if a later one is already applied
+func (h *healthReporter) refresh() {
+	if h.hs == nil {
+		return
+	}
+	h.mu.Lock()
+	h.seq++
+	seq, registered := h.seq, h.registered
+	checks := make(map[string]HealthChecker, len(h.checks))
+	if registered {
+		for name, fn := range h.checks {
+			checks[name] = fn
+		}
+	}
+	h.mu.Unlock()
+	results := runChecks(checks, h.timeout)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq < h.applied {
+		return
+	}
+	h.applied = seq
+	all := registered
+	for _, name := range h.services {
+		serving := registered
+		if ok, checked := results[name]; checked && serving {
+			serving = ok
+		}
+		if m, ok := h.manual[name]; ok && serving {
+			serving = m
+		}
+		all = all && serving
+		h.hs.SetServingStatus(name, servingStatus(serving))
+	}
+	h.hs.SetServingStatus("", servingStatus(all))
+}
+
+// runChecks calls the checkers concurrently, one still running at the deadline reports false
+func runChecks(checks map[string]HealthChecker, timeout time.Duration) map[string]bool {
+	type result struct {
+		name string
+		ok   bool
+	}
+	results := make(map[string]bool, len(checks))
+	if len(checks) == 0 {
+		return results
+	}
+	done := make(chan result, len(checks))
+	for name, fn := range checks {
+		results[name] = false
+		go func(name string, fn HealthChecker) {
+			done <- result{name, fn()}
+		}(name, fn)
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for range checks {
+		select {
+		case r := <-done:
+			results[r.name] = r.ok
+		case <-deadline:
+			logger.Warn("rpc health check timeout")
+			return results
+		}
+	}
+	return results
+}
+
+func servingStatus(serving bool) healthpb.HealthCheckResponse_ServingStatus {
+	if serving {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
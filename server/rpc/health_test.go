@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"context"
+	"github.com/billyyoyo/microj/registry"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"testing"
+	"time"
+)
+
+func TestHealthWatchWithoutInterval(t *testing.T) {
+	s := &RpcServer{}
+	h := s.healthReporter()
+	h.hs = health.NewServer()
+	h.services = []string{"proto.Example"}
+	registry.AddRegisterWatcher(h.regWatcher)
+	h.refresh()
+	done := make(chan bool)
+	go func() {
+		h.watch(0)
+		close(done)
+	}()
+	defer func() {
+		close(h.stop)
+		<-done
+	}()
+
+	status := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := h.hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "proto.Example"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	if status() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatal("serving before registered")
+	}
+	registry.NotifyRegistered(true)
+	deadline := time.Now().Add(time.Second)
+	for status() != healthpb.HealthCheckResponse_SERVING {
+		if time.Now().After(deadline) {
+			t.Fatal("registration not applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	s := &RpcServer{}
+	h := s.healthReporter()
+	h.hs = health.NewServer()
+	h.services = []string{"proto.Example", "proto.Other"}
+	h.registered = true
+	h.timeout = 50 * time.Millisecond
+	block := make(chan bool)
+	defer close(block)
+	s.RegHealthCheck("proto.Example", func() bool {
+		<-block
+		return true
+	})
+	refreshed := make(chan bool)
+	go func() {
+		h.refresh()
+		close(refreshed)
+	}()
+	// the hung checker doesn't hold the lock
+	locked := make(chan bool)
+	go func() {
+		h.mu.Lock()
+		h.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lock held while checking")
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("refresh not bounded by the timeout")
+	}
+	for service, want := range map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"proto.Example": healthpb.HealthCheckResponse_NOT_SERVING,
+		"proto.Other":   healthpb.HealthCheckResponse_SERVING,
+		"":              healthpb.HealthCheckResponse_NOT_SERVING,
+	} {
+		resp, err := h.hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != want {
+			t.Errorf("service %q status %v, want %v", service, resp.Status, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"github.com/billyyoyo/microj/metrics"
+	"github.com/billyyoyo/microj/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const logModule = "rpc"
+
+var (
+	rpcHandled = metrics.NewCounterVec(metrics.NAMESPACE+"_rpc_server_handled_total",
+		"Total number of rpc calls handled by the rpc server.", "method", "code")
+	rpcLatency = metrics.NewHistogramVec(metrics.NAMESPACE+"_rpc_server_handling_seconds",
+		"Latency of rpc calls handled by the rpc server.", nil, "method")
+)
+
+type unaryInterceptors []*unaryInterceptor
+
+type unaryInterceptor struct {
+	index int32
+	fn    grpc.UnaryServerInterceptor
+}
+
+func (o unaryInterceptors) Len() int {
+	return len(o)
+}
+
+func (o unaryInterceptors) Less(i, j int) bool {
+	return o[i].index < o[j].index
+}
+
+func (o unaryInterceptors) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
+type streamInterceptors []*streamInterceptor
+
+type streamInterceptor struct {
+	index int32
+	fn    grpc.StreamServerInterceptor
+}
+
+func (o streamInterceptors) Len() int {
+	return len(o)
+}
+
+func (o streamInterceptors) Less(i, j int) bool {
+	return o[i].index < o[j].index
+}
+
+func (o streamInterceptors) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
+// TokenValidator checks the token carried by the Authorization metadata
+type TokenValidator func(ctx context.Context, token string) error
+
+func LogUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func LogStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logCall(ss.Context(), info.FullMethod, start, err)
+	return err
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	var clientIP string
+	if p, ok := peer.FromContext(ctx); ok {
+		clientIP = p.Addr.String()
+	}
+	logger.FromContext(ctx).Module(logModule).Infof("code=%s took=%dms ip=%s method=%s",
+		status.Code(err),
+		time.Since(start).Milliseconds(),
+		clientIP,
+		method,
+	)
+}
+
+// TraceUnaryInterceptor continues the trace carried by the incoming metadata and puts the request logger into ctx
+func TraceUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, span := startSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endSpan(span, err)
+	return resp, err
+}
+
+// TraceStreamInterceptor continues the trace carried by the incoming metadata and puts the request logger into ctx
+func TraceStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startSpan(ss.Context(), info.FullMethod)
+	err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+	endSpan(span, err)
+	return err
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func startSpan(ctx context.Context, method string) (context.Context, *trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(k string) string {
+		if vs := md.Get(k); len(vs) > 0 {
+			return vs[0]
+		}
+		return ""
+	}
+	ctx, span := trace.Start(trace.Extract(ctx, get), method, trace.SPAN_KIND_SERVER)
+	span.SetAttr("rpc.system", "grpc")
+	span.SetAttr("rpc.method", method)
+	return logger.Extract(ctx, get, span.Context().TraceID.String()), span
+}
+
+func endSpan(span *trace.Span, err error) {
+	span.SetAttr("rpc.grpc.status_code", status.Code(err).String())
+	span.SetError(err)
+	span.End()
+}
+
+func MetricsUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeCall(info.FullMethod, start, err)
+	return resp, err
+}
+
+func MetricsStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeCall(info.FullMethod, start, err)
+	return err
+}
+
+func observeCall(method string, start time.Time, err error) {
+	rpcHandled.Inc(method, status.Code(err).String())
+	rpcLatency.Observe(time.Since(start).Seconds(), method)
+}
+
+func RecoverUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverError(ctx, info.FullMethod, r)
+		}
+	}()
+	resp, err = handler(ctx, req)
+	return resp, errs.ToRpcError(err)
+}
+
+func RecoverStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverError(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return errs.ToRpcError(handler(srv, ss))
+}
+
+func recoverError(ctx context.Context, method string, r any) error {
+	log := logger.FromContext(ctx).Module(logModule)
+	if e, ok := r.(error); ok {
+		log.Error("Recover from panic", e, logger.Val{K: "method", V: method})
+		if _, ok := status.FromError(e); ok {
+			return e
+		}
+		if me, ok := errs.FromError(e); ok {
+			return errs.ToRpcError(me)
+		}
+		return status.Error(codes.Internal, e.Error())
+	}
+	log.Error("Recover from panic",
+		nil,
+		logger.Val{K: "method", V: method},
+		logger.Val{K: "error", V: r},
+	)
+	return status.Error(codes.Internal, errs.ERRMSG_UNKNOWN)
+}
+
+// AuthUnaryInterceptor validates the Authorization metadata of every call except the skipped full methods
+func AuthUnaryInterceptor(validate TokenValidator, skips ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := auth(ctx, info.FullMethod, validate, skips); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AuthStreamInterceptor validates the Authorization metadata of every stream except the skipped full methods
+func AuthStreamInterceptor(validate TokenValidator, skips ...string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := auth(ss.Context(), info.FullMethod, validate, skips); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func auth(ctx context.Context, method string, validate TokenValidator, skips []string) error {
+	for _, s := range skips {
+		if s == method {
+			return nil
+		}
+	}
+	token, err := GetMetadata(ctx, "Authorization")
+	if err != nil {
+		return err
+	}
+	if err = validate(ctx, token); err != nil {
+		if _, ok := errs.FromError(err); ok {
+			return errs.ToRpcError(err)
+		}
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Unauthenticated, fmt.Sprintf("invalid token: %s", err.Error()))
+	}
+	return nil
+}
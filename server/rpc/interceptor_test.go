@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chainUnary runs the interceptors like grpc.ChainUnaryInterceptor, the first one is the outermost
+func chainUnary(is []grpc.UnaryServerInterceptor, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) grpc.UnaryHandler {
+	for i := len(is) - 1; i >= 0; i-- {
+		in, next := is[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return in(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+func chainStream(is []grpc.StreamServerInterceptor, info *grpc.StreamServerInfo, handler grpc.StreamHandler) grpc.StreamHandler {
+	for i := len(is) - 1; i >= 0; i-- {
+		in, next := is[i], handler
+		handler = func(srv any, ss grpc.ServerStream) error {
+			return in(srv, ss, info, next)
+		}
+	}
+	return handler
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func funcPtr(fn any) uintptr {
+	return reflect.ValueOf(fn).Pointer()
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	var steps []string
+	record := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			steps = append(steps, name)
+			return handler(ctx, req)
+		}
+	}
+	recordStream := func(name string) grpc.StreamServerInterceptor {
+		return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			steps = append(steps, name)
+			return handler(srv, ss)
+		}
+	}
+	s := &RpcServer{}
+	s.AddUnaryInterceptor(3, record("3")).AddUnaryInterceptor(1, record("1")).AddUnaryInterceptor(2, record("2"))
+	s.AddStreamInterceptor(2, recordStream("s2")).AddStreamInterceptor(1, recordStream("s1"))
+	unary, stream := s.interceptors()
+
+	builtin := []any{TraceUnaryInterceptor, LogUnaryInterceptor, MetricsUnaryInterceptor, RecoverUnaryInterceptor}
+	if len(unary) != len(builtin)+3 {
+		t.Fatalf("%d unary interceptors", len(unary))
+	}
+	for i, fn := range builtin {
+		if funcPtr(unary[i]) != funcPtr(fn) {
+			t.Fatalf("unary interceptor %d is not builtin", i)
+		}
+	}
+	builtin = []any{TraceStreamInterceptor, LogStreamInterceptor, MetricsStreamInterceptor, RecoverStreamInterceptor}
+	for i, fn := range builtin {
+		if funcPtr(stream[i]) != funcPtr(fn) {
+			t.Fatalf("stream interceptor %d is not builtin", i)
+		}
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/example.Greeter/Hello"}
+	resp, err := chainUnary(unary, info, func(ctx context.Context, req any) (any, error) {
+		steps = append(steps, "handler")
+		return "hello", nil
+	})(context.Background(), "req")
+	if err != nil || resp != "hello" {
+		t.Fatalf("resp %v, error %v", resp, err)
+	}
+	sinfo := &grpc.StreamServerInfo{FullMethod: "/example.Greeter/Chat"}
+	err = chainStream(stream, sinfo, func(srv any, ss grpc.ServerStream) error {
+		steps = append(steps, "stream")
+		return nil
+	})(nil, &testStream{ctx: context.Background()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(steps, " "); got != "1 2 3 handler s1 s2 stream" {
+		t.Fatalf("order %s", got)
+	}
+}
+
+func TestRecoverBeforeUserInterceptors(t *testing.T) {
+	s := &RpcServer{}
+	s.AddUnaryInterceptor(1, func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		panic("interceptor down")
+	})
+	unary, _ := s.interceptors()
+	_, err := chainUnary(unary, &grpc.UnaryServerInfo{FullMethod: "/example.Greeter/Hello"}, nil)(context.Background(), nil)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("panic of user interceptor %v", err)
+	}
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	validate := func(ctx context.Context, token string) error {
+		if token != "Bearer good" {
+			return errors.New("expired")
+		}
+		return nil
+	}
+	withToken := func(token string) context.Context {
+		if token == "" {
+			return context.Background()
+		}
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+	}
+	unary := AuthUnaryInterceptor(validate, "/example.Greeter/Login")
+	stream := AuthStreamInterceptor(validate, "/example.Greeter/Login")
+	handled := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+	streamed := func(srv any, ss grpc.ServerStream) error {
+		return nil
+	}
+	cases := []struct {
+		method string
+		token  string
+		code   codes.Code
+	}{
+		{"/example.Greeter/Hello", "Bearer good", codes.OK},
+		{"/example.Greeter/Hello", "Bearer bad", codes.Unauthenticated},
+		{"/example.Greeter/Hello", "", codes.Unauthenticated},
+		{"/example.Greeter/Login", "", codes.OK},
+	}
+	for _, c := range cases {
+		_, err := unary(withToken(c.token), nil, &grpc.UnaryServerInfo{FullMethod: c.method}, handled)
+		if c.code == codes.OK && err != nil || c.code != codes.OK && err == nil {
+			t.Errorf("unary %s with %q: %v", c.method, c.token, err)
+		}
+		if c.code == codes.Unauthenticated && c.token != "" && status.Code(err) != codes.Unauthenticated {
+			t.Errorf("unary %s with %q: code %s", c.method, c.token, status.Code(err))
+		}
+		err = stream(nil, &testStream{ctx: withToken(c.token)}, &grpc.StreamServerInfo{FullMethod: c.method}, streamed)
+		if c.code == codes.OK && err != nil || c.code != codes.OK && err == nil {
+			t.Errorf("stream %s with %q: %v", c.method, c.token, err)
+		}
+	}
+}
@@ -4,19 +4,44 @@ import (
 	"context"
 	"fmt"
 	"github.com/billyyoyo/microj/app"
+	"github.com/billyyoyo/microj/config"
 	"github.com/billyyoyo/microj/errs"
 	"github.com/billyyoyo/microj/logger"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"net"
+	"sort"
 	"strings"
+	"time"
 )
 
 type RpcReg func(r *grpc.Server)
 
 type RpcServer struct {
-	rpcReg []RpcReg
-	s      *grpc.Server
+	rpcReg      []RpcReg
+	unaryIncep  unaryInterceptors
+	streamIncep streamInterceptors
+	opts        []grpc.ServerOption
+	health      *healthReporter
+	s           *grpc.Server
+}
+
+type Options struct {
+	MaxRecvMsgSize       int       `yaml:"maxRecvMsgSize"`
+	MaxSendMsgSize       int       `yaml:"maxSendMsgSize"`
+	MaxConcurrentStreams uint32    `yaml:"maxConcurrentStreams"`
+	Keepalive            Keepalive `yaml:"keepalive" mapstructure:"keepalive"`
+}
+
+// Keepalive all second unit
+type Keepalive struct {
+	Time                int64 `yaml:"time"`
+	Timeout             int64 `yaml:"timeout"`
+	MaxConnectionIdle   int64 `yaml:"maxConnectionIdle"`
+	MaxConnectionAge    int64 `yaml:"maxConnectionAge"`
+	MinTime             int64 `yaml:"minTime"`
+	PermitWithoutStream bool  `yaml:"permitWithoutStream"`
 }
 
 func (s *RpcServer) RegService(reg RpcReg) *RpcServer {
@@ -24,27 +49,122 @@ func (s *RpcServer) RegService(reg RpcReg) *RpcServer {
 	return s
 }
 
+// AddUnaryInterceptor adds an unary interceptor, the smaller index runs outer
+func (s *RpcServer) AddUnaryInterceptor(i int32, fn grpc.UnaryServerInterceptor) *RpcServer {
+	s.unaryIncep = append(s.unaryIncep, &unaryInterceptor{
+		index: i,
+		fn:    fn,
+	})
+	return s
+}
+
+// AddStreamInterceptor adds a stream interceptor, the smaller index runs outer
+func (s *RpcServer) AddStreamInterceptor(i int32, fn grpc.StreamServerInterceptor) *RpcServer {
+	s.streamIncep = append(s.streamIncep, &streamInterceptor{
+		index: i,
+		fn:    fn,
+	})
+	return s
+}
+
+// AddOption adds a raw grpc server option, applied after the ones loaded from config
+func (s *RpcServer) AddOption(opt grpc.ServerOption) *RpcServer {
+	s.opts = append(s.opts, opt)
+	return s
+}
+
 func (s *RpcServer) Init() {
 
 }
 
-func (s *RpcServer) Run() {
+func (s *RpcServer) Run(ready func()) error {
 	logger.Info("init proto server")
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", app.Addr(), app.Port()))
+	addr := app.ListenAddr("rpc")
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		logger.Fatal("grpc server listen error:", err)
+		return errs.Wrap(errs.ERRCODE_COMMON, "grpc server listen error", err)
 	}
-	rpcServer := grpc.NewServer()
-	for _, s := range s.rpcReg {
-		s(rpcServer)
+	logger.Info("grpc server listen on ", addr)
+	s.s = grpc.NewServer(s.serverOptions()...)
+	for _, reg := range s.rpcReg {
+		reg(s.s)
 	}
-	if err = rpcServer.Serve(listener); err != nil {
-		logger.Fatal("grpc server startup error:", err)
+	s.regHealth()
+	ready()
+	if err = s.s.Serve(listener); err != nil {
+		return errs.Wrap(errs.ERRCODE_COMMON, "grpc server serve error", err)
 	}
+	return nil
 }
 
-func (s *RpcServer) Stop() {
-	s.s.GracefulStop()
+func (s *RpcServer) Stop(ctx context.Context) {
+	if s.s == nil {
+		return
+	}
+	s.shutdownHealth()
+	done := make(chan bool)
+	go func() {
+		s.s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Error("grpc server graceful stop timeout", ctx.Err())
+		s.s.Stop()
+	}
+}
+
+// interceptors puts the builtin ones before the added ones sorted by index, the first runs outer
+func (s *RpcServer) interceptors() ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor) {
+	sort.Stable(s.unaryIncep)
+	sort.Stable(s.streamIncep)
+	unary := []grpc.UnaryServerInterceptor{TraceUnaryInterceptor, LogUnaryInterceptor, MetricsUnaryInterceptor, RecoverUnaryInterceptor}
+	for _, i := range s.unaryIncep {
+		unary = append(unary, i.fn)
+	}
+	stream := []grpc.StreamServerInterceptor{TraceStreamInterceptor, LogStreamInterceptor, MetricsStreamInterceptor, RecoverStreamInterceptor}
+	for _, i := range s.streamIncep {
+		stream = append(stream, i.fn)
+	}
+	return unary, stream
+}
+
+func (s *RpcServer) serverOptions() []grpc.ServerOption {
+	unary, stream := s.interceptors()
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+	var o Options
+	if err := config.Scan("rpc", &o); err != nil {
+		logger.Error("rpc server options load failed", err)
+	}
+	if o.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(o.MaxRecvMsgSize))
+	}
+	if o.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(o.MaxSendMsgSize))
+	}
+	if o.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(o.MaxConcurrentStreams))
+	}
+	ka := o.Keepalive
+	if ka.Time > 0 || ka.Timeout > 0 || ka.MaxConnectionIdle > 0 || ka.MaxConnectionAge > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:              time.Duration(ka.Time) * time.Second,
+			Timeout:           time.Duration(ka.Timeout) * time.Second,
+			MaxConnectionIdle: time.Duration(ka.MaxConnectionIdle) * time.Second,
+			MaxConnectionAge:  time.Duration(ka.MaxConnectionAge) * time.Second,
+		}))
+	}
+	if ka.MinTime > 0 || ka.PermitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Duration(ka.MinTime) * time.Second,
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}))
+	}
+	return append(opts, s.opts...)
 }
 
 func GetMetadata(ctx context.Context, key string) (value string, err error) {
@@ -0,0 +1,401 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/billyyoyo/microj/errs"
+	"github.com/billyyoyo/microj/logger"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EXPORTER_STDOUT = "stdout"
+	EXPORTER_FILE   = "file"
+	EXPORTER_OTLP   = "otlp"
+
+	defaultBatchSize = 512
+	defaultQueueSize = 2048
+)
+
+var (
+	tracer    = &provider{}
+	exporters = map[string]func(opts Options) (Exporter, error){
+		EXPORTER_STDOUT: func(opts Options) (Exporter, error) {
+			return NewWriterExporter(os.Stdout), nil
+		},
+		EXPORTER_FILE: NewFileExporter,
+		EXPORTER_OTLP: NewOtlpExporter,
+	}
+	exportersMu sync.Mutex
+)
+
+type Options struct {
+	Enable      bool   `yaml:"enable"`
+	ServiceName string `yaml:"-"`
+	Exporter    string `yaml:"exporter"`
+	// File is the path of the file exporter
+	File string `yaml:"file"`
+	// Endpoint is the OTLP/HTTP traces url like http://localhost:4318/v1/traces
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers"`
+	// SampleRatio of the new traces, 0 means all, child spans follow the parent
+	SampleRatio   float64 `yaml:"sampleRatio"`
+	BatchSize     int     `yaml:"batchSize"`
+	FlushInterval int64   `yaml:"flushInterval"` // second
+}
+
+// SpanData is an ended span handed to the exporter
+type SpanData struct {
+	Service  string            `json:"service"`
+	TraceID  string            `json:"traceId"`
+	SpanID   string            `json:"spanId"`
+	ParentID string            `json:"parentSpanId,omitempty"`
+	Name     string            `json:"name"`
+	Kind     SpanKind          `json:"kind"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// RegExporter adds an exporter selected by trace.exporter
+func RegExporter(name string, fn func(opts Options) (Exporter, error)) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	exporters[name] = fn
+}
+
+type provider struct {
+	on      bool
+	opts    Options
+	exp     Exporter
+	queue   chan SpanData
+	flush   chan chan bool
+	stop    chan bool
+	stopped chan bool
+	rnd     *rand.Rand
+	rndMu   sync.Mutex
+}
+
+// Init enables the exporting, spans are only propagated before it
+func Init(opts Options) error {
+	if !opts.Enable {
+		return nil
+	}
+	if opts.Exporter == "" {
+		opts.Exporter = EXPORTER_STDOUT
+	}
+	if opts.SampleRatio <= 0 || opts.SampleRatio > 1 {
+		opts.SampleRatio = 1
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5
+	}
+	exportersMu.Lock()
+	fn, ok := exporters[opts.Exporter]
+	exportersMu.Unlock()
+	if !ok {
+		return errs.NewInternal(fmt.Sprintf("unknown trace exporter %s", opts.Exporter))
+	}
+	exp, err := fn(opts)
+	if err != nil {
+		return err
+	}
+	tracer = &provider{
+		on:      true,
+		opts:    opts,
+		exp:     exp,
+		queue:   make(chan SpanData, defaultQueueSize),
+		flush:   make(chan chan bool),
+		stop:    make(chan bool),
+		stopped: make(chan bool),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	go tracer.run()
+	logger.Info("trace exporter ", opts.Exporter)
+	return nil
+}
+
+// Flush exports the queued spans
+func Flush(ctx context.Context) {
+	p := tracer
+	if !p.on {
+		return
+	}
+	done := make(chan bool)
+	select {
+	case p.flush <- done:
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-p.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown flushes the queued spans and closes the exporter
+func Shutdown(ctx context.Context) error {
+	p := tracer
+	if !p.on {
+		return nil
+	}
+	select {
+	case <-p.stopped:
+		return nil
+	default:
+	}
+	close(p.stop)
+	select {
+	case <-p.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.exp.Shutdown(ctx)
+}
+
+func (p *provider) enabled() bool {
+	return p.on
+}
+
+func (p *provider) sample() bool {
+	if !p.on || p.opts.SampleRatio >= 1 {
+		return true
+	}
+	p.rndMu.Lock()
+	defer p.rndMu.Unlock()
+	return p.rnd.Float64() < p.opts.SampleRatio
+}
+
+// export drops the span when the queue is full rather than blocking the request
+func (p *provider) export(d SpanData) {
+	d.Service = p.opts.ServiceName
+	select {
+	case p.queue <- d:
+	default:
+	}
+}
+
+func (p *provider) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(time.Duration(p.opts.FlushInterval) * time.Second)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, p.opts.BatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := p.exp.Export(ctx, batch); err != nil {
+			logger.Error("trace export error", err)
+		}
+		batch = make([]SpanData, 0, p.opts.BatchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case d := <-p.queue:
+				batch = append(batch, d)
+				if len(batch) >= p.opts.BatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case d := <-p.queue:
+			batch = append(batch, d)
+			if len(batch) >= p.opts.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-p.flush:
+			drain()
+			close(done)
+		case <-p.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// writerExporter writes one json span per line
+type writerExporter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w, enc: json.NewEncoder(w)}
+}
+
+func NewFileExporter(opts Options) (Exporter, error) {
+	if opts.File == "" {
+		return nil, errs.NewInternal("no trace file config")
+	}
+	f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errs.Wrap(errs.ERRCODE_COMMON, "trace file open error", err)
+	}
+	return NewWriterExporter(f), nil
+}
+
+func (e *writerExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		if err := e.enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *writerExporter) Shutdown(ctx context.Context) error {
+	if c, ok := e.w.(io.Closer); ok && e.w != os.Stdout && e.w != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// otlpExporter posts the spans in the OTLP/HTTP json encoding
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	cli      *http.Client
+}
+
+func NewOtlpExporter(opts Options) (Exporter, error) {
+	if opts.Endpoint == "" {
+		return nil, errs.NewInternal("no trace otlp endpoint config")
+	}
+	return &otlpExporter{
+		endpoint: opts.Endpoint,
+		headers:  opts.Headers,
+		cli:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (e *otlpExporter) Export(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.cli.Do(req)
+	if err != nil {
+		return errs.Wrap(errs.ERRCODE_REMOTE_CALL, "trace otlp export error", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errs.New(errs.ERRCODE_REMOTE_CALL, fmt.Sprintf("trace otlp export status %d", resp.StatusCode))
+	}
+	return nil
+}
+
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.cli.CloseIdleConnections()
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// otlpRequest groups the spans by service into an ExportTraceServiceRequest
+func otlpRequest(spans []SpanData) map[string]any {
+	byService := make(map[string][]otlpSpan)
+	var services []string
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		for k, v := range s.Attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		if _, ok := byService[s.Service]; !ok {
+			services = append(services, s.Service)
+		}
+		byService[s.Service] = append(byService[s.Service], o)
+	}
+	var rs []map[string]any
+	for _, name := range services {
+		rs = append(rs, map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{otlpAttr("service.name", name)},
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]string{"name": "github.com/billyyoyo/microj"},
+				"spans": byService[name],
+			}},
+		})
+	}
+	return map[string]any{"resourceSpans": rs}
+}
+
+func otlpAttr(k, v string) otlpKeyValue {
+	kv := otlpKeyValue{Key: k}
+	kv.Value.StringValue = v
+	return kv
+}
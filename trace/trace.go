@@ -0,0 +1,281 @@
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_TRACEPARENT = "traceparent"
+	HEADER_TRACESTATE  = "tracestate"
+)
+
+// SpanKind follows the numbering of the OTLP protocol
+type SpanKind int
+
+const (
+	SPAN_KIND_INTERNAL SpanKind = iota + 1
+	SPAN_KIND_SERVER
+	SPAN_KIND_CLIENT
+	SPAN_KIND_PRODUCER
+	SPAN_KIND_CONSUMER
+)
+
+var (
+	idRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	idMu   sync.Mutex
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span propagated across processes
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses the W3C traceparent header value, unknown versions are read as version 00
+func ParseTraceparent(s string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+type Span struct {
+	mu        sync.Mutex
+	sc        SpanContext
+	parent    SpanID
+	name      string
+	kind      SpanKind
+	start     time.Time
+	attrs     map[string]string
+	err       string
+	ended     bool
+	recording bool
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Start starts a child span of the span or remote span context in ctx, a new trace is started if none.
+// The span always propagates, it is only exported when tracing is enabled and the trace is sampled
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+	}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.sc.TraceState = parent.TraceState
+		s.parent = parent.SpanID
+	} else {
+		s.sc.TraceID = newTraceID()
+		s.sc.Sampled = tracer.sample()
+	}
+	s.sc.SpanID = newSpanID()
+	s.recording = s.sc.Sampled && tracer.enabled()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SpanFromContext returns nil if ctx carries no local span
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanContextFromContext returns the context of the local span, or the remote one extracted into ctx
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc
+	}
+	if ctx == nil {
+		return SpanContext{}
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// TraceIDFromContext returns an empty string if ctx is not traced
+func TraceIDFromContext(ctx context.Context) string {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID.String()
+}
+
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject writes the span context in ctx as W3C trace context headers
+func Inject(ctx context.Context, set func(k, v string)) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	set(HEADER_TRACEPARENT, sc.Traceparent())
+	if sc.TraceState != "" {
+		set(HEADER_TRACESTATE, sc.TraceState)
+	}
+}
+
+// Extract reads W3C trace context headers into ctx, ctx is returned as is if no valid traceparent
+func Extract(ctx context.Context, get func(k string) string) context.Context {
+	sc, ok := ParseTraceparent(get(HEADER_TRACEPARENT))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = get(HEADER_TRACESTATE)
+	return ContextWithRemote(ctx, sc)
+}
+
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+func (s *Span) IsRecording() bool {
+	return s.recording
+}
+
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttr is ignored once the span ended
+func (s *Span) SetAttr(k string, v any) {
+	if !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[k] = fmt.Sprint(v)
+}
+
+// SetError marks the span failed, nil is ignored and so is the error once the span ended
+func (s *Span) SetError(err error) {
+	if err == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End exports the span, calls after the first one are ignored
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	d := SpanData{
+		TraceID: s.sc.TraceID.String(),
+		SpanID:  s.sc.SpanID.String(),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   s.start,
+		End:     time.Now(),
+		Attrs:   s.attrs,
+		Error:   s.err,
+	}
+	s.mu.Unlock()
+	if !s.recording {
+		return
+	}
+	if s.parent.IsValid() {
+		d.ParentID = s.parent.String()
+	}
+	tracer.export(d)
+}
+
+func newTraceID() (t TraceID) {
+	idMu.Lock()
+	defer idMu.Unlock()
+	for !t.IsValid() {
+		idRand.Read(t[:])
+	}
+	return
+}
+
+func newSpanID() (s SpanID) {
+	idMu.Lock()
+	defer idMu.Unlock()
+	for !s.IsValid() {
+		idRand.Read(s[:])
+	}
+	return
+}
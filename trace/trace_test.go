@@ -0,0 +1,104 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	v := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(v)
+	if !ok || !sc.Sampled || sc.Traceparent() != v {
+		t.Fatalf("parse %s got %+v", v, sc)
+	}
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("invalid traceparent %q accepted", bad)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	headers := map[string]string{HEADER_TRACEPARENT: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	ctx := Extract(context.Background(), func(k string) string { return headers[k] })
+	ctx, span := Start(ctx, "child", SPAN_KIND_SERVER)
+	defer span.End()
+	if TraceIDFromContext(ctx) != "4bf92f3577b34da6a3ce929d0e0e4736" || span.parent.String() != "00f067aa0ba902b7" {
+		t.Fatalf("child span not in the remote trace: %+v", span.sc)
+	}
+	out := make(map[string]string)
+	Inject(ctx, func(k, v string) { out[k] = v })
+	if sc, ok := ParseTraceparent(out[HEADER_TRACEPARENT]); !ok || sc.SpanID != span.sc.SpanID {
+		t.Fatalf("injected %v", out)
+	}
+}
+
+func TestOtlpExporter(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer collector.Close()
+
+	err := Init(Options{Enable: true, ServiceName: "test", Exporter: EXPORTER_OTLP, Endpoint: collector.URL + "/v1/traces"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Shutdown(context.Background())
+		tracer = &provider{}
+	}()
+	ctx, parent := Start(context.Background(), "parent", SPAN_KIND_SERVER)
+	_, child := Start(ctx, "child", SPAN_KIND_CLIENT)
+	child.SetAttr("k", 1)
+	child.SetError(context.Canceled)
+	child.End()
+	parent.End()
+	Flush(context.Background())
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans[0].Spans) != 2 {
+		t.Fatalf("collector got %+v", got)
+	}
+	s := got.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.Name != "child" || s.ParentSpanID != parent.sc.SpanID.String() || s.Status.Code != 2 || s.Kind != SPAN_KIND_CLIENT {
+		t.Fatalf("child span exported as %+v", s)
+	}
+}
+
+func TestSpanEnded(t *testing.T) {
+	s := &Span{recording: true}
+	s.SetAttr("before", 1)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.SetAttr("during", i)
+		}
+	}()
+	s.End()
+	<-done
+	s.SetAttr("after", 1)
+	s.SetError(context.Canceled)
+	if _, ok := s.attrs["after"]; ok || s.err != "" {
+		t.Fatalf("span changed after end: %v %s", s.attrs, s.err)
+	}
+}